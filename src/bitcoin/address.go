@@ -0,0 +1,182 @@
+package bitcoin
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"math/big"
+	"strings"
+)
+
+// ErrChecksum is returned for a base58check string with a wrong checksum
+var ErrChecksum = errors.New("invalid base58 checksum")
+
+// Network holds the address prefixes of a Bitcoin network
+type Network struct {
+	Name       string
+	PubKeyHash byte
+	ScriptHash byte
+	Bech32HRP  string
+}
+
+var (
+	MainNet = &Network{Name: "mainnet", PubKeyHash: 0x00, ScriptHash: 0x05, Bech32HRP: "bc"}
+	TestNet = &Network{Name: "testnet", PubKeyHash: 0x6f, ScriptHash: 0xc4, Bech32HRP: "tb"}
+)
+
+// AddressType is the kind of script paying to a key
+type AddressType int
+
+const (
+	// P2PKH are the legacy addresses starting with 1
+	P2PKH AddressType = iota
+	// P2SHP2WPKH are the nested segwit addresses starting with 3
+	P2SHP2WPKH
+	// P2WPKH are the native segwit addresses starting with bc1q
+	P2WPKH
+)
+
+// Address returns the address of the compressed public key
+func (n *Network) Address(t AddressType, pubKey []byte) string {
+	h := hash160(pubKey)
+	switch t {
+	case P2SHP2WPKH:
+		// the script hash of the 0 <hash160> witness program
+		return base58CheckEncode(n.ScriptHash, hash160(append([]byte{0x00, 0x14}, h...)))
+	case P2WPKH:
+		return segwitEncode(n.Bech32HRP, 0, h)
+	default:
+		return base58CheckEncode(n.PubKeyHash, h)
+	}
+}
+
+func hash160(b []byte) []byte {
+	h := sha256.Sum256(b)
+	return ripemd160(h[:])
+}
+
+func doubleSHA256(b []byte) []byte {
+	h := sha256.Sum256(b)
+	h = sha256.Sum256(h[:])
+	return h[:]
+}
+
+const base58Alphabet = "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz"
+
+func base58Encode(b []byte) string {
+	n := new(big.Int).SetBytes(b)
+	radix, mod := big.NewInt(58), new(big.Int)
+
+	var out []byte
+	for n.Sign() > 0 {
+		n.DivMod(n, radix, mod)
+		out = append(out, base58Alphabet[mod.Int64()])
+	}
+	// each leading zero byte is a leading 1
+	for _, c := range b {
+		if c != 0 {
+			break
+		}
+		out = append(out, base58Alphabet[0])
+	}
+	for i, j := 0, len(out)-1; i < j; i, j = i+1, j-1 {
+		out[i], out[j] = out[j], out[i]
+	}
+	return string(out)
+}
+
+func base58Decode(s string) ([]byte, error) {
+	n, radix := new(big.Int), big.NewInt(58)
+	for _, c := range s {
+		idx := strings.IndexRune(base58Alphabet, c)
+		if idx < 0 {
+			return nil, errors.New("invalid base58 character")
+		}
+		n.Mul(n, radix)
+		n.Add(n, big.NewInt(int64(idx)))
+	}
+
+	zeros := 0
+	for zeros < len(s) && s[zeros] == base58Alphabet[0] {
+		zeros++
+	}
+	return append(make([]byte, zeros), n.Bytes()...), nil
+}
+
+func base58CheckEncode(version byte, payload []byte) string {
+	b := append([]byte{version}, payload...)
+	return base58Encode(append(b, doubleSHA256(b)[:4]...))
+}
+
+// base58CheckDecode returns the payload of a base58check string, with its version bytes
+func base58CheckDecode(s string) ([]byte, error) {
+	b, err := base58Decode(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) < 4 {
+		return nil, ErrChecksum
+	}
+	payload, checksum := b[:len(b)-4], b[len(b)-4:]
+	if !bytes.Equal(doubleSHA256(payload)[:4], checksum) {
+		return nil, ErrChecksum
+	}
+	return payload, nil
+}
+
+const bech32Charset = "qpzry9x8gf2tvdw0s3jn54khce6mua7l"
+
+func bech32Polymod(values []byte) uint32 {
+	gen := [5]uint32{0x3b6a57b2, 0x26508e6d, 0x1ea119fa, 0x3d4233dd, 0x2a1462b3}
+	chk := uint32(1)
+	for _, v := range values {
+		top := chk >> 25
+		chk = (chk&0x1ffffff)<<5 ^ uint32(v)
+		for i := 0; i < 5; i++ {
+			if (top>>i)&1 == 1 {
+				chk ^= gen[i]
+			}
+		}
+	}
+	return chk
+}
+
+// segwitEncode returns the bech32 address of a version 0 witness program (BIP 173)
+func segwitEncode(hrp string, version byte, program []byte) string {
+	// regroup the 8 bits bytes in 5 bits groups
+	data := []byte{version}
+	acc, n := 0, 0
+	for _, b := range program {
+		acc = acc<<8 | int(b)
+		n += 8
+		for n >= 5 {
+			n -= 5
+			data = append(data, byte(acc>>n)&31)
+		}
+	}
+	if n > 0 {
+		data = append(data, byte(acc<<(5-n))&31)
+	}
+
+	var values []byte
+	for _, c := range hrp {
+		values = append(values, byte(c)>>5)
+	}
+	values = append(values, 0)
+	for _, c := range hrp {
+		values = append(values, byte(c)&31)
+	}
+	values = append(values, data...)
+	polymod := bech32Polymod(append(values, 0, 0, 0, 0, 0, 0)) ^ 1
+	for i := 0; i < 6; i++ {
+		data = append(data, byte(polymod>>(5*(5-i)))&31)
+	}
+
+	var sb strings.Builder
+	sb.WriteString(hrp)
+	sb.WriteByte('1')
+	for _, d := range data {
+		sb.WriteByte(bech32Charset[d])
+	}
+	return sb.String()
+}
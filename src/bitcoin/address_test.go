@@ -0,0 +1,52 @@
+package bitcoin
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+func TestRipemd160(t *testing.T) {
+	for in, want := range map[string]string{
+		"":    "9c1185a5c5e9fc54612808977ee8f548b2258d31",
+		"abc": "8eb208f7e05d987a9b044a8e98c6b087f15a0bfc",
+		"abcdbcdecdefdefgefghfghighijhijkijkljklmklmnlmnomnopnopq": "12a053384a9c0c88e405a06c27dcf49ada62eb2b",
+	} {
+		if got := hex.EncodeToString(ripemd160([]byte(in))); got != want {
+			t.Errorf("ripemd160(%q): expected %s, got %s", in, want, got)
+		}
+	}
+}
+
+func TestNetwork_Address(t *testing.T) {
+	// the public key of the generator point
+	pub := generator().compressed()
+	if got := hex.EncodeToString(hash160(pub)); got != "751e76e8199196d454941c45d1b3a323f1433bd6" {
+		t.Fatalf("unexpected hash160 %s", got)
+	}
+
+	for typ, want := range map[AddressType]string{
+		P2PKH:      "1BgGZ9tcN4rm9KBzDn7KprQz87SZ26SAMH",
+		P2SHP2WPKH: "3JvL6Ymt8MVWiCNHC7oWU6nLeHNJKLZGLN",
+		P2WPKH:     "bc1qw508d6qejxtdg4y5r3zarvary0c5xw7kv8f3t4",
+	} {
+		if got := MainNet.Address(typ, pub); got != want {
+			t.Errorf("expected %s, got %s", want, got)
+		}
+	}
+	if got := TestNet.Address(P2WPKH, pub); got != "tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx" {
+		t.Errorf("unexpected testnet address %s", got)
+	}
+}
+
+func TestBase58Check(t *testing.T) {
+	payload, err := base58CheckDecode("1BgGZ9tcN4rm9KBzDn7KprQz87SZ26SAMH")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := hex.EncodeToString(payload); got != "00751e76e8199196d454941c45d1b3a323f1433bd6" {
+		t.Errorf("unexpected payload %s", got)
+	}
+	if _, err := base58CheckDecode("1BgGZ9tcN4rm9KBzDn7KprQz87SZ26SAMh"); err != ErrChecksum {
+		t.Errorf("expected a checksum error, got %v", err)
+	}
+}
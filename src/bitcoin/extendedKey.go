@@ -0,0 +1,145 @@
+package bitcoin
+
+import (
+	"crypto/hmac"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+var (
+	// ErrHardenedChild is returned when deriving a hardened child, which needs the private key
+	ErrHardenedChild = errors.New("cannot derive a hardened child from a public key")
+	// ErrUnusableChild is returned for the very unlikely indexes which don't give a valid key, the next index must be used
+	ErrUnusableChild = errors.New("invalid child key, use the next index")
+)
+
+// HardenedIndex is the first hardened child index
+const HardenedIndex = 0x80000000
+
+type keyVersion struct {
+	network *Network
+	address AddressType
+}
+
+// The versions of the extended public keys, which also tell the type of their addresses (SLIP 132)
+var keyVersions = map[[4]byte]keyVersion{
+	{0x04, 0x88, 0xb2, 0x1e}: {MainNet, P2PKH},      // xpub
+	{0x04, 0x9d, 0x7c, 0xb2}: {MainNet, P2SHP2WPKH}, // ypub
+	{0x04, 0xb2, 0x47, 0x46}: {MainNet, P2WPKH},     // zpub
+	{0x04, 0x35, 0x87, 0xcf}: {TestNet, P2PKH},      // tpub
+	{0x04, 0x4a, 0x52, 0x62}: {TestNet, P2SHP2WPKH}, // upub
+	{0x04, 0x5f, 0x1c, 0x4f}: {TestNet, P2WPKH},     // vpub
+}
+
+// ExtendedKey is a BIP 32 extended public key, from which the public keys of a wallet are derived
+type ExtendedKey struct {
+	version     [4]byte
+	depth       byte
+	fingerprint [4]byte
+	index       uint32
+	chainCode   []byte
+	pubKey      *point
+}
+
+// ParseExtendedKey parses an xpub, ypub or zpub, or their testnet tpub, upub and vpub variants
+func ParseExtendedKey(s string) (*ExtendedKey, error) {
+	b, err := base58CheckDecode(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) != 78 {
+		return nil, fmt.Errorf("invalid extended key length %d", len(b))
+	}
+
+	k := &ExtendedKey{depth: b[4], index: binary.BigEndian.Uint32(b[9:13]), chainCode: b[13:45]}
+	copy(k.version[:], b[:4])
+	copy(k.fingerprint[:], b[5:9])
+	if _, found := keyVersions[k.version]; !found {
+		return nil, fmt.Errorf("unsupported extended key version %x, only public keys are supported", k.version)
+	}
+	if k.pubKey, err = decompress(b[45:]); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// Network returns the network of the key
+func (k *ExtendedKey) Network() *Network {
+	return keyVersions[k.version].network
+}
+
+// AddressType returns the type of the addresses of the key, given by its version
+func (k *ExtendedKey) AddressType() AddressType {
+	return keyVersions[k.version].address
+}
+
+// PubKey returns the compressed public key
+func (k *ExtendedKey) PubKey() []byte {
+	return k.pubKey.compressed()
+}
+
+// Address returns the address of the public key
+func (k *ExtendedKey) Address() string {
+	return k.Network().Address(k.AddressType(), k.PubKey())
+}
+
+// Child derives the non hardened child key at index (BIP 32 CKDpub)
+func (k *ExtendedKey) Child(index uint32) (*ExtendedKey, error) {
+	if index >= HardenedIndex {
+		return nil, ErrHardenedChild
+	}
+
+	pub := k.PubKey()
+	mac := hmac.New(sha512.New, k.chainCode)
+	mac.Write(pub)
+	binary.Write(mac, binary.BigEndian, index)
+	i := mac.Sum(nil)
+
+	il := new(big.Int).SetBytes(i[:32])
+	if il.Cmp(curveN) >= 0 {
+		return nil, ErrUnusableChild
+	}
+	child := generator().mul(il).add(k.pubKey)
+	if child == nil {
+		return nil, ErrUnusableChild
+	}
+
+	c := &ExtendedKey{
+		version:   k.version,
+		depth:     k.depth + 1,
+		index:     index,
+		chainCode: i[32:],
+		pubKey:    child,
+	}
+	copy(c.fingerprint[:], hash160(pub)[:4])
+	return c, nil
+}
+
+// Derive derives the child keys along a path of indexes, like 0/5 for the 6th receive address
+func (k *ExtendedKey) Derive(path ...uint32) (*ExtendedKey, error) {
+	var err error
+	for _, index := range path {
+		if k, err = k.Child(index); err != nil {
+			return nil, err
+		}
+	}
+	return k, nil
+}
+
+// String serializes the key in base58check
+func (k *ExtendedKey) String() string {
+	b := make([]byte, 0, 78)
+	b = append(b, k.version[:]...)
+	b = append(b, k.depth)
+	b = append(b, k.fingerprint[:]...)
+	var index [4]byte
+	binary.BigEndian.PutUint32(index[:], k.index)
+	b = append(b, index[:]...)
+	b = append(b, k.chainCode...)
+	b = append(b, k.PubKey()...)
+
+	return base58Encode(append(b, doubleSHA256(b)[:4]...))
+}
@@ -0,0 +1,58 @@
+package bitcoin
+
+import (
+	"testing"
+)
+
+func TestExtendedKey_Child(t *testing.T) {
+	// BIP 32 test vector 1, from m/0H which is the last hardened key
+	k, err := ParseExtendedKey("xpub68Gmy5EdvgibQVfPdqkBBCHxA5htiqg55crXYuXoQRKfDBFA1WEjWgP6LHhwBZeNK1VTsfTFUHCdrfp1bgwQ9xv5ski8PX9rL2dZXvgGDnw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	child, err := k.Child(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "xpub6ASuArnXKPbfEwhqN6e3mwBcDTgzisQN1wXN9BJcM47sSikHjJf3UFHKkNAWbWMiGj7Wf5uMash7SyYq527Hqck2AxYysAA7xmALppuCkwQ"; child.String() != want {
+		t.Errorf("expected m/0H/1 %s, got %s", want, child.String())
+	}
+
+	if _, err := k.Child(HardenedIndex); err != ErrHardenedChild {
+		t.Errorf("expected ErrHardenedChild, got %v", err)
+	}
+}
+
+func TestExtendedKey_Address(t *testing.T) {
+	// the account keys of the "abandon abandon ... about" mnemonic (BIP 44, 49 and 84 test vectors)
+	for _, tt := range []struct {
+		key     string
+		path    []uint32
+		address string
+	}{
+		{"xpub6BosfCnifzxcFwrSzQiqu2DBVTshkCXacvNsWGYJVVhhawA7d4R5WSWGFNbi8Aw6ZRc1brxMyWMzG3DSSSSoekkudhUd9yLb6qx39T9nMdj", []uint32{0, 0}, "1LqBGSKuX5yYUonjxT5qGfpUsXKYYWeabA"},
+		{"ypub6Ww3ibxVfGzLrAH1PNcjyAWenMTbbAosGNB6VvmSEgytSER9azLDWCxoJwW7Ke7icmizBMXrzBx9979FfaHxHcrArf3zbeJJJUZPf663zsP", []uint32{0, 0}, "37VucYSaXLCAsxYyAPfbSi9eh4iEcbShgf"},
+		{"zpub6rFR7y4Q2AijBEqTUquhVz398htDFrtymD9xYYfG1m4wAcvPhXNfE3EfH1r1ADqtfSdVCToUG868RvUUkgDKf31mGDtKsAYz2oz2AGutZYs", []uint32{0, 0}, "bc1qcr8te4kr609gcawutmrza0j4xv80jy8z306fyu"},
+		{"zpub6rFR7y4Q2AijBEqTUquhVz398htDFrtymD9xYYfG1m4wAcvPhXNfE3EfH1r1ADqtfSdVCToUG868RvUUkgDKf31mGDtKsAYz2oz2AGutZYs", []uint32{0, 1}, "bc1qnjg0jd8228aq7egyzacy8cys3knf9xvrerkf9g"},
+		{"zpub6rFR7y4Q2AijBEqTUquhVz398htDFrtymD9xYYfG1m4wAcvPhXNfE3EfH1r1ADqtfSdVCToUG868RvUUkgDKf31mGDtKsAYz2oz2AGutZYs", []uint32{1, 0}, "bc1q8c6fshw2dlwun7ekn9qwf37cu2rn755upcp6el"},
+	} {
+		k, err := ParseExtendedKey(tt.key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		child, err := k.Derive(tt.path...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := child.Address(); got != tt.address {
+			t.Errorf("%v: expected %s, got %s", tt.path, tt.address, got)
+		}
+	}
+}
+
+func TestParseExtendedKey_private(t *testing.T) {
+	_, err := ParseExtendedKey("xprv9s21ZrQH143K3QTDL4LXw2F7HEK3wJUD2nW2nRk4stbPy6cq3jPPqjiChkVvvNKmPGJxWUtg6LnF5kejMRNNU3TGtRBeJgk33yuGBxrMPHi")
+	if err == nil {
+		t.Error("expected an error for a private key")
+	}
+}
@@ -0,0 +1,128 @@
+package bitcoin
+
+import (
+	"errors"
+	"math/big"
+)
+
+// The public key derivation only needs the addition and scalar multiplication of secp256k1 points,
+// crypto/elliptic doesn't support this curve
+
+var (
+	curveP  = hexInt("fffffffffffffffffffffffffffffffffffffffffffffffffffffffefffffc2f")
+	curveN  = hexInt("fffffffffffffffffffffffffffffffebaaedce6af48a03bbfd25e8cd0364141")
+	curveGx = hexInt("79be667ef9dcbbac55a06295ce870b07029bfcdb2dce28d959f2815b16f81798")
+	curveGy = hexInt("483ada7726a3c4655da4fbfc0e1108a8fd17b448a68554199c47d08ffb10d4b8")
+)
+
+// ErrInvalidPoint is returned for a public key which isn't on the curve
+var ErrInvalidPoint = errors.New("invalid secp256k1 public key")
+
+func hexInt(s string) *big.Int {
+	i, _ := new(big.Int).SetString(s, 16)
+	return i
+}
+
+// point is an affine point of the curve, nil is the point at infinity
+type point struct {
+	x, y *big.Int
+}
+
+func generator() *point {
+	return &point{curveGx, curveGy}
+}
+
+// add returns a+b
+func (a *point) add(b *point) *point {
+	switch {
+	case a == nil:
+		return b
+	case b == nil:
+		return a
+	case a.x.Cmp(b.x) == 0:
+		if a.y.Cmp(b.y) != 0 || a.y.Sign() == 0 {
+			return nil
+		}
+		return a.double()
+	}
+	// λ = (by - ay) / (bx - ax)
+	l := new(big.Int).Sub(b.y, a.y)
+	l.Mul(l, inverse(new(big.Int).Sub(b.x, a.x)))
+	l.Mod(l, curveP)
+	return a.line(l, b.x)
+}
+
+// double returns 2a
+func (a *point) double() *point {
+	if a == nil || a.y.Sign() == 0 {
+		return nil
+	}
+	// λ = 3ax² / 2ay
+	l := new(big.Int).Mul(a.x, a.x)
+	l.Mul(l, big.NewInt(3))
+	l.Mul(l, inverse(new(big.Int).Lsh(a.y, 1)))
+	l.Mod(l, curveP)
+	return a.line(l, a.x)
+}
+
+// line returns the third point of the line of slope l going through a and the point of abscissa bx, negated
+func (a *point) line(l, bx *big.Int) *point {
+	x := new(big.Int).Mul(l, l)
+	x.Sub(x, a.x)
+	x.Sub(x, bx)
+	x.Mod(x, curveP)
+
+	y := new(big.Int).Sub(a.x, x)
+	y.Mul(y, l)
+	y.Sub(y, a.y)
+	y.Mod(y, curveP)
+	return &point{x, y}
+}
+
+// mul returns k*a
+func (a *point) mul(k *big.Int) *point {
+	var r *point
+	for i := k.BitLen() - 1; i >= 0; i-- {
+		r = r.double()
+		if k.Bit(i) == 1 {
+			r = r.add(a)
+		}
+	}
+	return r
+}
+
+func inverse(v *big.Int) *big.Int {
+	return new(big.Int).ModInverse(new(big.Int).Mod(v, curveP), curveP)
+}
+
+// compressed returns the 33 bytes SEC1 compressed encoding of the point
+func (a *point) compressed() []byte {
+	out := make([]byte, 33)
+	out[0] = 0x02 + byte(a.y.Bit(0))
+	a.x.FillBytes(out[1:])
+	return out
+}
+
+// decompress parses a 33 bytes SEC1 compressed point
+func decompress(b []byte) (*point, error) {
+	if len(b) != 33 || (b[0] != 0x02 && b[0] != 0x03) {
+		return nil, ErrInvalidPoint
+	}
+	x := new(big.Int).SetBytes(b[1:])
+	if x.Cmp(curveP) >= 0 {
+		return nil, ErrInvalidPoint
+	}
+
+	// y² = x³ + 7, and p = 3 mod 4 so y = (y²)^((p+1)/4)
+	y2 := new(big.Int).Exp(x, big.NewInt(3), curveP)
+	y2.Add(y2, big.NewInt(7))
+	y2.Mod(y2, curveP)
+	y := new(big.Int).Exp(y2, new(big.Int).Rsh(new(big.Int).Add(curveP, big.NewInt(1)), 2), curveP)
+	if new(big.Int).Exp(y, big.NewInt(2), curveP).Cmp(y2) != 0 {
+		return nil, ErrInvalidPoint
+	}
+	if y.Bit(0) != uint(b[0]&1) {
+		y.Sub(curveP, y)
+	}
+	return &point{x, y}, nil
+}
@@ -0,0 +1,116 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/bottlepay/portfolio-data/model"
+	"github.com/bottlepay/portfolio-data/store"
+	"github.com/spf13/cobra"
+)
+
+// cgtCmd represents the cgt command
+var cgtCmd = &cobra.Command{
+	Use:   "cgt",
+	Short: "Report the UK capital gains of the custodians for a tax year",
+	Long: `Report the UK capital gains of the custodians of a state file for a tax year, in GBP.
+The disposals are matched with the same day acquisitions, the acquisitions of the next 30 days, then the Section 104 pool.
+The rates of the past come from the --forex-history file.`,
+	SilenceUsage:  true,
+	SilenceErrors: true,
+	RunE:          cgtRunner,
+}
+
+func init() {
+	rootCmd.AddCommand(cgtCmd)
+
+	cgtCmd.PersistentFlags().StringP("state", "s", "state.json", "the state file of the data service")
+	cgtCmd.PersistentFlags().Int32SliceP("custodian", "c", nil, "the custodians of the portfolio, all of them by default")
+	cgtCmd.PersistentFlags().StringP("year", "y", "", "the tax year, like 2021-22, the current one by default")
+	cgtCmd.PersistentFlags().StringP("format", "f", "csv", "the format of the report, csv or json")
+	addForexFlags(cgtCmd.PersistentFlags())
+	addForexHistoryFlags(cgtCmd.PersistentFlags())
+}
+
+func cgtRunner(cmd *cobra.Command, args []string) error {
+	flags := cmd.Flags()
+	stateFile, err := flags.GetString("state")
+	if err != nil {
+		return err
+	}
+	custIDs, err := flags.GetInt32Slice("custodian")
+	if err != nil {
+		return err
+	}
+	syear, err := flags.GetString("year")
+	if err != nil {
+		return err
+	}
+	year, err := taxYear(syear)
+	if err != nil {
+		return err
+	}
+	format, err := flags.GetString("format")
+	if err != nil {
+		return err
+	}
+	if format != "csv" && format != "json" {
+		return fmt.Errorf("invalid --format %q, expected csv or json", format)
+	}
+
+	forex, err := forexFromFlags(flags)
+	if err != nil {
+		return err
+	}
+	history, err := forexHistoryFromFlags(flags, forex)
+	if err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(stateFile); err != nil {
+		return err
+	}
+	s, err := store.NewStore(stateFile)
+	if err != nil {
+		return err
+	}
+	if len(custIDs) == 0 {
+		for _, c := range s.GetCustodiansWithoutTransactions() {
+			custIDs = append(custIDs, c.ID)
+		}
+	}
+	var custodians []*model.Custodian
+	for _, id := range custIDs {
+		c := s.GetCustodian(id)
+		if c == nil {
+			return fmt.Errorf("custodian %d not found", id)
+		}
+		custodians = append(custodians, c)
+	}
+
+	report := model.ComputeCGT(custodians, year, history.ForexRateAt)
+	for _, e := range report.Errors {
+		fmt.Fprintln(os.Stderr, "left out of the report:", e)
+	}
+	return writeCGTReport(os.Stdout, report, format)
+}
+
+// taxYear parses a tax year, the current one when it's empty
+func taxYear(s string) (model.TaxYear, error) {
+	if s == "" {
+		return model.TaxYearOf(time.Now()), nil
+	}
+	return model.ParseTaxYear(s)
+}
+
+// writeCGTReport writes the report as csv, only the disposals, or as json
+func writeCGTReport(w io.Writer, report *model.CGTReport, format string) error {
+	if format == "csv" {
+		return report.WriteCSV(w)
+	}
+	encoder := json.NewEncoder(w)
+	return encoder.Encode(report)
+}
@@ -10,6 +10,7 @@ import (
 	"os"
 	"os/signal"
 	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
@@ -20,6 +21,7 @@ import (
 	"github.com/go-chi/cors"
 	"github.com/shopspring/decimal"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 )
 
 // dataCmd represents the data command
@@ -36,10 +38,51 @@ func init() {
 	dataCmd.PersistentFlags().StringP("state", "s", "state.json", "file to save state to")
 	dataCmd.PersistentFlags().StringP("listen", "l", "0.0.0.0:9999", "the address to listen on")
 	dataCmd.PersistentFlags().IntP("timer", "t", 1, "the frequency (in seconds) with which to generate events. 0 disables automatic generation")
+	addForexFlags(dataCmd.PersistentFlags())
+	dataCmd.PersistentFlags().String("transfer-fee-percent", "0", "the percentage of a transfer charged by the sending custodian")
+	dataCmd.PersistentFlags().String("transfer-fee-flat", "", "the flat fees of the transfers, per asset, like BTC:0.0001,GBP:1")
+	dataCmd.PersistentFlags().String("forex-fee-percent", "0", "the percentage of an exchange charged by the custodian, in the received asset")
 
 	rand.Seed(time.Now().UnixNano())
 }
 
+// feesFromFlags reads the fees charged by the custodians
+func feesFromFlags(flags *pflag.FlagSet) (store.FeePolicy, error) {
+	var fees store.FeePolicy
+	for _, each := range []struct {
+		name  string
+		value *decimal.Decimal
+	}{
+		{"transfer-fee-percent", &fees.TransferPercent},
+		{"forex-fee-percent", &fees.ForexPercent},
+	} {
+		s, err := flags.GetString(each.name)
+		if err != nil {
+			return fees, err
+		}
+		if *each.value, err = decimal.NewFromString(s); err != nil || each.value.IsNegative() {
+			return fees, fmt.Errorf("invalid --%s %q, expected a percentage of 0 or more", each.name, s)
+		}
+	}
+
+	s, err := flags.GetString("transfer-fee-flat")
+	if err != nil {
+		return fees, err
+	}
+	flat, err := parseBalances(s)
+	if err != nil {
+		return fees, fmt.Errorf("invalid --transfer-fee-flat: %w", err)
+	}
+	fees.TransferFlat = make(map[string]decimal.Decimal, len(flat))
+	for _, a := range flat {
+		if a.Balance.IsNegative() {
+			return fees, fmt.Errorf("invalid --transfer-fee-flat: negative %s fee", a.Code)
+		}
+		fees.TransferFlat[a.Code] = a.Balance
+	}
+	return fees, nil
+}
+
 func dataRunner(cmd *cobra.Command, args []string) error {
 	flags := cmd.Flags()
 	stateFile, err := flags.GetString("state")
@@ -57,8 +100,18 @@ func dataRunner(cmd *cobra.Command, args []string) error {
 		return err
 	}
 
-	// Load the data store
-	store, err := store.NewStore(stateFile)
+	forex, err := forexFromFlags(flags)
+	if err != nil {
+		return err
+	}
+
+	fees, err := feesFromFlags(flags)
+	if err != nil {
+		return err
+	}
+
+	// Load the data store, the data service is the only one saving a migrated state file
+	store, err := store.NewStore(stateFile, store.WithForexProvider(forex), store.WithFees(fees), store.WithMigrationSnapshot())
 	if err != nil {
 		return err
 	}
@@ -204,6 +257,7 @@ func NewServerContext(store *store.Store, listenAddr string) *ServerContext {
 
 	r.Get("/custodian/{id}", serverCtx.HandleGetCustodian)
 	r.Get("/generate", serverCtx.HandleGenerate)
+	r.Get("/forex", serverCtx.HandleGetForex)
 
 	return serverCtx
 }
@@ -216,6 +270,9 @@ func (s *ServerContext) Shutdown(ctx context.Context) error {
 	return s.server.Shutdown(ctx)
 }
 
+// HandleGetCustodian serves GET /custodian/{id}?since=<txID>&limit=<n>
+// With since, only the transactions after this ID are returned, limit of them at most.
+// The X-Last-Transaction-Id header tells the client if more transactions are available.
 func (s *ServerContext) HandleGetCustodian(w http.ResponseWriter, r *http.Request) {
 	id, _ := strconv.ParseInt(chi.URLParam(r, "id"), 10, 32)
 	if id < 0 {
@@ -223,17 +280,100 @@ func (s *ServerContext) HandleGetCustodian(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	custodian := s.store.GetCustodian(int32(id))
+	query := r.URL.Query()
+	since, limit := int64(0), int64(0)
+	var err error
+	if v := query.Get("since"); v != "" {
+		if since, err = strconv.ParseInt(v, 10, 32); err != nil || since < 0 {
+			http.Error(w, "invalid since", http.StatusBadRequest)
+			return
+		}
+	}
+	if v := query.Get("limit"); v != "" {
+		if limit, err = strconv.ParseInt(v, 10, 32); err != nil || limit <= 0 {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+
+	// the validators must be the ones of the custodian in the body, even if an event happens meanwhile
+	var custodian *model.Custodian
+	var lastTxID int32
+	var modifiedAt time.Time
+	if since > 0 || limit > 0 {
+		custodian, lastTxID, modifiedAt = s.store.GetCustodianSince(int32(id), int32(since), int(limit))
+	} else {
+		custodian, lastTxID, modifiedAt = s.store.GetCustodianCopy(int32(id))
+	}
 	if custodian == nil {
 		http.Error(w, "not found", http.StatusNotFound)
 		return
 	}
 
+	// The custodian only changes with new transactions, so the last transaction ID
+	// is enough to tell the client if its copy is up to date
+	etag := fmt.Sprintf(`"%d-%d"`, id, lastTxID)
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Last-Modified", modifiedAt.UTC().Format(http.TimeFormat))
+	w.Header().Set("X-Last-Transaction-Id", strconv.Itoa(int(lastTxID)))
+	if notModified(r, etag, modifiedAt) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
 	w.Header().Add("content-type", "application/json")
 	encoder := json.NewEncoder(w)
 	encoder.Encode(custodian)
 }
 
+// notModified checks the If-None-Match and If-Modified-Since headers of a conditional request.
+// If-Modified-Since is ignored when If-None-Match is present.
+func notModified(r *http.Request, etag string, modifiedAt time.Time) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		for _, each := range strings.Split(inm, ",") {
+			each = strings.TrimPrefix(strings.TrimSpace(each), "W/")
+			if each == etag || each == "*" {
+				return true
+			}
+		}
+		return false
+	}
+	if ims, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err == nil {
+		// HTTP dates don't have sub-second precision
+		return !modifiedAt.Truncate(time.Second).After(ims)
+	}
+	return false
+}
+
+// HandleGetForex serves GET /forex?base=BTC, the rates used by the data service against the base currency,
+// the first supported currency by default. It's a rates feed for the http forex provider.
+func (s *ServerContext) HandleGetForex(w http.ResponseWriter, r *http.Request) {
+	forex := s.store.Forex()
+	codes := forex.Codes()
+	if len(codes) == 0 {
+		http.Error(w, "no forex rates", http.StatusServiceUnavailable)
+		return
+	}
+
+	base := strings.ToUpper(r.URL.Query().Get("base"))
+	if base == "" {
+		base = codes[0]
+	}
+	if !store.ForexSupports(forex, base) {
+		http.Error(w, "unsupported base currency", http.StatusBadRequest)
+		return
+	}
+	table, err := store.ForexSnapshot(forex, base)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Add("content-type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.Encode(table)
+}
+
 func (s *ServerContext) HandleGenerate(w http.ResponseWriter, r *http.Request) {
 	count, _ := strconv.ParseInt(r.URL.Query().Get("count"), 10, 64)
 	if count < 0 {
@@ -0,0 +1,86 @@
+package cmd
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/gavv/httpexpect/v2"
+)
+
+func Test_HandleGetCustodian_conditional(t *testing.T) {
+	e := httpexpect.New(t, "http://localhost:9999/")
+
+	res := e.GET("/custodian/1").
+		Expect().
+		Status(http.StatusOK)
+	res.Header("ETag").Equal(`"1-37"`)
+	lastModified := res.Header("Last-Modified").NotEmpty().Raw()
+
+	e.GET("/custodian/1").WithHeader("If-None-Match", `"1-37"`).
+		Expect().
+		Status(http.StatusNotModified).
+		Body().Empty()
+
+	e.GET("/custodian/1").WithHeader("If-None-Match", `"1-36"`).
+		Expect().
+		Status(http.StatusOK)
+
+	e.GET("/custodian/1").WithHeader("If-Modified-Since", lastModified).
+		Expect().
+		Status(http.StatusNotModified)
+
+	e.GET("/custodian/1").WithHeader("If-Modified-Since", "Mon, 01 Jan 2001 00:00:00 GMT").
+		Expect().
+		Status(http.StatusOK)
+}
+
+func Test_HandleGetCustodian_since(t *testing.T) {
+	e := httpexpect.New(t, "http://localhost:9999/")
+
+	res := e.GET("/custodian/1").WithQuery("since", 30).WithQuery("limit", 5).
+		Expect().
+		Status(http.StatusOK)
+	res.Header("X-Last-Transaction-Id").Equal("37")
+	txl := res.JSON().Object().Value("transactions").Array()
+	txl.Length().Equal(5)
+	txl.First().Object().Value("id").Equal(31)
+	txl.Last().Object().Value("id").Equal(35)
+
+	e.GET("/custodian/1").WithQuery("since", 35).
+		Expect().
+		Status(http.StatusOK).
+		JSON().Object().Value("transactions").Array().Length().Equal(2)
+
+	// up to date, no transactions
+	e.GET("/custodian/1").WithQuery("since", 37).
+		Expect().
+		Status(http.StatusOK).
+		JSON().Object().Keys().ContainsOnly("id", "assets")
+
+	e.GET("/custodian/1").WithQuery("since", "alpha").
+		Expect().
+		Status(http.StatusBadRequest)
+	e.GET("/custodian/1").WithQuery("limit", 0).
+		Expect().
+		Status(http.StatusBadRequest)
+}
+
+func Test_HandleGetForex(t *testing.T) {
+	e := httpexpect.New(t, "http://localhost:9999/")
+
+	rates := e.GET("/forex").
+		Expect().
+		Status(http.StatusOK).JSON().Object()
+	rates.Value("base").Equal("BTC")
+	rates.Value("as_of").String().NotEmpty()
+	rates.Value("rates").Object().Value("GBP").Equal("40000")
+
+	e.GET("/forex").WithQuery("base", "gbp").
+		Expect().
+		Status(http.StatusOK).JSON().Object().
+		Value("rates").Object().Value("BTC").Equal("0.000025")
+
+	e.GET("/forex").WithQuery("base", "XYZ").
+		Expect().
+		Status(http.StatusBadRequest)
+}
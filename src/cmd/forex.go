@@ -0,0 +1,111 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/bottlepay/portfolio-data/store"
+	"github.com/spf13/pflag"
+)
+
+// addForexFlags adds the flags selecting the forex provider, shared by the data and track commands
+func addForexFlags(flags *pflag.FlagSet) {
+	flags.String("forex", "static", "where the exchange rates come from: static for the built-in table, file, or http")
+	flags.String("forex-file", "rates.json", "the JSON or CSV rates file of the file forex provider")
+	flags.Duration("forex-reload", 10*time.Second, "how often the rates file is checked for modifications. 0 disables reloading")
+	flags.String("forex-url", "http://localhost:9999/forex", "the rates feed of the http forex provider")
+	flags.Duration("forex-ttl", time.Minute, "how long the rates of the http feed are cached")
+}
+
+// addForexHistoryFlags adds the flags of the historical rates
+func addForexHistoryFlags(flags *pflag.FlagSet) {
+	flags.String("forex-history", "", "a CSV file of time,from,to,rate historical rates")
+	flags.String("forex-lookup", "nearest", "how historical rates are found between two points: nearest before, or interpolate")
+	flags.Duration("forex-record", time.Minute, "how often the current rates are recorded in the historical rates. 0 only records them at startup")
+}
+
+func forexFromFlags(flags *pflag.FlagSet) (store.ForexProvider, error) {
+	provider, err := flags.GetString("forex")
+	if err != nil {
+		return nil, err
+	}
+
+	switch provider {
+	case "static":
+		return store.DefaultForexProvider(), nil
+	case "file":
+		path, err := flags.GetString("forex-file")
+		if err != nil {
+			return nil, err
+		}
+		reload, err := flags.GetDuration("forex-reload")
+		if err != nil {
+			return nil, err
+		}
+		return store.NewFileForexProvider(path, reload)
+	case "http":
+		u, err := flags.GetString("forex-url")
+		if err != nil {
+			return nil, err
+		}
+		ttl, err := flags.GetDuration("forex-ttl")
+		if err != nil {
+			return nil, err
+		}
+		return store.NewHTTPForexProvider(u, &http.Client{Timeout: 10 * time.Second}, ttl), nil
+	default:
+		return nil, fmt.Errorf("unknown forex provider %q, use static, file or http", provider)
+	}
+}
+
+// forexHistoryFromFlags loads the historical rates, and records the rates of the forex provider in them
+func forexHistoryFromFlags(flags *pflag.FlagSet, forex store.ForexProvider) (*store.ForexHistory, error) {
+	lookupFlag, err := flags.GetString("forex-lookup")
+	if err != nil {
+		return nil, err
+	}
+	lookup, err := store.ParseForexLookup(lookupFlag)
+	if err != nil {
+		return nil, err
+	}
+	history := store.NewForexHistory(lookup)
+
+	path, err := flags.GetString("forex-history")
+	if err != nil {
+		return nil, err
+	}
+	if path != "" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		if err := history.LoadCSV(f); err != nil {
+			return nil, fmt.Errorf("invalid forex history %s: %w", path, err)
+		}
+	}
+
+	interval, err := flags.GetDuration("forex-record")
+	if err != nil {
+		return nil, err
+	}
+	record := func() {
+		if codes := forex.Codes(); len(codes) > 0 {
+			if err := history.Record(forex, codes[0]); err != nil {
+				log.Printf("error recording forex rates: %v", err)
+			}
+		}
+	}
+	record()
+	if interval > 0 {
+		go func() {
+			for range time.Tick(interval) {
+				record()
+			}
+		}()
+	}
+	return history, nil
+}
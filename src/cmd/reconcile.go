@@ -0,0 +1,125 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/bottlepay/portfolio-data/model"
+	"github.com/bottlepay/portfolio-data/store"
+	"github.com/shopspring/decimal"
+	"github.com/spf13/cobra"
+)
+
+// reconcileCmd represents the reconcile command
+var reconcileCmd = &cobra.Command{
+	Use:           "reconcile",
+	Short:         "Reconcile the balances of the custodians with their transactions",
+	Long:          `Replay the transactions of the custodians of a state file from opening balances, and compare with their reported balances`,
+	SilenceUsage:  true,
+	SilenceErrors: true,
+	RunE:          reconcileRunner,
+}
+
+func init() {
+	rootCmd.AddCommand(reconcileCmd)
+
+	reconcileCmd.PersistentFlags().StringP("state", "s", "state.json", "the state file of the data service")
+	reconcileCmd.PersistentFlags().Int32P("custodian", "c", 0, "the custodian to reconcile, 0 for all of them")
+	reconcileCmd.PersistentFlags().String("opening", "", "the opening balances, like BTC:10.00000001,GBP:100000.01")
+	reconcileCmd.PersistentFlags().String("tolerance", "0", "the discrepancy allowed for each asset")
+}
+
+func reconcileRunner(cmd *cobra.Command, args []string) error {
+	flags := cmd.Flags()
+	stateFile, err := flags.GetString("state")
+	if err != nil {
+		return err
+	}
+	custID, err := flags.GetInt32("custodian")
+	if err != nil {
+		return err
+	}
+	sopening, err := flags.GetString("opening")
+	if err != nil {
+		return err
+	}
+	opening, err := parseBalances(sopening)
+	if err != nil {
+		return fmt.Errorf("invalid --opening: %w", err)
+	}
+	stolerance, err := flags.GetString("tolerance")
+	if err != nil {
+		return err
+	}
+	tolerance, err := decimal.NewFromString(stolerance)
+	if err != nil || tolerance.IsNegative() {
+		return fmt.Errorf("invalid --tolerance %q", stolerance)
+	}
+
+	if _, err := os.Stat(stateFile); err != nil {
+		return err
+	}
+	s, err := store.NewStore(stateFile)
+	if err != nil {
+		return err
+	}
+
+	var custodians []*model.Custodian
+	if custID == 0 {
+		for _, c := range s.GetCustodiansWithoutTransactions() {
+			custodians = append(custodians, s.GetCustodian(c.ID))
+		}
+	} else {
+		c := s.GetCustodian(custID)
+		if c == nil {
+			return fmt.Errorf("custodian %d not found", custID)
+		}
+		custodians = append(custodians, c)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(w, "custodian\tasset\ttxs\topening\tin\tout\tfees\treplayed\treported\tdiscrepancy\t\t")
+	failed := 0
+	for _, c := range custodians {
+		r := model.Reconcile(c, opening, tolerance)
+		if !r.Reconciled {
+			failed++
+		}
+		for _, ar := range r.Assets {
+			status := "ok"
+			if !ar.Reconciled {
+				status = "DRIFT"
+			}
+			fmt.Fprintf(w, "%d\t%s\t%d\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t\n", r.CustodianID, ar.Code, ar.Transactions,
+				ar.Opening, ar.In, ar.Out, ar.Fees, ar.Replayed, ar.Reported, ar.Discrepancy, status)
+		}
+	}
+	w.Flush()
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d custodians don't reconcile", failed, len(custodians))
+	}
+	return nil
+}
+
+// parseBalances parses a list of balances like BTC:10.00000001,GBP:100000.01, an empty list is valid
+func parseBalances(s string) ([]*model.Asset, error) {
+	var assets []*model.Asset
+	for _, each := range strings.Split(s, ",") {
+		if each = strings.TrimSpace(each); each == "" {
+			continue
+		}
+		parts := strings.SplitN(each, ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid balance %q, expected CODE:amount", each)
+		}
+		balance, err := decimal.NewFromString(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid balance %q: %w", each, err)
+		}
+		assets = append(assets, &model.Asset{Code: strings.ToUpper(parts[0]), Balance: balance})
+	}
+	return assets, nil
+}
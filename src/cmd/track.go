@@ -2,12 +2,17 @@ package cmd
 
 import (
 	"context"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"io"
+	"log"
 	"net/http"
 	"os"
 	"os/signal"
+	"sort"
 	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
@@ -17,7 +22,9 @@ import (
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 	"github.com/go-chi/cors"
+	"github.com/shopspring/decimal"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 )
 
 const (
@@ -32,25 +39,95 @@ var trackCmd = &cobra.Command{
 	RunE: func(cmd *cobra.Command, args []string) error {
 		flags := cmd.Flags()
 
-		userStore := store.NewFakeUserStore()
-		userStore.Populate()
+		userStore, err := userStoreFromFlags(context.Background(), flags)
+		if err != nil {
+			return err
+		}
+		if c, ok := userStore.(io.Closer); ok {
+			defer c.Close()
+		}
 
 		url, err := flags.GetString("custodian")
 		if err != nil {
 			panic("--custodian=URL is required")
 		}
-		custSvc := service.NewCustodianSvc(url)
+		concurrency, err := flags.GetInt("concurrency")
+		if err != nil {
+			return err
+		}
+		retry, err := retryPolicyFromFlags(flags)
+		if err != nil {
+			return err
+		}
+		breaker, err := breakerPolicyFromFlags(flags)
+		if err != nil {
+			return err
+		}
+		syncPageSize, err := flags.GetInt("sync-page-size")
+		if err != nil {
+			return err
+		}
+		opts := []service.CustodianSvcOption{
+			service.WithConcurrency(concurrency),
+			service.WithSyncPageSize(syncPageSize),
+			service.WithRetryPolicy(retry),
+			service.WithBreakerPolicy(breaker),
+		}
+		cacheOpt, err := cacheFromFlags(flags)
+		if err != nil {
+			return err
+		}
+		if cacheOpt != nil {
+			opts = append(opts, cacheOpt)
+		}
+		adapterOpts, err := adaptersFromFlags(flags, retry)
+		if err != nil {
+			return err
+		}
+		opts = append(opts, adapterOpts...)
+		custSvc := service.NewCustodianSvc(url, opts...)
+
+		forex, err := forexFromFlags(flags)
+		if err != nil {
+			return err
+		}
+		history, err := forexHistoryFromFlags(flags, forex)
+		if err != nil {
+			return err
+		}
 
 		r := chi.NewRouter()
 		r.Use(middleware.Logger)
-		r.Route("/user/{id}", func(r chi.Router) {
-			r.Use(handleUserCtx(userStore))
-			r.Get("/", handleUserRoute())
-			r.Get("/holdings", handleHoldingsRoute(custSvc))
-			r.Route("/custodian/{custId}", func(r chi.Router) {
-				r.Get("/transactions", handleTransactionsRoute(custSvc))
+		r.Route("/user", func(r chi.Router) {
+			r.Get("/", handleListUsersRoute(userStore))
+			r.Post("/", handleAddUserRoute(userStore, custSvc))
+			r.Route("/{id}", func(r chi.Router) {
+				r.Use(handleUserCtx(userStore))
+				r.Get("/", handleUserRoute())
+				r.Put("/", handleUpdateUserRoute(userStore, custSvc))
+				r.Delete("/", handleDeleteUserRoute(userStore))
+				r.Put("/custodians/{custId}", handleLinkCustodianRoute(userStore, custSvc))
+				r.Delete("/custodians/{custId}", handleUnlinkCustodianRoute(userStore))
+				r.Get("/holdings", handleHoldingsRoute(custSvc, forex, history))
+				r.Get("/history", handleHistoryRoute(custSvc, history))
+				r.Get("/transfers", handleTransfersRoute(custSvc))
+				r.Get("/flows", handleFlowsRoute(custSvc))
+				r.Get("/fees", handleFeesRoute(custSvc))
+				r.Get("/pnl", handlePnLRoute(custSvc, forex, history))
+				r.Get("/cgt", handleCGTRoute(custSvc, history))
+				r.Get("/exchanges", handleExchangesRoute(custSvc, history))
+				r.Route("/custodian/{custId}", func(r chi.Router) {
+					r.Get("/transactions", handleTransactionsRoute(custSvc))
+					r.Get("/reconcile", handleReconcileRoute(custSvc))
+					r.Get("/exchanges", handleExchangesRoute(custSvc, history))
+				})
 			})
 		})
+		// the admin routes would need their own authentication in production
+		r.Route("/admin", func(r chi.Router) {
+			r.Get("/breakers", handleBreakersRoute(custSvc))
+			r.Delete("/cache/{custId}", handleInvalidateRoute(custSvc))
+		})
 
 		listenAddr, err := flags.GetString("listen")
 		if err != nil {
@@ -89,6 +166,160 @@ var trackCmd = &cobra.Command{
 	},
 }
 
+// adaptersFromFlags registers the exchange adapters, in addition to the default mock adapter
+func adaptersFromFlags(flags *pflag.FlagSet, retry service.RetryPolicy) ([]service.CustodianSvcOption, error) {
+	coinbaseURL, err := flags.GetString("coinbase-url")
+	if err != nil {
+		return nil, err
+	}
+	binanceURL, err := flags.GetString("binance-url")
+	if err != nil {
+		return nil, err
+	}
+	esploraURL, err := flags.GetString("esplora-url")
+	if err != nil {
+		return nil, err
+	}
+	doer := service.NewRetryingClient(http.DefaultClient, retry)
+	return []service.CustodianSvcOption{
+		service.WithAdapter("coinbase", service.NewCoinbaseAdapter(coinbaseURL, doer)),
+		service.WithAdapter("binance", service.NewBinanceAdapter(binanceURL, doer)),
+		service.WithAdapter("bitcoin", service.NewBitcoinAdapter(esploraURL, doer)),
+	}, nil
+}
+
+// retryPolicyFromFlags reads the --retry-* flags
+func retryPolicyFromFlags(flags *pflag.FlagSet) (service.RetryPolicy, error) {
+	var p service.RetryPolicy
+	var err error
+
+	if p.MaxAttempts, err = flags.GetInt("retry-attempts"); err != nil {
+		return p, err
+	}
+	if p.BaseDelay, err = flags.GetDuration("retry-delay"); err != nil {
+		return p, err
+	}
+	if p.MaxDelay, err = flags.GetDuration("retry-max-delay"); err != nil {
+		return p, err
+	}
+	if p.Jitter, err = flags.GetFloat64("retry-jitter"); err != nil {
+		return p, err
+	}
+	if p.RetryableStatusCodes, err = flags.GetIntSlice("retry-status"); err != nil {
+		return p, err
+	}
+	return p, nil
+}
+
+// breakerPolicyFromFlags reads the --breaker-* flags
+func breakerPolicyFromFlags(flags *pflag.FlagSet) (service.BreakerPolicy, error) {
+	var p service.BreakerPolicy
+	var err error
+
+	if p.FailureThreshold, err = flags.GetInt("breaker-threshold"); err != nil {
+		return p, err
+	}
+	if p.CoolDown, err = flags.GetDuration("breaker-cooldown"); err != nil {
+		return p, err
+	}
+	if p.HalfOpenSuccesses, err = flags.GetInt("breaker-half-open"); err != nil {
+		return p, err
+	}
+	return p, nil
+}
+
+// cacheFromFlags reads the --cache-* and --redis-* flags, and returns nil when caching is disabled
+func cacheFromFlags(flags *pflag.FlagSet) (service.CustodianSvcOption, error) {
+	size, err := flags.GetInt("cache-size")
+	if err != nil {
+		return nil, err
+	}
+	if size <= 0 {
+		return nil, nil
+	}
+
+	var p service.CachePolicy
+	if p.TTL, err = flags.GetDuration("cache-ttl"); err != nil {
+		return nil, err
+	}
+	if p.StaleWhileRevalidate, err = flags.GetDuration("cache-stale"); err != nil {
+		return nil, err
+	}
+	if p.KeepExpired, err = flags.GetDuration("cache-keep"); err != nil {
+		return nil, err
+	}
+
+	backend, err := flags.GetString("cache-backend")
+	if err != nil {
+		return nil, err
+	}
+	switch backend {
+	case "memory":
+		return service.WithCache(service.NewLRUCache(size, p.MaxAge()), p), nil
+	case "redis":
+		addr, err := flags.GetString("redis-addr")
+		if err != nil {
+			return nil, err
+		}
+		password, err := flags.GetString("redis-password")
+		if err != nil {
+			return nil, err
+		}
+		return service.WithCache(service.NewRedisCache(addr, password, p.MaxAge()), p), nil
+	}
+	return nil, fmt.Errorf("invalid --cache-backend %q, expected memory or redis", backend)
+}
+
+// userStoreKeyEnv is the environment variable of the key of the user store, which keeps it out of the process list
+const userStoreKeyEnv = "USER_STORE_KEY"
+
+// userStoreFromFlags opens the store of the users, seeded with the fake user when it's empty
+func userStoreFromFlags(ctx context.Context, flags *pflag.FlagSet) (store.UserStore, error) {
+	backend, err := flags.GetString("user-store")
+	if err != nil {
+		return nil, err
+	}
+	switch backend {
+	case "memory":
+		s := store.NewFakeUserStore()
+		s.Populate()
+		return s, nil
+	case "sqlite":
+		path, err := flags.GetString("user-store-file")
+		if err != nil {
+			return nil, err
+		}
+		var opts []store.SQLUserStoreOption
+		key, err := flags.GetString("user-store-key")
+		if err != nil {
+			return nil, err
+		}
+		if key == "" {
+			key = os.Getenv(userStoreKeyEnv)
+		}
+		if key != "" {
+			k, err := hex.DecodeString(key)
+			if err != nil {
+				return nil, fmt.Errorf("invalid user store key: %w", err)
+			}
+			opts = append(opts, store.WithCredentialsKey(k))
+		} else {
+			log.Printf("the user store %s keeps the credentials in plain text, set $%s to encrypt them", path, userStoreKeyEnv)
+		}
+
+		s, err := store.OpenSQLiteUserStore(ctx, path, opts...)
+		if err != nil {
+			return nil, fmt.Errorf("error opening the user store %s: %w", path, err)
+		}
+		if err := s.Populate(); err != nil {
+			s.Close()
+			return nil, err
+		}
+		return s, nil
+	}
+	return nil, fmt.Errorf("invalid --user-store %q, expected memory or sqlite", backend)
+}
+
 // /user/{id} -> id in USERCONTEXT context value
 func handleUserCtx(s store.UserStore) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
@@ -114,16 +345,109 @@ func handleUserCtx(s store.UserStore) func(http.Handler) http.Handler {
 	}
 }
 
-// GET /user/{id}/holdings
-func handleHoldingsRoute(svc *service.CustodianSvc) http.HandlerFunc {
+// timeRangeFromQuery parses the optional RFC 3339 from and to variables of the url
+func timeRangeFromQuery(r *http.Request) (from, to time.Time, err error) {
+	query := r.URL.Query()
+	if v := query.Get("from"); v != "" {
+		if from, err = time.Parse(time.RFC3339, v); err != nil {
+			return from, to, fmt.Errorf("invalid from, use an RFC 3339 time")
+		}
+	}
+	if v := query.Get("to"); v != "" {
+		if to, err = time.Parse(time.RFC3339, v); err != nil {
+			return from, to, fmt.Errorf("invalid to, use an RFC 3339 time")
+		}
+	}
+	return from, to, nil
+}
+
+// partialHoldings is the response of GET /user/{id}/holdings?partial
+type partialHoldings struct {
+	Holdings     []*model.Asset             `json:"holdings"`
+	Valuation    *model.Valuation           `json:"valuation,omitempty"`
+	Custodians   []*service.CustodianStatus `json:"custodians"`
+	SourcesOK    int                        `json:"sources_ok"`
+	SourcesTotal int                        `json:"sources_total"`
+}
+
+// holdingsValuer values holdings in a quote currency, with the current rates or the historical rates at a time
+type holdingsValuer struct {
+	quote   string
+	at      time.Time
+	forex   store.ForexProvider
+	history *store.ForexHistory
+}
+
+func (hv *holdingsValuer) value(holdings []*model.Asset) *model.Valuation {
+	if hv.at.IsZero() {
+		v := model.ValueHoldings(holdings, hv.quote, hv.forex.Rate)
+		if asOf := hv.forex.AsOf(); !asOf.IsZero() {
+			v.RatesAsOf = &asOf
+		}
+		return v
+	}
+
+	v := model.ValueHoldings(holdings, hv.quote, func(from, to string) (decimal.Decimal, error) {
+		return hv.history.ForexRateAt(from, to, hv.at)
+	})
+	v.RatesAsOf = &hv.at
+	return v
+}
+
+// GET /user/{id}/holdings?partial&quote=GBP&at=2021-05-20T10:00:00Z
+func handleHoldingsRoute(svc *service.CustodianSvc, forex store.ForexProvider, history *store.ForexHistory) http.HandlerFunc {
 	return func(rw http.ResponseWriter, r *http.Request) {
 		user := r.Context().Value(USERCONTEXT).(*model.User)
 
+		// With the quote variable on the url, value the holdings in this currency,
+		// and with the at variable, use the historical rates at this time
+		valuer := &holdingsValuer{quote: strings.ToUpper(r.URL.Query().Get("quote")), forex: forex, history: history}
+		quote := valuer.quote
+		var rates interface{ Codes() []string } = forex
+		if at := r.URL.Query().Get("at"); at != "" {
+			var err error
+			if valuer.at, err = time.Parse(time.RFC3339, at); err != nil || quote == "" {
+				http.Error(rw, "invalid at in GET /user/{id}/holdings?quote=GBP&at=2021-05-20T10:00:00Z", http.StatusBadRequest)
+				return
+			}
+			rates = history
+		}
+		if quote != "" && !store.ForexSupports(rates, quote) {
+			http.Error(rw, "unsupported quote currency in GET /user/{id}/holdings?quote=GBP", http.StatusBadRequest)
+			return
+		}
+
 		// we'll use a 30s timeout to fetch the data
 		ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
 		defer cancel()
 
-		custodians, err := svc.FetchFromCustodian(ctx, user.Custodians...)
+		// With the partial variable on the url, aggregate the custodians which responded
+		// and report the status of each of them
+		if _, hasPartial := r.URL.Query()["partial"]; hasPartial {
+			res := &partialHoldings{
+				Custodians:   make([]*service.CustodianStatus, 0, len(user.Custodians)),
+				SourcesTotal: len(user.Custodians),
+			}
+			var custodians []*model.Custodian
+			for _, result := range svc.FetchAllAccounts(ctx, service.UserAccounts(user)...) {
+				res.Custodians = append(res.Custodians, result.Status())
+				if result.Err == nil {
+					custodians = append(custodians, result.Custodian)
+				}
+			}
+			res.SourcesOK = len(custodians)
+			res.Holdings = model.AggregateHoldings(custodians)
+			if quote != "" {
+				res.Valuation = valuer.value(res.Holdings)
+			}
+
+			rw.Header().Add("content-type", "application/json")
+			encoder := json.NewEncoder(rw)
+			encoder.Encode(res)
+			return
+		}
+
+		custodians, err := svc.FetchAccounts(ctx, service.UserAccounts(user)...)
 		if err != nil {
 			http.Error(rw, "custodian error", http.StatusInternalServerError)
 			return
@@ -132,48 +456,441 @@ func handleHoldingsRoute(svc *service.CustodianSvc) http.HandlerFunc {
 
 		rw.Header().Add("content-type", "application/json")
 		encoder := json.NewEncoder(rw)
+		if quote != "" {
+			encoder.Encode(valuer.value(holdings))
+			return
+		}
 		encoder.Encode(holdings)
 	}
 }
 
-// GET /user/{id}/custodian/{custId}/transactions?type=[0-3]&aggregate
-func handleTransactionsRoute(svc *service.CustodianSvc) http.HandlerFunc {
+// maxHistoryPoints limits the size of a history, 1000 days is almost 3 years
+const maxHistoryPoints = 1000
+
+// parseInterval parses a duration, with the d and w units for days and weeks, like 1d
+func parseInterval(s string) (time.Duration, error) {
+	for unit, d := range map[string]time.Duration{"d": 24 * time.Hour, "w": 7 * 24 * time.Hour} {
+		if n := strings.TrimSuffix(s, unit); n != s {
+			count, err := strconv.Atoi(n)
+			if err != nil {
+				return 0, err
+			}
+			return time.Duration(count) * d, nil
+		}
+	}
+	return time.ParseDuration(s)
+}
+
+// historyResponse is the response of GET /user/{id}/history
+type historyResponse struct {
+	*model.PortfolioHistory
+	Interval string    `json:"interval"`
+	From     time.Time `json:"from"`
+	To       time.Time `json:"to"`
+}
+
+// GET /user/{id}/history?quote=GBP&interval=1d&from=&to=
+func handleHistoryRoute(svc *service.CustodianSvc, history *store.ForexHistory) http.HandlerFunc {
 	return func(rw http.ResponseWriter, r *http.Request) {
 		user := r.Context().Value(USERCONTEXT).(*model.User)
 
+		quote := strings.ToUpper(r.URL.Query().Get("quote"))
+		if !store.ForexSupports(history, quote) {
+			http.Error(rw, "missing or unsupported quote currency in GET /user/{id}/history?quote=GBP&interval=1d", http.StatusBadRequest)
+			return
+		}
+		interval := r.URL.Query().Get("interval")
+		if interval == "" {
+			interval = "1d"
+		}
+		step, err := parseInterval(interval)
+		if err != nil || step < time.Minute {
+			http.Error(rw, "invalid interval, use a duration of at least 1m, like 1h, 1d or 1w", http.StatusBadRequest)
+			return
+		}
+		from, to, err := timeRangeFromQuery(r)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+
 		// we'll use a 30s timeout to fetch the data
 		ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
 		defer cancel()
 
-		scustId := chi.URLParam(r, "custId")
-		custId, err := strconv.Atoi(scustId)
+		custodians, err := svc.FetchAccounts(ctx, service.UserAccounts(user)...)
 		if err != nil {
-			http.Error(rw, "invalid custId in GET /user/{id}/custodian/{custId}/transactions?type=[0-3]", http.StatusBadRequest)
+			http.Error(rw, "custodian error", http.StatusInternalServerError)
 			return
 		}
 
-		// check this user has access to this custodian
-		found := false
-		for _, each := range user.Custodians {
-			if each == int32(custId) {
-				found = true
+		// By default, the history goes from the first transaction to now, up to maxHistoryPoints intervals
+		if to.IsZero() {
+			to = time.Now().UTC()
+		}
+		if from.IsZero() {
+			from = to
+			for _, c := range custodians {
+				for _, tx := range c.Transactions {
+					if !tx.Timestamp.IsZero() && tx.Timestamp.Before(from) {
+						from = tx.Timestamp
+					}
+				}
+			}
+			from = from.Truncate(step)
+			if to.Sub(from)/step >= maxHistoryPoints {
+				from = to.Add(-(maxHistoryPoints - 1) * step).Truncate(step)
 			}
 		}
-		if !found {
-			http.Error(rw, "invalid custodian ID", http.StatusUnauthorized)
+		if from.After(to) {
+			http.Error(rw, "from is after to", http.StatusBadRequest)
+			return
+		}
+		if to.Sub(from)/step >= maxHistoryPoints {
+			http.Error(rw, fmt.Sprintf("too many points, the history is limited to %d intervals", maxHistoryPoints), http.StatusBadRequest)
+			return
+		}
+
+		// a point at each interval, and the last one at the end of the history
+		var times []time.Time
+		for t := from; t.Before(to); t = t.Add(step) {
+			times = append(times, t)
+		}
+		times = append(times, to)
+
+		rw.Header().Add("content-type", "application/json")
+		encoder := json.NewEncoder(rw)
+		encoder.Encode(&historyResponse{
+			PortfolioHistory: model.ValueHistory(custodians, times, quote, history.ForexRateAt),
+			Interval:         interval,
+			From:             from,
+			To:               to,
+		})
+	}
+}
+
+// GET /user/{id}/transfers?status=matched&from=&to=
+func handleTransfersRoute(svc *service.CustodianSvc) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		user := r.Context().Value(USERCONTEXT).(*model.User)
+
+		status := model.TransferStatus(r.URL.Query().Get("status"))
+		switch status {
+		case "", model.TransferMatched, model.TransferMismatched, model.TransferOrphaned, model.TransferUnlinked:
+		default:
+			http.Error(rw, "invalid status, expected matched, mismatched, orphaned or unlinked", http.StatusBadRequest)
+			return
+		}
+		from, to, err := timeRangeFromQuery(r)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// we'll use a 30s timeout to fetch the data
+		ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+		defer cancel()
+
+		custodians, err := svc.FetchAccounts(ctx, service.UserAccounts(user)...)
+		if err != nil {
+			http.Error(rw, "custodian error", http.StatusInternalServerError)
+			return
+		}
+
+		transfers := make([]*model.Transfer, 0)
+		for _, t := range model.MatchTransfers(custodians) {
+			if status != "" && t.Status != status {
+				continue
+			}
+			if (!from.IsZero() && t.Timestamp.Before(from)) || (!to.IsZero() && !t.Timestamp.Before(to)) {
+				continue
+			}
+			transfers = append(transfers, t)
+		}
+
+		rw.Header().Add("content-type", "application/json")
+		encoder := json.NewEncoder(rw)
+		encoder.Encode(transfers)
+	}
+}
+
+// GET /user/{id}/flows?from=&to=
+func handleFlowsRoute(svc *service.CustodianSvc) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		user := r.Context().Value(USERCONTEXT).(*model.User)
+
+		from, to, err := timeRangeFromQuery(r)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// we'll use a 30s timeout to fetch the data
+		ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+		defer cancel()
+
+		custodians, err := svc.FetchAccounts(ctx, service.UserAccounts(user)...)
+		if err != nil {
+			http.Error(rw, "custodian error", http.StatusInternalServerError)
+			return
+		}
+
+		// With the from and to variables on the url, only keep the transactions in this time range
+		if !from.IsZero() || !to.IsZero() {
+			for i, c := range custodians {
+				custodians[i] = &model.Custodian{ID: c.ID, Assets: c.Assets, Transactions: model.FilterTransactionsByTime(c.Transactions, from, to)}
+			}
+		}
+
+		rw.Header().Add("content-type", "application/json")
+		encoder := json.NewEncoder(rw)
+		encoder.Encode(model.NetFlows(custodians))
+	}
+}
+
+// custodianFees are the fees paid by a custodian
+type custodianFees struct {
+	CustodianID int32          `json:"custodian_id"`
+	Fees        []*model.Asset `json:"fees"`
+}
+
+// feesResponse is the response of GET /user/{id}/fees
+type feesResponse struct {
+	Custodians []custodianFees `json:"custodians"`
+	Total      []*model.Asset  `json:"total"`
+}
+
+// GET /user/{id}/fees?from=2021-05-01T00:00:00Z&to=2021-06-01T00:00:00Z
+func handleFeesRoute(svc *service.CustodianSvc) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		user := r.Context().Value(USERCONTEXT).(*model.User)
+
+		from, to, err := timeRangeFromQuery(r)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// we'll use a 30s timeout to fetch the data
+		ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+		defer cancel()
+
+		custodians, err := svc.FetchAccounts(ctx, service.UserAccounts(user)...)
+		if err != nil {
+			http.Error(rw, "custodian error", http.StatusInternalServerError)
+			return
+		}
+
+		res := feesResponse{Custodians: make([]custodianFees, 0, len(custodians))}
+		total := model.NewAssetList()
+		for _, c := range custodians {
+			// With the from and to variables on the url, only keep the fees in this time range
+			if !from.IsZero() || !to.IsZero() {
+				c = &model.Custodian{ID: c.ID, Transactions: model.FilterTransactionsByTime(c.Transactions, from, to)}
+			}
+			fees := c.Fees()
+			for _, fee := range fees {
+				total.AddAssetValue(fee)
+			}
+			res.Custodians = append(res.Custodians, custodianFees{CustodianID: c.ID, Fees: fees})
+		}
+		res.Total = total.GetAssets()
+
+		rw.Header().Add("content-type", "application/json")
+		encoder := json.NewEncoder(rw)
+		encoder.Encode(res)
+	}
+}
+
+// GET /user/{id}/pnl?quote=GBP&method=fifo
+func handlePnLRoute(svc *service.CustodianSvc, forex store.ForexProvider, history *store.ForexHistory) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		user := r.Context().Value(USERCONTEXT).(*model.User)
+
+		quote := strings.ToUpper(r.URL.Query().Get("quote"))
+		if !store.ForexSupports(history, quote) || !store.ForexSupports(forex, quote) {
+			http.Error(rw, "missing or unsupported quote currency in GET /user/{id}/pnl?quote=GBP&method=fifo", http.StatusBadRequest)
+			return
+		}
+		method := model.FIFO
+		if v := r.URL.Query().Get("method"); v != "" {
+			var err error
+			if method, err = model.ParseCostBasisMethod(v); err != nil {
+				http.Error(rw, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
+		// we'll use a 30s timeout to fetch the data
+		ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+		defer cancel()
+
+		custodians, err := svc.FetchAccounts(ctx, service.UserAccounts(user)...)
+		if err != nil {
+			http.Error(rw, "custodian error", http.StatusInternalServerError)
+			return
+		}
+
+		rw.Header().Add("content-type", "application/json")
+		encoder := json.NewEncoder(rw)
+		encoder.Encode(model.ComputePnL(custodians, quote, method, history.ForexRateAt, forex.Rate))
+	}
+}
+
+// GET /user/{id}/cgt?year=2021-22&format=json
+func handleCGTRoute(svc *service.CustodianSvc, history *store.ForexHistory) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		user := r.Context().Value(USERCONTEXT).(*model.User)
+
+		year, err := taxYear(r.URL.Query().Get("year"))
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
 			return
 		}
+		format := r.URL.Query().Get("format")
+		if format == "" {
+			format = "json"
+		}
+		if format != "csv" && format != "json" {
+			http.Error(rw, "invalid format, expected csv or json", http.StatusBadRequest)
+			return
+		}
+
+		// we'll use a 30s timeout to fetch the data
+		ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+		defer cancel()
 
-		custodians, err := svc.FetchFromCustodian(ctx, int32(custId))
+		custodians, err := svc.FetchAccounts(ctx, service.UserAccounts(user)...)
 		if err != nil {
 			http.Error(rw, "custodian error", http.StatusInternalServerError)
 			return
 		}
-		if len(custodians) != 1 {
-			http.Error(rw, "custodian count error", http.StatusInternalServerError)
+
+		report := model.ComputeCGT(custodians, year, history.ForexRateAt)
+		if format == "csv" {
+			rw.Header().Add("content-type", "text/csv")
+			rw.Header().Add("content-disposition", fmt.Sprintf(`attachment; filename="cgt-%d-%s.csv"`, user.ID, year))
+			// the errors don't fit in the csv
+			if !report.Complete {
+				rw.Header().Add("X-Report-Incomplete", strings.Join(report.Errors, "; "))
+			}
+		} else {
+			rw.Header().Add("content-type", "application/json")
+		}
+		writeCGTReport(rw, report, format)
+	}
+}
+
+// exchangesResponse is the response of GET /user/{id}/exchanges
+type exchangesResponse struct {
+	Quote     string                   `json:"quote,omitempty"`
+	Exchanges []model.AssetExchange    `json:"exchanges"`
+	Pairs     []*model.ExchangeSummary `json:"pairs"`
+}
+
+// GET /user/{id}/exchanges?quote=GBP&from=&to=
+// GET /user/{id}/custodian/{custId}/exchanges?quote=GBP&from=&to=
+func handleExchangesRoute(svc *service.CustodianSvc, history *store.ForexHistory) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		user := r.Context().Value(USERCONTEXT).(*model.User)
+
+		// With the quote variable on the url, value the exchanges with the rates at their time
+		quote := strings.ToUpper(r.URL.Query().Get("quote"))
+		if quote != "" && !store.ForexSupports(history, quote) {
+			http.Error(rw, "unsupported quote currency in GET /user/{id}/exchanges?quote=GBP", http.StatusBadRequest)
+			return
+		}
+		from, to, err := timeRangeFromQuery(r)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// we'll use a 30s timeout to fetch the data
+		ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+		defer cancel()
+
+		var custodians []*model.Custodian
+		if chi.URLParam(r, "custId") != "" {
+			custodian, status, err := fetchUserCustodian(ctx, r, svc)
+			if err != nil {
+				http.Error(rw, err.Error(), status)
+				return
+			}
+			custodians = append(custodians, custodian)
+		} else {
+			if custodians, err = svc.FetchAccounts(ctx, service.UserAccounts(user)...); err != nil {
+				http.Error(rw, "custodian error", http.StatusInternalServerError)
+				return
+			}
+		}
+
+		res := &exchangesResponse{Quote: quote, Exchanges: make([]model.AssetExchange, 0)}
+		for _, c := range custodians {
+			for _, e := range c.GetAssetExchanges() {
+				if (!from.IsZero() && e.Timestamp.Before(from)) || (!to.IsZero() && !e.Timestamp.Before(to)) {
+					continue
+				}
+				res.Exchanges = append(res.Exchanges, e)
+			}
+		}
+		sort.SliceStable(res.Exchanges, func(i, j int) bool {
+			return res.Exchanges[i].Timestamp.Before(res.Exchanges[j].Timestamp)
+		})
+		if quote != "" {
+			model.ValueExchanges(res.Exchanges, quote, history.ForexRateAt)
+		}
+		res.Pairs = model.SummarizeExchanges(res.Exchanges)
+
+		rw.Header().Add("content-type", "application/json")
+		encoder := json.NewEncoder(rw)
+		encoder.Encode(res)
+	}
+}
+
+// fetchUserCustodian fetches the {custId} custodian of the user of the request,
+// with the HTTP status to respond with if it fails
+func fetchUserCustodian(ctx context.Context, r *http.Request, svc *service.CustodianSvc) (*model.Custodian, int, error) {
+	user := r.Context().Value(USERCONTEXT).(*model.User)
+
+	custId, err := strconv.Atoi(chi.URLParam(r, "custId"))
+	if err != nil {
+		return nil, http.StatusBadRequest, fmt.Errorf("invalid custId in %s", r.URL.Path)
+	}
+
+	// check this user has access to this custodian
+	found := false
+	for _, each := range user.Custodians {
+		if each == int32(custId) {
+			found = true
+		}
+	}
+	if !found {
+		return nil, http.StatusUnauthorized, fmt.Errorf("invalid custodian ID")
+	}
+
+	custodians, err := svc.FetchAccounts(ctx, service.UserAccount(user, int32(custId)))
+	if err != nil {
+		return nil, http.StatusInternalServerError, fmt.Errorf("custodian error")
+	}
+	if len(custodians) != 1 {
+		return nil, http.StatusInternalServerError, fmt.Errorf("custodian count error")
+	}
+	return custodians[0], http.StatusOK, nil
+}
+
+// GET /user/{id}/custodian/{custId}/transactions?type=[0-3]&from=&to=&aggregate
+func handleTransactionsRoute(svc *service.CustodianSvc) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		// we'll use a 30s timeout to fetch the data
+		ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+		defer cancel()
+
+		custodian, status, err := fetchUserCustodian(ctx, r, svc)
+		if err != nil {
+			http.Error(rw, err.Error(), status)
 			return
 		}
-		custodian := custodians[0]
 
 		var txl []*model.Transaction
 		if t, hasType := r.URL.Query()["type"]; hasType {
@@ -187,6 +904,16 @@ func handleTransactionsRoute(svc *service.CustodianSvc) http.HandlerFunc {
 			txl = custodian.Transactions
 		}
 
+		// With the from and to variables on the url, only keep the transactions in this time range
+		from, to, err := timeRangeFromQuery(r)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !from.IsZero() || !to.IsZero() {
+			txl = model.FilterTransactionsByTime(txl, from, to)
+		}
+
 		rw.Header().Add("content-type", "application/json")
 		encoder := json.NewEncoder(rw)
 
@@ -203,21 +930,380 @@ func handleTransactionsRoute(svc *service.CustodianSvc) http.HandlerFunc {
 	}
 }
 
+// GET /user/{id}/custodian/{custId}/reconcile?opening=BTC:10.00000001,GBP:100000.01&tolerance=0.0000001
+func handleReconcileRoute(svc *service.CustodianSvc) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		opening, err := parseBalances(r.URL.Query().Get("opening"))
+		if err != nil {
+			http.Error(rw, "invalid opening: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		tolerance := decimal.Zero
+		if v := r.URL.Query().Get("tolerance"); v != "" {
+			if tolerance, err = decimal.NewFromString(v); err != nil || tolerance.IsNegative() {
+				http.Error(rw, "invalid tolerance", http.StatusBadRequest)
+				return
+			}
+		}
+
+		// we'll use a 30s timeout to fetch the data
+		ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+		defer cancel()
+
+		custodian, status, err := fetchUserCustodian(ctx, r, svc)
+		if err != nil {
+			http.Error(rw, err.Error(), status)
+			return
+		}
+
+		rw.Header().Add("content-type", "application/json")
+		encoder := json.NewEncoder(rw)
+		encoder.Encode(model.Reconcile(custodian, opening, tolerance))
+	}
+}
+
+// GET /admin/breakers
+func handleBreakersRoute(svc *service.CustodianSvc) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Add("content-type", "application/json")
+		encoder := json.NewEncoder(rw)
+		encoder.Encode(svc.BreakerStates())
+	}
+}
+
+// DELETE /admin/cache/{custId}
+func handleInvalidateRoute(svc *service.CustodianSvc) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		custId, err := strconv.Atoi(chi.URLParam(r, "custId"))
+		if err != nil {
+			http.Error(rw, "invalid custId in DELETE /admin/cache/{custId}", http.StatusBadRequest)
+			return
+		}
+		if err := svc.Invalidate(r.Context(), int32(custId)); err != nil {
+			http.Error(rw, "cache error", http.StatusInternalServerError)
+			return
+		}
+		rw.WriteHeader(http.StatusNoContent)
+	}
+}
+
 // GET /user/{id}
 func handleUserRoute() http.HandlerFunc {
 	return func(rw http.ResponseWriter, r *http.Request) {
 		user := r.Context().Value(USERCONTEXT).(*model.User)
+		writeUser(rw, http.StatusOK, user)
+	}
+}
+
+// maxUsersPage is the maximum number of users listed at once
+const maxUsersPage = 1000
+
+// usersPage is the response of GET /user
+type usersPage struct {
+	Users []*model.User `json:"users"`
+	// Next is the after variable of the next page, when there may be one
+	Next *int32 `json:"next,omitempty"`
+}
+
+// userRequest is the body of POST /user and PUT /user/{id}
+type userRequest struct {
+	ID         int32                  `json:"id"`
+	Custodians []int32                `json:"custodians"`
+	Links      map[int32]*linkRequest `json:"links"`
+}
+
+// linkRequest is how a custodian is reached, the credentials are received but never sent back
+type linkRequest struct {
+	Adapter     string            `json:"adapter"`
+	Credentials map[string]string `json:"credentials"`
+}
+
+// link checks the adapter of the link exists
+func (l *linkRequest) link(svc *service.CustodianSvc) (*model.CustodianLink, error) {
+	if !svc.HasAdapter(l.Adapter) {
+		return nil, fmt.Errorf("unknown custodian adapter %q", l.Adapter)
+	}
+	return &model.CustodianLink{Adapter: l.Adapter, Credentials: l.Credentials}, nil
+}
+
+// user checks the custodians are positive IDs, linked once, and that the links are of linked custodians
+func (req *userRequest) user(svc *service.CustodianSvc) (*model.User, error) {
+	user := model.NewUser(req.ID)
+	for _, custID := range req.Custodians {
+		if custID <= 0 {
+			return nil, fmt.Errorf("invalid custodian %d", custID)
+		}
+		if user.Linked(custID) {
+			return nil, fmt.Errorf("custodian %d linked twice", custID)
+		}
+		user.Custodians = append(user.Custodians, custID)
+	}
+	for custID, l := range req.Links {
+		if !user.Linked(custID) {
+			return nil, fmt.Errorf("link of custodian %d, which isn't linked", custID)
+		}
+		link, err := l.link(svc)
+		if err != nil {
+			return nil, err
+		}
+		if user.Links == nil {
+			user.Links = make(map[int32]*model.CustodianLink)
+		}
+		user.Links[custID] = link
+	}
+	return user, nil
+}
+
+// writeUser writes the user, with its version as ETag
+func writeUser(rw http.ResponseWriter, status int, user *model.User) {
+	rw.Header().Set("ETag", fmt.Sprintf(`"%d"`, user.Version))
+	rw.Header().Add("content-type", "application/json")
+	rw.WriteHeader(status)
+	encoder := json.NewEncoder(rw)
+	encoder.Encode(user)
+}
+
+// ifMatchVersion reads the version of the user a modification is made from, in the If-Match header.
+// It also returns the status of the response when there's no valid version.
+func ifMatchVersion(r *http.Request) (int64, int, error) {
+	im := r.Header.Get("If-Match")
+	if im == "" {
+		return 0, http.StatusPreconditionRequired, fmt.Errorf("missing If-Match header, the ETag of the user")
+	}
+	version, err := strconv.ParseInt(strings.Trim(im, `"`), 10, 64)
+	if err != nil {
+		return 0, http.StatusBadRequest, fmt.Errorf("invalid If-Match header, expected the ETag of the user")
+	}
+	return version, 0, nil
+}
+
+// userStoreError writes the error of a user store modification
+func userStoreError(rw http.ResponseWriter, err error) {
+	switch err {
+	case store.UserNotFoundError, store.CustodianNotLinkedError:
+		http.Error(rw, err.Error(), http.StatusNotFound)
+	case store.UserVersionConflictError:
+		http.Error(rw, err.Error(), http.StatusPreconditionFailed)
+	case store.UserAlreadyExistsError:
+		http.Error(rw, err.Error(), http.StatusConflict)
+	default:
+		http.Error(rw, "user store error", http.StatusInternalServerError)
+	}
+}
+
+// GET /user?after=0&limit=100
+func handleListUsersRoute(s store.UserStore) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		after, limit := 0, 100
+		var err error
+		if v := query.Get("after"); v != "" {
+			if after, err = strconv.Atoi(v); err != nil || after < 0 {
+				http.Error(rw, "invalid after in GET /user?after=0&limit=100", http.StatusBadRequest)
+				return
+			}
+		}
+		if v := query.Get("limit"); v != "" {
+			if limit, err = strconv.Atoi(v); err != nil || limit <= 0 || limit > maxUsersPage {
+				http.Error(rw, fmt.Sprintf("invalid limit in GET /user?after=0&limit=100, at most %d", maxUsersPage), http.StatusBadRequest)
+				return
+			}
+		}
+
+		users, err := s.ListUsers(r.Context(), int32(after), limit)
+		if err != nil {
+			userStoreError(rw, err)
+			return
+		}
+		page := usersPage{Users: users}
+		if len(users) == limit {
+			next := users[len(users)-1].ID
+			page.Next = &next
+		}
 
-		// we'll use a 30s timeout to fetch the data
 		rw.Header().Add("content-type", "application/json")
 		encoder := json.NewEncoder(rw)
-		encoder.Encode(user)
+		encoder.Encode(page)
+	}
+}
+
+// POST /user
+func handleAddUserRoute(s store.UserStore, svc *service.CustodianSvc) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		var req userRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(rw, "invalid user in POST /user", http.StatusBadRequest)
+			return
+		}
+		if req.ID < 0 {
+			http.Error(rw, "invalid id in POST /user", http.StatusBadRequest)
+			return
+		}
+		user, err := req.user(svc)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if err := s.AddUser(r.Context(), user); err != nil {
+			userStoreError(rw, err)
+			return
+		}
+		rw.Header().Set("Location", fmt.Sprintf("/user/%d", user.ID))
+		writeUser(rw, http.StatusCreated, user)
+	}
+}
+
+// PUT /user/{id}
+func handleUpdateUserRoute(s store.UserStore, svc *service.CustodianSvc) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		current := r.Context().Value(USERCONTEXT).(*model.User)
+		version, status, err := ifMatchVersion(r)
+		if err != nil {
+			http.Error(rw, err.Error(), status)
+			return
+		}
+
+		var req userRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(rw, "invalid user in PUT /user/{id}", http.StatusBadRequest)
+			return
+		}
+		// the ID of the url is the one modified
+		req.ID = current.ID
+		user, err := req.user(svc)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		user.Version = version
+		if err := s.UpdateUser(r.Context(), user); err != nil {
+			userStoreError(rw, err)
+			return
+		}
+		writeUser(rw, http.StatusOK, user)
+	}
+}
+
+// DELETE /user/{id}
+func handleDeleteUserRoute(s store.UserStore) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		user := r.Context().Value(USERCONTEXT).(*model.User)
+		version, status, err := ifMatchVersion(r)
+		if err != nil {
+			http.Error(rw, err.Error(), status)
+			return
+		}
+
+		if err := s.DeleteUser(r.Context(), user.ID, version); err != nil {
+			userStoreError(rw, err)
+			return
+		}
+		rw.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// custIDParam reads the custId of the url, false when it isn't a custodian ID
+func custIDParam(r *http.Request) (int32, bool) {
+	custID, err := strconv.Atoi(chi.URLParam(r, "custId"))
+	return int32(custID), err == nil && custID > 0
+}
+
+// PUT /user/{id}/custodians/{custId}, with an optional {"adapter": "coinbase", "credentials": {...}} body.
+// The link of a custodian linked already is replaced.
+func handleLinkCustodianRoute(s store.UserStore, svc *service.CustodianSvc) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		user := r.Context().Value(USERCONTEXT).(*model.User)
+		custID, ok := custIDParam(r)
+		if !ok {
+			http.Error(rw, "invalid custId in PUT /user/{id}/custodians/{custId}", http.StatusBadRequest)
+			return
+		}
+		version, status, err := ifMatchVersion(r)
+		if err != nil {
+			http.Error(rw, err.Error(), status)
+			return
+		}
+
+		// without a body, the custodian is reached with the default adapter
+		var link *model.CustodianLink
+		var req linkRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+			http.Error(rw, "invalid link in PUT /user/{id}/custodians/{custId}", http.StatusBadRequest)
+			return
+		} else if err == nil && (req.Adapter != "" || len(req.Credentials) > 0) {
+			if link, err = req.link(svc); err != nil {
+				http.Error(rw, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
+		linked, err := s.LinkCustodian(r.Context(), user.ID, version, custID, link)
+		if err != nil {
+			userStoreError(rw, err)
+			return
+		}
+		writeUser(rw, http.StatusOK, linked)
+	}
+}
+
+// DELETE /user/{id}/custodians/{custId}
+func handleUnlinkCustodianRoute(s store.UserStore) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		user := r.Context().Value(USERCONTEXT).(*model.User)
+		custID, ok := custIDParam(r)
+		if !ok {
+			http.Error(rw, "invalid custId in DELETE /user/{id}/custodians/{custId}", http.StatusBadRequest)
+			return
+		}
+		version, status, err := ifMatchVersion(r)
+		if err != nil {
+			http.Error(rw, err.Error(), status)
+			return
+		}
+
+		unlinked, err := s.UnlinkCustodian(r.Context(), user.ID, version, custID)
+		if err != nil {
+			userStoreError(rw, err)
+			return
+		}
+		writeUser(rw, http.StatusOK, unlinked)
 	}
 }
 
 func init() {
 	trackCmd.PersistentFlags().StringP("listen", "l", "0.0.0.0:9998", "the address to listen on")
 	trackCmd.PersistentFlags().StringP("custodian", "c", "http://localhost:9999/custodian/", "the custodian service url")
+	retry := service.DefaultRetryPolicy()
+	trackCmd.PersistentFlags().Int("retry-attempts", retry.MaxAttempts, "the maximum number of attempts per custodian request. 1 disables retries")
+	trackCmd.PersistentFlags().Duration("retry-delay", retry.BaseDelay, "the delay before the first retry, doubled for each following retry")
+	trackCmd.PersistentFlags().Duration("retry-max-delay", retry.MaxDelay, "the maximum delay between two retries")
+	trackCmd.PersistentFlags().Float64("retry-jitter", retry.Jitter, "the fraction (0 to 1) of each retry delay which is randomized")
+	trackCmd.PersistentFlags().IntSlice("retry-status", retry.RetryableStatusCodes, "the HTTP status codes which are retried")
+	cache := service.DefaultCachePolicy()
+	trackCmd.PersistentFlags().String("cache-backend", "memory", "where custodians are cached: memory, or redis to share them between trackers")
+	trackCmd.PersistentFlags().String("redis-addr", "localhost:6379", "the address of the redis cache server")
+	trackCmd.PersistentFlags().String("redis-password", "", "the password of the redis cache server")
+	trackCmd.PersistentFlags().Int("cache-size", 1000, "the maximum number of accounts kept in the memory cache. 0 disables caching")
+	trackCmd.PersistentFlags().Duration("cache-ttl", cache.TTL, "how long a cached custodian is used without fetching it again")
+	trackCmd.PersistentFlags().Duration("cache-stale", cache.StaleWhileRevalidate, "how long after its ttl a stale custodian is still used, while it's refreshed in the background")
+	trackCmd.PersistentFlags().Duration("cache-keep", cache.KeepExpired, "how long an expired custodian is kept, to be revalidated with a conditional request instead of downloaded again")
+	trackCmd.PersistentFlags().Int("sync-page-size", service.DefaultSyncPageSize, "the number of new transactions fetched per request when syncing a cached custodian. 0 fetches them all at once")
+	trackCmd.PersistentFlags().String("user-store", "memory", "where users are stored: memory, forgotten on restart, or sqlite")
+	trackCmd.PersistentFlags().String("user-store-file", "users.db", "the database file of the sqlite user store, created readable by its owner only. "+
+		"It holds the credentials of the linked custodians, in plain text without --user-store-key")
+	trackCmd.PersistentFlags().String("user-store-key", "", "the hex encoded 32 bytes key encrypting the credentials in the sqlite user store, $"+userStoreKeyEnv+" by default")
+	breaker := service.DefaultBreakerPolicy()
+	trackCmd.PersistentFlags().Int("breaker-threshold", breaker.FailureThreshold, "the number of consecutive failures which opens the circuit breaker of a custodian. 0 disables the breakers")
+	trackCmd.PersistentFlags().Duration("breaker-cooldown", breaker.CoolDown, "how long an open circuit breaker rejects requests before probing the custodian again")
+	trackCmd.PersistentFlags().Int("breaker-half-open", breaker.HalfOpenSuccesses, "the number of successful probes needed to close a circuit breaker")
+	trackCmd.PersistentFlags().String("coinbase-url", "https://api.coinbase.com", "the base url of the Coinbase-style API used by the coinbase adapter")
+	trackCmd.PersistentFlags().String("binance-url", "https://api.binance.com", "the base url of the Binance-style API used by the binance adapter")
+	trackCmd.PersistentFlags().String("esplora-url", "https://blockstream.info/api", "the base url of the Esplora block explorer API used by the bitcoin adapter")
+	addForexFlags(trackCmd.PersistentFlags())
+	addForexHistoryFlags(trackCmd.PersistentFlags())
+	trackCmd.PersistentFlags().Int("concurrency", service.DefaultConcurrency, "the maximum number of custodians fetched in parallel. 1 fetches them sequentially")
 
 	rootCmd.AddCommand(trackCmd)
 }
@@ -3,6 +3,7 @@ package cmd
 import (
 	"net/http"
 	"testing"
+	"time"
 
 	"github.com/bottlepay/portfolio-data/model"
 	"github.com/gavv/httpexpect/v2"
@@ -44,6 +45,107 @@ func Test_handleUserRoute(t *testing.T) {
 		Expect().
 		Status(http.StatusNotFound)
 
+	e.GET("/user/1").
+		Expect().
+		Header("ETag").Equal(`"1"`)
+}
+
+func Test_handleUserLifecycle(t *testing.T) {
+	e := httpexpect.New(t, "http://localhost:9998/")
+
+	// the credentials are received but never sent back
+	user := e.POST("/user").WithJSON(map[string]interface{}{
+		"id":         100,
+		"custodians": []int{2, 1},
+		"links":      map[string]interface{}{"1": map[string]interface{}{"adapter": "mock", "credentials": map[string]string{"token": "secret"}}},
+	}).
+		Expect().
+		Status(http.StatusCreated)
+	user.Header("Location").Equal("/user/100")
+	user.Header("ETag").Equal(`"1"`)
+	user.JSON().Object().ContainsMap(map[string]interface{}{"id": 100, "custodians": []int{2, 1}, "version": 1})
+	user.JSON().Object().Value("links").Object().Value("1").Object().NotContainsKey("credentials")
+
+	e.POST("/user").WithJSON(map[string]interface{}{"id": 100}).
+		Expect().
+		Status(http.StatusConflict)
+	e.POST("/user").WithJSON(map[string]interface{}{"custodians": []int{1, 1}}).
+		Expect().
+		Status(http.StatusBadRequest)
+	e.POST("/user").WithJSON(map[string]interface{}{"custodians": []int{1}, "links": map[string]interface{}{"1": map[string]string{"adapter": "unknown"}}}).
+		Expect().
+		Status(http.StatusBadRequest)
+
+	// a user without an ID gets the next one
+	e.POST("/user").WithJSON(map[string]interface{}{"custodians": []int{3}}).
+		Expect().
+		Status(http.StatusCreated).JSON().Object().Value("id").Equal(101)
+
+	// the users are paginated
+	page := e.GET("/user").WithQuery("after", 1).WithQuery("limit", 1).
+		Expect().
+		Status(http.StatusOK).JSON().Object()
+	page.Value("users").Array().Length().Equal(1)
+	page.Value("users").Array().First().Object().Value("id").Equal(100)
+	page.Value("next").Equal(100)
+	e.GET("/user").WithQuery("after", 100).
+		Expect().
+		Status(http.StatusOK).JSON().Object().NotContainsKey("next")
+	e.GET("/user").WithQuery("limit", 0).
+		Expect().
+		Status(http.StatusBadRequest)
+
+	// the modifications are made from the current version
+	e.PUT("/user/100").WithJSON(map[string]interface{}{"custodians": []int{1, 2, 3}}).
+		Expect().
+		Status(http.StatusPreconditionRequired)
+	e.PUT("/user/100").WithHeader("If-Match", `"1"`).WithJSON(map[string]interface{}{"custodians": []int{1, 2, 3}}).
+		Expect().
+		Status(http.StatusOK).JSON().Object().ContainsMap(map[string]interface{}{"custodians": []int{1, 2, 3}, "version": 2})
+	e.PUT("/user/100").WithHeader("If-Match", `"1"`).WithJSON(map[string]interface{}{"custodians": []int{1}}).
+		Expect().
+		Status(http.StatusPreconditionFailed)
+
+	// the custodians are linked and unlinked
+	e.PUT("/user/100/custodians/4").WithHeader("If-Match", `"2"`).
+		Expect().
+		Status(http.StatusOK).JSON().Object().ContainsMap(map[string]interface{}{"custodians": []int{1, 2, 3, 4}, "version": 3})
+	// linking a custodian again replaces its link, at its position
+	e.PUT("/user/100/custodians/2").WithHeader("If-Match", `"3"`).WithJSON(map[string]string{"adapter": "mock"}).
+		Expect().
+		Status(http.StatusOK).JSON().Object().ContainsMap(map[string]interface{}{
+		"custodians": []int{1, 2, 3, 4}, "version": 4, "links": map[string]interface{}{"2": map[string]string{"adapter": "mock"}},
+	})
+	e.PUT("/user/100/custodians/5").WithHeader("If-Match", `"4"`).WithJSON(map[string]string{"adapter": "unknown"}).
+		Expect().
+		Status(http.StatusBadRequest)
+	e.DELETE("/user/100/custodians/2").WithHeader("If-Match", `"4"`).
+		Expect().
+		Status(http.StatusOK).JSON().Object().ContainsMap(map[string]interface{}{"custodians": []int{1, 3, 4}, "version": 5})
+	e.DELETE("/user/100/custodians/2").WithHeader("If-Match", `"5"`).
+		Expect().
+		Status(http.StatusNotFound)
+	e.DELETE("/user/100/custodians/zero").WithHeader("If-Match", `"5"`).
+		Expect().
+		Status(http.StatusBadRequest)
+
+	// the holdings of the user are the ones of its custodians
+	e.GET("/user/100/holdings").
+		Expect().
+		Status(http.StatusOK)
+
+	e.DELETE("/user/100").WithHeader("If-Match", `"4"`).
+		Expect().
+		Status(http.StatusPreconditionFailed)
+	e.DELETE("/user/100").WithHeader("If-Match", `"5"`).
+		Expect().
+		Status(http.StatusNoContent)
+	e.DELETE("/user/101").WithHeader("If-Match", `"1"`).
+		Expect().
+		Status(http.StatusNoContent)
+	e.GET("/user/100").
+		Expect().
+		Status(http.StatusNotFound)
 }
 
 func Test_handleHoldingsRoute(t *testing.T) {
@@ -61,6 +163,52 @@ func Test_handleHoldingsRoute(t *testing.T) {
 		Expect().
 		Status(http.StatusNotFound)
 
+	partial := e.GET("/user/1/holdings").WithQuery("partial", true).
+		Expect().
+		Status(http.StatusOK).JSON().Object()
+
+	partial.Value("holdings").Array().Length().Equal(2)
+	partial.Value("sources_ok").Number().Equal(4)
+	partial.Value("sources_total").Number().Equal(4)
+	partial.Value("custodians").Array().Length().Equal(4)
+	partial.Value("custodians").Array().First().Object().Value("status").Equal("ok")
+
+	valuation := e.GET("/user/1/holdings").WithQuery("quote", "gbp").
+		Expect().
+		Status(http.StatusOK).JSON().Object()
+
+	valuation.Value("quote").Equal("GBP")
+	valuation.Value("complete").Equal(true)
+	valuation.Value("holdings").Array().Length().Equal(2)
+	valuation.Value("holdings").Array().First().Object().Keys().ContainsOnly("balance", "code", "value")
+	valuation.Value("total").String().NotEmpty()
+	valuation.Value("rates_as_of").String().NotEmpty()
+
+	e.GET("/user/1/holdings").WithQuery("partial", true).WithQuery("quote", "EUR").
+		Expect().
+		Status(http.StatusOK).JSON().Object().
+		Value("valuation").Object().Value("quote").Equal("EUR")
+
+	e.GET("/user/1/holdings").WithQuery("quote", "XYZ").
+		Expect().
+		Status(http.StatusBadRequest)
+
+	// the rates of the provider are recorded at startup, there are no older rates
+	now := time.Now().UTC().Format(time.RFC3339)
+	e.GET("/user/1/holdings").WithQuery("quote", "GBP").WithQuery("at", now).
+		Expect().
+		Status(http.StatusOK).JSON().Object().
+		ContainsMap(map[string]interface{}{"complete": true, "rates_as_of": now})
+
+	past := e.GET("/user/1/holdings").WithQuery("quote", "GBP").WithQuery("at", "2001-01-01T00:00:00Z").
+		Expect().
+		Status(http.StatusOK).JSON().Object()
+	past.Value("complete").Equal(false)
+	past.Value("holdings").Array().First().Object().Keys().ContainsOnly("balance", "code", "error")
+
+	e.GET("/user/1/holdings").WithQuery("at", now).
+		Expect().
+		Status(http.StatusBadRequest)
 }
 
 // This integration test really requires to run against the generator with --time=0 and
@@ -107,4 +255,353 @@ func Test_handleTransactionsRoute(t *testing.T) {
 	assets.First().Object().Value("balance").Equal("7.6262799625") // hand checked
 	assets.Last().Object().Value("code").Equal("GBP")
 	assets.Last().Object().Value("balance").Equal("43046.9044724478") // hand checked
+
+	txl = e.GET("/user/1/custodian/1/transactions").
+		WithQuery("from", "2021-05-29T00:00:00Z").
+		WithQuery("to", "2021-05-30T00:00:00Z").
+		Expect().Status(http.StatusOK).JSON().Array()
+	txl.Length().Equal(4)
+	txl.First().Object().Value("timestamp").String().Match("^2021-05-29T")
+
+	e.GET("/user/1/custodian/1/transactions").WithQuery("from", "2021-05-30T00:00:00Z").
+		Expect().Status(http.StatusOK).JSON().Array().Length().Equal(15)
+
+	e.GET("/user/1/custodian/1/transactions").WithQuery("to", "yesterday").
+		Expect().Status(http.StatusBadRequest)
+}
+
+func Test_handleHistoryRoute(t *testing.T) {
+	e := httpexpect.New(t, "http://localhost:9998/")
+
+	total := e.GET("/user/1/holdings").WithQuery("quote", "GBP").
+		Expect().
+		Status(http.StatusOK).JSON().Object().Value("total").Raw()
+
+	history := e.GET("/user/1/history").WithQuery("quote", "gbp").
+		Expect().
+		Status(http.StatusOK).JSON().Object()
+	history.Value("quote").Equal("GBP")
+	history.Value("interval").Equal("1d")
+	history.Value("assets").Object().Keys().ContainsOnly("BTC", "GBP")
+	last := history.Value("total").Array().Last().Object()
+	last.Value("complete").Equal(true)
+	last.Value("value").Equal(total)
+
+	// the past is valued with the rates of data/forex-history.csv, 28000 GBP on the 26th
+	history = e.GET("/user/1/history").WithQuery("quote", "GBP").
+		WithQuery("from", "2021-05-26T00:00:00Z").
+		WithQuery("to", "2021-06-01T00:00:00Z").
+		WithQuery("interval", "2d").
+		Expect().
+		Status(http.StatusOK).JSON().Object()
+	history.Value("total").Array().Length().Equal(4)
+	btc := history.Value("assets").Object().Value("BTC").Array()
+	btc.First().Object().Value("balance").Equal("40.0000000266685475") // hand checked
+	btc.First().Object().Value("value").Equal("1120000.00074672")
+	history.Value("total").Array().First().Object().Value("complete").Equal(true)
+	btc.Last().Object().Value("balance").Equal("94.57164143")
+
+	e.GET("/user/1/history").
+		Expect().
+		Status(http.StatusBadRequest)
+	e.GET("/user/1/history").WithQuery("quote", "GBP").WithQuery("interval", "1s").
+		Expect().
+		Status(http.StatusBadRequest)
+	e.GET("/user/1/history").WithQuery("quote", "GBP").
+		WithQuery("from", "2021-06-01T00:00:00Z").WithQuery("to", "2021-05-01T00:00:00Z").
+		Expect().
+		Status(http.StatusBadRequest)
+	e.GET("/user/1/history").WithQuery("quote", "GBP").
+		WithQuery("from", "2001-01-01T00:00:00Z").WithQuery("interval", "1h").
+		Expect().
+		Status(http.StatusBadRequest)
+}
+
+func Test_handleReconcileRoute(t *testing.T) {
+	e := httpexpect.New(t, "http://localhost:9998/")
+
+	e.GET("/user/1/custodian/999/reconcile").
+		Expect().
+		Status(http.StatusUnauthorized)
+
+	// the generator rounds the balances but not the amounts
+	rec := e.GET("/user/1/custodian/1/reconcile").WithQuery("opening", "BTC:10.00000001,GBP:100000.01").
+		Expect().
+		Status(http.StatusOK).JSON().Object()
+	rec.Value("custodian_id").Equal(1)
+	rec.Value("reconciled").Equal(false)
+	btc := rec.Value("assets").Array()
+	btc.Length().Equal(1)
+	btc.First().Object().ContainsMap(map[string]interface{}{
+		"code":         "BTC",
+		"transactions": 37,
+		"replayed":     "31.1287400147",
+		"reported":     "31.12874002",
+		"discrepancy":  "0.0000000053",
+	})
+
+	e.GET("/user/1/custodian/1/reconcile").
+		WithQuery("opening", "BTC:10.00000001").WithQuery("tolerance", "0.0000001").
+		Expect().
+		Status(http.StatusOK).JSON().Object().Value("reconciled").Equal(true)
+
+	e.GET("/user/1/custodian/1/reconcile").WithQuery("opening", "BTC").
+		Expect().
+		Status(http.StatusBadRequest)
+	e.GET("/user/1/custodian/1/reconcile").WithQuery("tolerance", "-1").
+		Expect().
+		Status(http.StatusBadRequest)
+}
+
+func Test_handleTransfersRoute(t *testing.T) {
+	e := httpexpect.New(t, "http://localhost:9998/")
+
+	transfers := e.GET("/user/1/transfers").
+		Expect().
+		Status(http.StatusOK).JSON().Array()
+	transfers.Length().Equal(52)
+	first := transfers.First().Object()
+	first.Value("status").Equal("matched")
+	first.Value("source").Object().ContainsMap(map[string]interface{}{
+		"custodian_id": 3, "transaction_id": 1, "asset": "GBP", "amount": "11000.0011",
+	})
+	first.Value("destination").Object().ContainsMap(map[string]interface{}{
+		"custodian_id": 4, "transaction_id": 3, "asset": "GBP", "amount": "11000.0011",
+	})
+
+	// every custodian of the user is linked, and the generator always makes both legs
+	e.GET("/user/1/transfers").WithQuery("status", "matched").
+		Expect().
+		Status(http.StatusOK).JSON().Array().Length().Equal(52)
+	e.GET("/user/1/transfers").WithQuery("status", "orphaned").
+		Expect().
+		Status(http.StatusOK).JSON().Array().Empty()
+
+	e.GET("/user/1/transfers").WithQuery("from", "2021-05-30T00:00:00Z").
+		Expect().
+		Status(http.StatusOK).JSON().Array().Length().Equal(14)
+
+	e.GET("/user/1/transfers").WithQuery("status", "lost").
+		Expect().
+		Status(http.StatusBadRequest)
+}
+
+func Test_handleFlowsRoute(t *testing.T) {
+	e := httpexpect.New(t, "http://localhost:9998/")
+
+	flows := e.GET("/user/1/flows").
+		Expect().
+		Status(http.StatusOK).JSON().Array()
+	flows.Length().Equal(2)
+
+	// every custodian is linked by the user, their transfers are internal
+	btc := flows.First().Object()
+	btc.ContainsMap(map[string]interface{}{
+		"code":         "BTC",
+		"deposits":     "81.3802245416",
+		"withdrawals":  "23.7194650477",
+		"unlinked_in":  "0",
+		"unlinked_out": "0",
+		"net":          "57.6607594939",
+		"internal_in":  "62.1844000494",
+		"internal_out": "62.1844000494",
+	})
+
+	e.GET("/user/1/flows").WithQuery("from", "2021-05-30T00:00:00Z").
+		Expect().
+		Status(http.StatusOK).JSON().Array().First().Object().Value("net").Equal("28.1151634768")
+
+	e.GET("/user/1/flows").WithQuery("from", "today").
+		Expect().
+		Status(http.StatusBadRequest)
+}
+
+func Test_handleFeesRoute(t *testing.T) {
+	e := httpexpect.New(t, "http://localhost:9998/")
+
+	// the fixture was generated without fees
+	fees := e.GET("/user/1/fees").
+		Expect().
+		Status(http.StatusOK).JSON().Object()
+	fees.Value("total").Array().Empty()
+	custodians := fees.Value("custodians").Array()
+	custodians.Length().Equal(4)
+	custodians.First().Object().Value("fees").Array().Empty()
+
+	e.GET("/user/1/fees").WithQuery("to", "yesterday").
+		Expect().
+		Status(http.StatusBadRequest)
+}
+
+func Test_handlePnLRoute(t *testing.T) {
+	e := httpexpect.New(t, "http://localhost:9998/")
+
+	// the lots are valued with the rates of data/forex-history.csv, the BTC sold at 40000 GBP made a profit
+	pnl := e.GET("/user/1/pnl").WithQuery("quote", "gbp").
+		Expect().
+		Status(http.StatusOK).JSON().Object()
+	pnl.ContainsMap(map[string]interface{}{
+		"quote":      "GBP",
+		"method":     "fifo",
+		"realized":   "44199.3354098",
+		"unrealized": "1216830.69895622",
+		"complete":   true,
+	})
+	btc := pnl.Value("assets").Array()
+	btc.Length().Equal(1)
+	btc.First().Object().ContainsMap(map[string]interface{}{
+		"code":         "BTC",
+		"quantity":     "94.57164143",
+		"cost_basis":   "2566034.95824378",
+		"disposed":     "31.5386038958",
+		"proceeds":     "927280.2444922",
+		"realized":     "44199.3354098",
+		"uncovered":    "0",
+		"market_value": "3782865.6572",
+	})
+	btc.First().Object().NotContainsKey("error")
+
+	// the same disposals, for another cost
+	e.GET("/user/1/pnl").WithQuery("quote", "GBP").WithQuery("method", "average").
+		Expect().
+		Status(http.StatusOK).JSON().Object().ContainsMap(map[string]interface{}{
+		"method":   "average",
+		"realized": "47787.20850267",
+		"complete": true,
+	})
+
+	e.GET("/user/1/pnl").
+		Expect().
+		Status(http.StatusBadRequest)
+	e.GET("/user/1/pnl").WithQuery("quote", "GBP").WithQuery("method", "hifo").
+		Expect().
+		Status(http.StatusBadRequest)
+}
+
+func Test_handleCGTRoute(t *testing.T) {
+	e := httpexpect.New(t, "http://localhost:9998/")
+
+	// the costs come from the rates of data/forex-history.csv
+	report := e.GET("/user/1/cgt").WithQuery("year", "2021-22").
+		Expect().
+		Status(http.StatusOK).JSON().Object()
+	report.ContainsMap(map[string]interface{}{
+		"tax_year": "2021-22",
+		"proceeds": "927280.2444922",
+		"costs":    "856478.91098992",
+		"gains":    "90263.20841137",
+		"losses":   "19461.87490909",
+		"net_gain": "70801.33350228",
+		"complete": true,
+	})
+	report.NotContainsKey("errors")
+	disposals := report.Value("disposals").Array()
+	disposals.Length().Equal(6)
+	// the BTC sold on the first day is matched with the BTC bought that day, then with the BTC bought in the next 30 days
+	disposals.First().Object().ContainsMap(map[string]interface{}{
+		"date":                       "2021-05-26",
+		"asset":                      "BTC",
+		"quantity":                   "2.1740669942",
+		"proceeds":                   "80073.8758568",
+		"cost":                       "66089.22579407",
+		"gain":                       "13984.65006273",
+		"same_day_quantity":          "0.8420000434",
+		"same_day_cost":              "28736.0017312",
+		"bed_and_breakfast_quantity": "1.3320669508",
+		"bed_and_breakfast_cost":     "37353.22406287",
+		"section_104_quantity":       "0",
+		"uncovered_quantity":         "0",
+	})
+	report.Value("pools").Array().First().Object().ContainsMap(map[string]interface{}{"asset": "BTC", "quantity": "94.57164143"})
+
+	res := e.GET("/user/1/cgt").WithQuery("year", "2021/22").WithQuery("format", "csv").
+		Expect().
+		Status(http.StatusOK)
+	res.Header("Content-Type").Equal("text/csv")
+	res.Header("X-Report-Incomplete").Empty()
+	res.Body().Match("^date,asset,quantity,proceeds,cost,gain,")
+	res.Body().Contains("\n2021-05-26,BTC,2.1740669942,80073.8758568,66089.22579407,13984.65006273,")
+
+	e.GET("/user/1/cgt").WithQuery("year", "2021-23").
+		Expect().
+		Status(http.StatusBadRequest)
+	e.GET("/user/1/cgt").WithQuery("format", "xls").
+		Expect().
+		Status(http.StatusBadRequest)
+}
+
+func Test_handleExchangesRoute(t *testing.T) {
+	e := httpexpect.New(t, "http://localhost:9998/")
+
+	res := e.GET("/user/1/exchanges").WithQuery("quote", "gbp").
+		Expect().
+		Status(http.StatusOK).JSON().Object()
+	res.Value("quote").Equal("GBP")
+	res.Value("exchanges").Array().Length().Equal(20)
+	res.Value("exchanges").Array().First().Object().ContainsMap(map[string]interface{}{
+		"custodian_id":        2,
+		"from_transaction_id": 1,
+		"to_transaction_id":   2,
+		"timestamp":           "2021-05-26T12:39:41Z",
+		"price":               "0.000025",
+		"value":               "8000.0008",
+	})
+	pairs := res.Value("pairs").Array()
+	pairs.Length().Equal(2)
+	pairs.First().Object().ContainsMap(map[string]interface{}{
+		"pair":          "BTC/GBP",
+		"count":         6,
+		"average_price": "40000",
+		"value":         "312765.553924",
+	})
+
+	// the exchanges of a custodian, without valuation
+	res = e.GET("/user/1/custodian/2/exchanges").
+		Expect().
+		Status(http.StatusOK).JSON().Object()
+	res.Value("exchanges").Array().Length().Equal(6)
+	res.Value("pairs").Array().First().Object().NotContainsKey("value")
+
+	e.GET("/user/1/custodian/999/exchanges").
+		Expect().
+		Status(http.StatusUnauthorized)
+	e.GET("/user/1/exchanges").WithQuery("quote", "XYZ").
+		Expect().
+		Status(http.StatusBadRequest)
+}
+
+func Test_handleBreakersRoute(t *testing.T) {
+	e := httpexpect.New(t, "http://localhost:9998/")
+
+	// make sure every custodian has been fetched at least once
+	e.GET("/user/1/holdings").
+		Expect().
+		Status(http.StatusOK)
+
+	breakers := e.GET("/admin/breakers").
+		Expect().
+		Status(http.StatusOK).JSON().Array()
+
+	breakers.Length().Equal(4)
+	for _, b := range breakers.Iter() {
+		b.Object().Value("state").Equal("closed")
+		b.Object().Value("consecutive_failures").Number().Equal(0)
+	}
+}
+
+func Test_handleInvalidateRoute(t *testing.T) {
+	e := httpexpect.New(t, "http://localhost:9998/")
+
+	e.DELETE("/admin/cache/1").
+		Expect().
+		Status(http.StatusNoContent)
+
+	e.DELETE("/admin/cache/alpha").
+		Expect().
+		Status(http.StatusBadRequest)
+
+	// the invalidated custodian is fetched again
+	e.GET("/user/1/holdings").
+		Expect().
+		Status(http.StatusOK).JSON().Array().Length().Equal(2)
 }
@@ -6,6 +6,8 @@ require (
 	github.com/gavv/httpexpect/v2 v2.3.0
 	github.com/go-chi/chi/v5 v5.0.3
 	github.com/go-chi/cors v1.2.0
+	github.com/mattn/go-sqlite3 v1.14.6
 	github.com/shopspring/decimal v1.2.0
 	github.com/spf13/cobra v1.1.3
+	github.com/spf13/pflag v1.0.5
 )
@@ -0,0 +1,405 @@
+package model
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	// the tax years and days are in UK time, wherever the tracker runs
+	_ "time/tzdata"
+
+	"github.com/shopspring/decimal"
+)
+
+// ukTime is the time zone of the UK tax years
+var ukTime = mustLoadLocation("Europe/London")
+
+func mustLoadLocation(name string) *time.Location {
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		panic(err)
+	}
+	return loc
+}
+
+// TaxYear is a UK tax year, from the 6th of April to the 5th of April of the next year
+type TaxYear int
+
+// ParseTaxYear parses a tax year like 2021-22 or 2021/22, or the year it starts in, like 2021
+func ParseTaxYear(s string) (TaxYear, error) {
+	s = strings.Replace(s, "/", "-", 1)
+	parts := strings.SplitN(s, "-", 2)
+	year, err := strconv.Atoi(parts[0])
+	if err != nil || year < 1900 || year > 9998 {
+		return 0, fmt.Errorf("invalid tax year %q, expected 2021-22", s)
+	}
+	if len(parts) == 2 && parts[1] != fmt.Sprintf("%02d", (year+1)%100) {
+		return 0, fmt.Errorf("invalid tax year %q, expected %d-%02d", s, year, (year+1)%100)
+	}
+	return TaxYear(year), nil
+}
+
+// TaxYearOf returns the tax year of a time
+func TaxYearOf(t time.Time) TaxYear {
+	t = t.In(ukTime)
+	if t.Before(time.Date(t.Year(), time.April, 6, 0, 0, 0, 0, ukTime)) {
+		return TaxYear(t.Year() - 1)
+	}
+	return TaxYear(t.Year())
+}
+
+// Start is when the tax year starts
+func (y TaxYear) Start() time.Time {
+	return time.Date(int(y), time.April, 6, 0, 0, 0, 0, ukTime)
+}
+
+// End is when the next tax year starts
+func (y TaxYear) End() time.Time {
+	return TaxYear(y + 1).Start()
+}
+
+func (y TaxYear) String() string {
+	return fmt.Sprintf("%d-%02d", int(y), (int(y)+1)%100)
+}
+
+// CGTDisposal is the disposal of an asset on a day, with the acquisitions matched by the HMRC rules:
+// the same day acquisitions first, then the acquisitions of the next 30 days, then the Section 104 pool
+type CGTDisposal struct {
+	Date     string          `json:"date"`
+	Asset    string          `json:"asset"`
+	Quantity decimal.Decimal `json:"quantity"`
+	Proceeds decimal.Decimal `json:"proceeds"`
+	// Cost is the allowable cost, the sum of the costs of the matched acquisitions
+	Cost decimal.Decimal `json:"cost"`
+	Gain decimal.Decimal `json:"gain"`
+
+	SameDayQuantity         decimal.Decimal `json:"same_day_quantity"`
+	SameDayCost             decimal.Decimal `json:"same_day_cost"`
+	BedAndBreakfastQuantity decimal.Decimal `json:"bed_and_breakfast_quantity"`
+	BedAndBreakfastCost     decimal.Decimal `json:"bed_and_breakfast_cost"`
+	Section104Quantity      decimal.Decimal `json:"section_104_quantity"`
+	Section104Cost          decimal.Decimal `json:"section_104_cost"`
+	// UncoveredQuantity is the quantity disposed of without an acquisition, its cost is 0
+	UncoveredQuantity decimal.Decimal `json:"uncovered_quantity"`
+}
+
+// Section104Pool is the pool of an asset at the end of a tax year
+type Section104Pool struct {
+	Asset    string          `json:"asset"`
+	Quantity decimal.Decimal `json:"quantity"`
+	Cost     decimal.Decimal `json:"cost"`
+}
+
+// CGTReport is the capital gains of a tax year, in GBP
+type CGTReport struct {
+	TaxYear   string            `json:"tax_year"`
+	Disposals []*CGTDisposal    `json:"disposals"`
+	Pools     []*Section104Pool `json:"pools"`
+
+	Proceeds decimal.Decimal `json:"proceeds"`
+	Costs    decimal.Decimal `json:"costs"`
+	Gains    decimal.Decimal `json:"gains"`
+	Losses   decimal.Decimal `json:"losses"`
+	// NetGain is Gains minus Losses
+	NetGain decimal.Decimal `json:"net_gain"`
+
+	// Errors are the assets left out of the report, because of a missing rate
+	Errors   []string `json:"errors,omitempty"`
+	Complete bool     `json:"complete"`
+}
+
+// WriteCSV writes the disposals of the report as CSV, with a header
+func (r *CGTReport) WriteCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{
+		"date", "asset", "quantity", "proceeds", "cost", "gain",
+		"same_day_quantity", "same_day_cost", "bed_and_breakfast_quantity", "bed_and_breakfast_cost",
+		"section_104_quantity", "section_104_cost", "uncovered_quantity",
+	})
+	for _, d := range r.Disposals {
+		cw.Write([]string{
+			d.Date, d.Asset, d.Quantity.String(), d.Proceeds.String(), d.Cost.String(), d.Gain.String(),
+			d.SameDayQuantity.String(), d.SameDayCost.String(), d.BedAndBreakfastQuantity.String(), d.BedAndBreakfastCost.String(),
+			d.Section104Quantity.String(), d.Section104Cost.String(), d.UncoveredQuantity.String(),
+		})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// cgtDay is the total of the acquisitions or the disposals of an asset on a day, with what's left to match
+type cgtDay struct {
+	day       time.Time
+	quantity  decimal.Decimal
+	value     decimal.Decimal
+	remaining decimal.Decimal
+}
+
+// take matches a quantity of the acquisitions of the day, and returns its cost
+func (d *cgtDay) take(quantity decimal.Decimal) decimal.Decimal {
+	d.remaining = d.remaining.Sub(quantity)
+	return d.value.Mul(quantity).Div(d.quantity)
+}
+
+// CGTCurrency is the currency of the capital gains
+const CGTCurrency = "GBP"
+
+// cgtLeg is an asset disposed of or acquired by an event, for a value in GBP
+type cgtLeg struct {
+	asset    *Asset
+	value    decimal.Decimal
+	acquired bool
+}
+
+// cgtLegs returns what the event disposes of and acquires, with its fees as allowable costs:
+// a fee in the disposed asset is disposed of with it, and a fee in the acquired asset is acquired less.
+// A fee in GBP reduces the proceeds of the disposal, or adds to the cost of the acquisition.
+// A fee in another asset is disposed of for its value, which is also an allowable cost of the event.
+func (e *costBasisEvent) cgtLegs(rateAt RateAtFunc) ([]*cgtLeg, error) {
+	value, err := e.value(CGTCurrency, rateAt)
+
+	var legs []*cgtLeg
+	var disposed, acquired *cgtLeg
+	if e.disposed != nil {
+		disposed = &cgtLeg{asset: &Asset{Code: e.disposed.Code, Balance: e.disposed.Balance}, value: value}
+		legs = append(legs, disposed)
+	}
+	if e.acquired != nil {
+		acquired = &cgtLeg{asset: &Asset{Code: e.acquired.Code, Balance: e.acquired.Balance}, value: value, acquired: true}
+		legs = append(legs, acquired)
+	}
+	allowable := func(cost decimal.Decimal) {
+		switch {
+		case disposed != nil && disposed.asset.Code != CGTCurrency:
+			disposed.value = disposed.value.Sub(cost)
+		case acquired != nil:
+			acquired.value = acquired.value.Add(cost)
+		}
+	}
+
+	for _, fee := range e.fees {
+		switch {
+		case fee.Code == CGTCurrency:
+			allowable(fee.Balance)
+		case disposed != nil && fee.Code == disposed.asset.Code:
+			disposed.asset.Balance = disposed.asset.Balance.Add(fee.Balance)
+		case acquired != nil && fee.Code == acquired.asset.Code:
+			acquired.asset.Balance = acquired.asset.Balance.Sub(fee.Balance)
+		default:
+			feeValue, feeErr := assetValue(fee, CGTCurrency, e.time, rateAt)
+			if err == nil {
+				err = feeErr
+			}
+			legs = append(legs, &cgtLeg{asset: fee, value: feeValue})
+			allowable(feeValue)
+		}
+	}
+	return legs, err
+}
+
+// ComputeCGT computes the capital gains of the custodians of a portfolio for a tax year, in GBP with the rates
+// at the time of each event. The acquisitions and disposals are the ones of ComputePnL, and all the history
+// is used to match them, so the Section 104 pools start with the first transaction.
+// The disposals are matched with the same day acquisitions, then with the acquisitions of the next 30 days,
+// earliest first, then with the Section 104 pool at its average cost.
+// Unlike ComputePnL, the fees are allowable costs of their event, see cgtLegs.
+func ComputeCGT(custodians []*Custodian, year TaxYear, rateAt RateAtFunc) *CGTReport {
+	report := &CGTReport{TaxYear: year.String(), Disposals: make([]*CGTDisposal, 0), Pools: make([]*Section104Pool, 0), Complete: true}
+
+	// the acquisitions and disposals of each asset, by day
+	acquisitions := make(map[string]map[time.Time]*cgtDay)
+	disposals := make(map[string]map[time.Time]*cgtDay)
+	add := func(days map[string]map[time.Time]*cgtDay, a *Asset, at time.Time, value decimal.Decimal) {
+		t := at.In(ukTime)
+		day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, ukTime)
+		if days[a.Code] == nil {
+			days[a.Code] = make(map[time.Time]*cgtDay)
+		}
+		d, found := days[a.Code][day]
+		if !found {
+			d = &cgtDay{day: day}
+			days[a.Code][day] = d
+		}
+		d.quantity = d.quantity.Add(a.Balance)
+		d.remaining = d.quantity
+		d.value = d.value.Add(value)
+	}
+	failed := make(map[string]string)
+
+	// without any transaction, there's no disposal and the cost of the balances isn't known
+	opening, _ := openingEvents(custodians)
+	if len(opening) > 0 && opening[0].time.IsZero() {
+		opening = nil
+	}
+	for _, e := range append(opening, costBasisEvents(custodians)...) {
+		legs, err := e.cgtLegs(rateAt)
+		for _, leg := range legs {
+			a := leg.asset
+			// an acquisition may be entirely paid in fees
+			if a.Code == CGTCurrency || !a.Balance.IsPositive() {
+				continue
+			}
+			if err != nil {
+				if _, found := failed[a.Code]; !found {
+					failed[a.Code] = err.Error()
+				}
+				continue
+			}
+			switch {
+			case !leg.acquired:
+				add(disposals, a, e.time, leg.value)
+			case e.opening:
+				// the opening balances were acquired before the first transaction, they go to the pool
+				add(acquisitions, a, e.time.AddDate(0, 0, -1), leg.value)
+			default:
+				add(acquisitions, a, e.time, leg.value)
+			}
+		}
+	}
+
+	found := make(map[string]bool)
+	for _, days := range []map[string]map[time.Time]*cgtDay{acquisitions, disposals} {
+		for code := range days {
+			found[code] = true
+		}
+	}
+	for code := range failed {
+		found[code] = true
+	}
+	var codes []string
+	for code := range found {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+
+	for _, code := range codes {
+		if err, found := failed[code]; found {
+			report.Errors = append(report.Errors, fmt.Sprintf("%s: %s", code, err))
+			report.Complete = false
+			continue
+		}
+		disposed, pool := matchCGT(code, acquisitions[code], disposals[code], year)
+		report.Disposals = append(report.Disposals, disposed...)
+		report.Pools = append(report.Pools, pool)
+	}
+
+	sort.SliceStable(report.Disposals, func(i, j int) bool {
+		return report.Disposals[i].Date < report.Disposals[j].Date
+	})
+	for _, d := range report.Disposals {
+		report.Proceeds = report.Proceeds.Add(d.Proceeds)
+		report.Costs = report.Costs.Add(d.Cost)
+		if d.Gain.IsNegative() {
+			report.Losses = report.Losses.Sub(d.Gain)
+		} else {
+			report.Gains = report.Gains.Add(d.Gain)
+		}
+	}
+	report.NetGain = report.Gains.Sub(report.Losses)
+	return report
+}
+
+// matchCGT matches the disposals of an asset with its acquisitions, and returns the disposals of the tax year
+// with the Section 104 pool at its end
+func matchCGT(code string, acquisitions, disposals map[time.Time]*cgtDay, year TaxYear) ([]*CGTDisposal, *Section104Pool) {
+	sorted := func(days map[time.Time]*cgtDay) []*cgtDay {
+		res := make([]*cgtDay, 0, len(days))
+		for _, d := range days {
+			res = append(res, d)
+		}
+		sort.Slice(res, func(i, j int) bool {
+			return res[i].day.Before(res[j].day)
+		})
+		return res
+	}
+	acquired, disposed := sorted(acquisitions), sorted(disposals)
+
+	results := make(map[time.Time]*CGTDisposal, len(disposed))
+	for _, d := range disposed {
+		results[d.day] = &CGTDisposal{Date: d.day.Format("2006-01-02"), Asset: code, Quantity: d.quantity, Proceeds: d.value}
+	}
+
+	// the same day acquisitions
+	for _, d := range disposed {
+		if a, found := acquisitions[d.day]; found {
+			q := decimal.Min(d.remaining, a.remaining)
+			r := results[d.day]
+			r.SameDayQuantity = q
+			r.SameDayCost = a.take(q)
+			d.remaining = d.remaining.Sub(q)
+		}
+	}
+
+	// the acquisitions of the next 30 days, earliest first
+	for _, d := range disposed {
+		r := results[d.day]
+		for _, a := range acquired {
+			if !d.remaining.IsPositive() {
+				break
+			}
+			if !a.day.After(d.day) || a.day.After(d.day.AddDate(0, 0, 30)) || !a.remaining.IsPositive() {
+				continue
+			}
+			q := decimal.Min(d.remaining, a.remaining)
+			r.BedAndBreakfastQuantity = r.BedAndBreakfastQuantity.Add(q)
+			r.BedAndBreakfastCost = r.BedAndBreakfastCost.Add(a.take(q))
+			d.remaining = d.remaining.Sub(q)
+		}
+	}
+
+	// the Section 104 pool, with what's left of the acquisitions and disposals, in order until the end of the tax year.
+	// Only the acquisitions or the disposals of a day have something left after the same day matching.
+	pool := &Section104Pool{Asset: code}
+	end := year.End()
+	for i, j := 0, 0; i < len(acquired) || j < len(disposed); {
+		if j == len(disposed) || (i < len(acquired) && !acquired[i].day.After(disposed[j].day)) {
+			a := acquired[i]
+			i++
+			if !a.day.Before(end) {
+				continue
+			}
+			if q := a.remaining; q.IsPositive() {
+				pool.Cost = pool.Cost.Add(a.take(q))
+				pool.Quantity = pool.Quantity.Add(q)
+			}
+			continue
+		}
+
+		d := disposed[j]
+		j++
+		if !d.day.Before(end) || !d.remaining.IsPositive() {
+			continue
+		}
+		r := results[d.day]
+		q := decimal.Min(d.remaining, pool.Quantity)
+		if q.IsPositive() {
+			cost := pool.Cost.Mul(q).Div(pool.Quantity)
+			r.Section104Quantity = q
+			r.Section104Cost = cost
+			pool.Cost = pool.Cost.Sub(cost)
+			pool.Quantity = pool.Quantity.Sub(q)
+		}
+		r.UncoveredQuantity = d.remaining.Sub(q)
+		d.remaining = decimal.Zero
+	}
+	pool.Cost = pool.Cost.RoundBank(8)
+
+	// the disposals of the tax year
+	var res []*CGTDisposal
+	for _, d := range disposed {
+		if d.day.Before(year.Start()) || !d.day.Before(end) {
+			continue
+		}
+		r := results[d.day]
+		r.SameDayCost = r.SameDayCost.RoundBank(8)
+		r.BedAndBreakfastCost = r.BedAndBreakfastCost.RoundBank(8)
+		r.Section104Cost = r.Section104Cost.RoundBank(8)
+		r.Cost = r.SameDayCost.Add(r.BedAndBreakfastCost).Add(r.Section104Cost)
+		r.Gain = r.Proceeds.Sub(r.Cost)
+		res = append(res, r)
+	}
+	return res, pool
+}
@@ -0,0 +1,186 @@
+package model
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+func TestParseTaxYear(t *testing.T) {
+	for _, s := range []string{"2021-22", "2021/22", "2021"} {
+		if y, err := ParseTaxYear(s); err != nil || y != 2021 || y.String() != "2021-22" {
+			t.Errorf("%s: unexpected tax year %v, %v", s, y, err)
+		}
+	}
+	for _, s := range []string{"2021-23", "21-22", "last"} {
+		if _, err := ParseTaxYear(s); err == nil {
+			t.Errorf("%s: expected an error", s)
+		}
+	}
+
+	// the tax years start at midnight in the UK, which is 23:00 UTC in April
+	if y := TaxYearOf(time.Date(2022, 4, 5, 22, 59, 0, 0, time.UTC)); y != 2021 {
+		t.Errorf("expected 2021-22, got %s", y)
+	}
+	if y := TaxYearOf(time.Date(2022, 4, 5, 23, 0, 0, 0, time.UTC)); y != 2022 {
+		t.Errorf("expected 2022-23, got %s", y)
+	}
+}
+
+func TestComputeCGT(t *testing.T) {
+	c := &Custodian{ID: 2, Assets: []*Asset{{Code: "BTC", Balance: decimal.NewFromInt(1)}}}
+	trade := func(at time.Time, from string, fromAmount int64, to string, toAmount int64) {
+		id := c.LastTransactionID()
+		c.AddTransaction(
+			&Transaction{Asset: from, Amount: decimal.NewFromInt(fromAmount), Direction: DirectionOut, Timestamp: at, RelatedCustodianID: 2, RelatedCustodianTransactionID: id + 2},
+			&Transaction{Asset: to, Amount: decimal.NewFromInt(toAmount), Direction: DirectionIn, Timestamp: at, RelatedCustodianID: 2, RelatedCustodianTransactionID: id + 1},
+		)
+	}
+	buy := func(at time.Time, btc, gbp int64) { trade(at, "GBP", gbp, "BTC", btc) }
+	sell := func(at time.Time, btc, gbp int64) { trade(at, "BTC", btc, "GBP", gbp) }
+	day := func(y int, m time.Month, d, h int) time.Time {
+		return time.Date(y, m, d, h, 0, 0, 0, time.UTC)
+	}
+
+	buy(day(2021, 3, 1, 10), 10, 100000)
+	buy(day(2021, 5, 1, 10), 5, 75000)
+	sell(day(2021, 6, 1, 10), 4, 80000)
+	// the same day
+	buy(day(2021, 6, 1, 15), 1, 22000)
+	// bed and breakfast
+	buy(day(2021, 6, 20, 10), 2, 30000)
+	// the pool
+	sell(day(2021, 7, 1, 10), 14, 350000)
+	buy(day(2021, 8, 15, 10), 3, 60000)
+	// the last day of the tax year in the UK, and the first day of the next one
+	sell(day(2022, 4, 5, 22), 1, 15000)
+	sell(day(2022, 4, 5, 23), 1, 26000)
+
+	noRate := func(from, to string, at time.Time) (decimal.Decimal, error) {
+		return decimal.Zero, errors.New("no rate at this time")
+	}
+	r := ComputeCGT([]*Custodian{c}, 2021, noRate)
+	if r.TaxYear != "2021-22" || !r.Complete || len(r.Disposals) != 3 {
+		t.Fatalf("unexpected report %+v", r)
+	}
+
+	d := func(s string) decimal.Decimal {
+		return decimal.RequireFromString(s)
+	}
+	june := r.Disposals[0]
+	if june.Date != "2021-06-01" || !june.Quantity.Equal(d("4")) || !june.Proceeds.Equal(d("80000")) ||
+		!june.SameDayQuantity.Equal(d("1")) || !june.SameDayCost.Equal(d("22000")) ||
+		!june.BedAndBreakfastQuantity.Equal(d("2")) || !june.BedAndBreakfastCost.Equal(d("30000")) ||
+		!june.Section104Quantity.Equal(d("1")) || !june.Section104Cost.Equal(d("11666.66666667")) ||
+		!june.Cost.Equal(d("63666.66666667")) || !june.Gain.Equal(d("16333.33333333")) {
+		t.Errorf("unexpected disposal %+v", june)
+	}
+	july := r.Disposals[1]
+	if july.Date != "2021-07-01" || !july.Section104Quantity.Equal(d("14")) || !july.Cost.Equal(d("163333.33333333")) ||
+		!july.UncoveredQuantity.IsZero() || !july.Gain.Equal(d("186666.66666667")) {
+		t.Errorf("unexpected disposal %+v", july)
+	}
+	april := r.Disposals[2]
+	if april.Date != "2022-04-05" || !april.Cost.Equal(d("20000")) || !april.Gain.Equal(d("-5000")) {
+		t.Errorf("unexpected disposal %+v", april)
+	}
+
+	if !r.Proceeds.Equal(d("445000")) || !r.Costs.Equal(d("247000")) || !r.Gains.Equal(d("203000")) ||
+		!r.Losses.Equal(d("5000")) || !r.NetGain.Equal(d("198000")) {
+		t.Errorf("unexpected totals %+v", r)
+	}
+	if len(r.Pools) != 1 || r.Pools[0].Asset != "BTC" || !r.Pools[0].Quantity.Equal(d("2")) || !r.Pools[0].Cost.Equal(d("40000")) {
+		t.Errorf("unexpected pools %+v", r.Pools[0])
+	}
+
+	var csv bytes.Buffer
+	if err := r.WriteCSV(&csv); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(csv.String()), "\n")
+	if len(lines) != 4 || !strings.HasPrefix(lines[0], "date,asset,quantity,proceeds,cost,gain,") ||
+		lines[3] != "2022-04-05,BTC,1,15000,20000,-5000,0,0,0,0,1,20000,0" {
+		t.Errorf("unexpected CSV %q", csv.String())
+	}
+
+	// the previous tax year has no disposal, and the pool of the first acquisition
+	r = ComputeCGT([]*Custodian{c}, 2020, noRate)
+	if len(r.Disposals) != 0 || !r.Pools[0].Quantity.Equal(d("10")) || !r.Pools[0].Cost.Equal(d("100000")) {
+		t.Errorf("unexpected report %+v", r)
+	}
+
+	// a deposit without a rate leaves the asset out
+	c.AddTransaction(&Transaction{Asset: "ETH", Amount: d("1"), Direction: DirectionIn, Timestamp: day(2021, 6, 1, 10)})
+	c.Assets = append(c.Assets, &Asset{Code: "ETH", Balance: d("1")})
+	r = ComputeCGT([]*Custodian{c}, 2021, noRate)
+	if r.Complete || len(r.Errors) != 1 || !strings.HasPrefix(r.Errors[0], "ETH: ") || len(r.Disposals) != 3 {
+		t.Errorf("unexpected report %+v", r)
+	}
+
+	// the balances before the first transaction are in the pool, not acquired the same day
+	c = &Custodian{ID: 2, Assets: []*Asset{{Code: "BTC", Balance: d("2")}}}
+	sell(day(2021, 6, 1, 10), 1, 30000)
+	rateAt := func(from, to string, at time.Time) (decimal.Decimal, error) {
+		return decimal.NewFromInt(10000), nil
+	}
+	r = ComputeCGT([]*Custodian{c}, 2021, rateAt)
+	if len(r.Disposals) != 1 || !r.Disposals[0].Section104Quantity.Equal(d("1")) || !r.Disposals[0].Gain.Equal(d("20000")) {
+		t.Errorf("unexpected disposals %+v", r.Disposals[0])
+	}
+}
+
+func TestComputeCGT_fees(t *testing.T) {
+	d := func(s string) decimal.Decimal {
+		return decimal.RequireFromString(s)
+	}
+	fee := func(s string) *decimal.Decimal {
+		f := d(s)
+		return &f
+	}
+	day := func(m time.Month, d int) time.Time {
+		return time.Date(2021, m, d, 10, 0, 0, 0, time.UTC)
+	}
+
+	c := &Custodian{ID: 2, Assets: []*Asset{{Code: "BTC", Balance: d("0.49")}}}
+	c2 := &Custodian{ID: 3, Assets: []*Asset{{Code: "BTC", Balance: d("0.5")}}}
+	// a buy with a fee in GBP, and one in the received BTC
+	c.AddTransaction(
+		&Transaction{Asset: "GBP", Amount: d("20000"), Direction: DirectionOut, Timestamp: day(5, 1), RelatedCustodianID: 2, RelatedCustodianTransactionID: 2, Fee: fee("100"), FeeAsset: "GBP"},
+		&Transaction{Asset: "BTC", Amount: d("2.02"), Direction: DirectionIn, Timestamp: day(5, 1), RelatedCustodianID: 2, RelatedCustodianTransactionID: 1, Fee: fee("0.02"), FeeAsset: "BTC"},
+	)
+	// a sale with a fee in the sold BTC, and one in GBP
+	c.AddTransaction(
+		&Transaction{Asset: "BTC", Amount: d("0.99"), Direction: DirectionOut, Timestamp: day(7, 1), RelatedCustodianID: 2, RelatedCustodianTransactionID: 4, Fee: fee("0.01"), FeeAsset: "BTC"},
+		&Transaction{Asset: "GBP", Amount: d("15000"), Direction: DirectionIn, Timestamp: day(7, 1), RelatedCustodianID: 2, RelatedCustodianTransactionID: 3, Fee: fee("50"), FeeAsset: "GBP"},
+	)
+	// a transfer between the custodians, whose fee is disposed of for its value
+	c.AddTransaction(&Transaction{Asset: "BTC", Amount: d("0.5"), Direction: DirectionOut, Timestamp: day(9, 1), RelatedCustodianID: 3, RelatedCustodianTransactionID: 1, Fee: fee("0.01"), FeeAsset: "BTC"})
+	c2.AddTransaction(&Transaction{Asset: "BTC", Amount: d("0.5"), Direction: DirectionIn, Timestamp: day(9, 1), RelatedCustodianID: 2, RelatedCustodianTransactionID: 5})
+
+	rateAt := func(from, to string, at time.Time) (decimal.Decimal, error) {
+		return decimal.NewFromInt(10000), nil
+	}
+	r := ComputeCGT([]*Custodian{c, c2}, 2021, rateAt)
+	if !r.Complete || len(r.Disposals) != 2 {
+		t.Fatalf("unexpected report %+v", r)
+	}
+
+	// the fees add to the cost of the 2 BTC bought, 10050 each, and reduce the proceeds of the sale
+	sale := r.Disposals[0]
+	if sale.Date != "2021-07-01" || !sale.Quantity.Equal(d("1")) || !sale.Proceeds.Equal(d("14950")) ||
+		!sale.Cost.Equal(d("10050")) || !sale.Gain.Equal(d("4900")) {
+		t.Errorf("unexpected sale %+v", sale)
+	}
+	transferFee := r.Disposals[1]
+	if transferFee.Date != "2021-09-01" || !transferFee.Quantity.Equal(d("0.01")) || !transferFee.Proceeds.Equal(d("100")) ||
+		!transferFee.Cost.Equal(d("100.5")) || !transferFee.Gain.Equal(d("-0.5")) {
+		t.Errorf("unexpected transfer fee %+v", transferFee)
+	}
+	if len(r.Pools) != 1 || !r.Pools[0].Quantity.Equal(d("0.99")) || !r.Pools[0].Cost.Equal(d("9949.5")) {
+		t.Errorf("unexpected pools %+v", r.Pools[0])
+	}
+}
@@ -0,0 +1,362 @@
+package model
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+// CostBasisMethod tells which lots are disposed of first
+type CostBasisMethod string
+
+const (
+	// FIFO disposes of the oldest lots first
+	FIFO CostBasisMethod = "fifo"
+	// LIFO disposes of the newest lots first
+	LIFO CostBasisMethod = "lifo"
+	// AverageCost pools the lots, they all have the average cost
+	AverageCost CostBasisMethod = "average"
+)
+
+// ParseCostBasisMethod parses fifo, lifo or average
+func ParseCostBasisMethod(s string) (CostBasisMethod, error) {
+	switch m := CostBasisMethod(s); m {
+	case FIFO, LIFO, AverageCost:
+		return m, nil
+	}
+	return "", fmt.Errorf("invalid cost basis method %q, expected fifo, lifo or average", s)
+}
+
+// AssetPnL is the cost basis and the profit and loss of an asset, in the quote currency
+type AssetPnL struct {
+	Code string `json:"code"`
+	// Quantity is the amount held, and CostBasis what it cost
+	Quantity  decimal.Decimal `json:"quantity"`
+	CostBasis decimal.Decimal `json:"cost_basis"`
+	// Disposed is the amount disposed of, for Proceeds, with a Realized profit
+	Disposed decimal.Decimal `json:"disposed"`
+	Proceeds decimal.Decimal `json:"proceeds"`
+	Realized decimal.Decimal `json:"realized"`
+	// Uncovered is the amount disposed of without a lot, its cost is 0
+	Uncovered decimal.Decimal `json:"uncovered"`
+	// MarketValue is the value of the Quantity at the current rate, with an Unrealized profit
+	MarketValue *decimal.Decimal `json:"market_value,omitempty"`
+	Unrealized  *decimal.Decimal `json:"unrealized,omitempty"`
+	// Error is why the profit of the asset couldn't be computed, a missing rate
+	Error string `json:"error,omitempty"`
+}
+
+// PnLReport is the profit and loss of a portfolio in a quote currency
+type PnLReport struct {
+	Quote  string          `json:"quote"`
+	Method CostBasisMethod `json:"method"`
+	Assets []*AssetPnL     `json:"assets"`
+	// Realized and Unrealized are the sums of the assets, they leave out the assets with an error
+	Realized   decimal.Decimal `json:"realized"`
+	Unrealized decimal.Decimal `json:"unrealized"`
+	// Complete is false when some assets have an error
+	Complete bool `json:"complete"`
+}
+
+// lot is an amount of an asset acquired at a time, for a cost
+type lot struct {
+	time     time.Time
+	quantity decimal.Decimal
+	cost     decimal.Decimal
+}
+
+// position tracks the lots of an asset
+type position struct {
+	pnl  *AssetPnL
+	lots []*lot
+}
+
+func (p *position) acquire(at time.Time, quantity, cost decimal.Decimal, method CostBasisMethod) {
+	if method == AverageCost && len(p.lots) > 0 {
+		p.lots[0].quantity = p.lots[0].quantity.Add(quantity)
+		p.lots[0].cost = p.lots[0].cost.Add(cost)
+		return
+	}
+	p.lots = append(p.lots, &lot{time: at, quantity: quantity, cost: cost})
+}
+
+func (p *position) dispose(quantity, proceeds decimal.Decimal, method CostBasisMethod) {
+	p.pnl.Disposed = p.pnl.Disposed.Add(quantity)
+	p.pnl.Proceeds = p.pnl.Proceeds.Add(proceeds)
+
+	cost := decimal.Zero
+	remaining := quantity
+	for remaining.IsPositive() && len(p.lots) > 0 {
+		// FIFO and the average cost take the first lot, LIFO the last one
+		i := 0
+		if method == LIFO {
+			i = len(p.lots) - 1
+		}
+		l := p.lots[i]
+
+		if l.quantity.LessThanOrEqual(remaining) {
+			cost = cost.Add(l.cost)
+			remaining = remaining.Sub(l.quantity)
+			p.lots = append(p.lots[:i], p.lots[i+1:]...)
+			continue
+		}
+		part := l.cost.Mul(remaining).Div(l.quantity)
+		cost = cost.Add(part)
+		l.cost = l.cost.Sub(part)
+		l.quantity = l.quantity.Sub(remaining)
+		remaining = decimal.Zero
+	}
+	p.pnl.Uncovered = p.pnl.Uncovered.Add(remaining)
+	p.pnl.Realized = p.pnl.Realized.Add(proceeds.Sub(cost))
+}
+
+// costBasisEvent gives the Disposed asset for the Acquired one, one of them is nil for a deposit or a withdrawal.
+// Both are nil for the fees of a transfer between the custodians, which has no event of its own.
+type costBasisEvent struct {
+	time     time.Time
+	disposed *Asset
+	acquired *Asset
+	// fees are paid by the transactions of the event, on top of their amounts
+	fees []*Asset
+	// opening is true for the acquisition of a balance before the first transaction
+	opening bool
+}
+
+// value is the value of the event in the quote currency, with the rates at its time, without the fees
+func (e *costBasisEvent) value(quote string, rateAt RateAtFunc) (decimal.Decimal, error) {
+	switch {
+	case e.disposed != nil && e.acquired != nil:
+		return tradeValue(e.disposed, e.acquired, quote, e.time, rateAt)
+	case e.disposed != nil:
+		return assetValue(e.disposed, quote, e.time, rateAt)
+	case e.acquired != nil:
+		return assetValue(e.acquired, quote, e.time, rateAt)
+	}
+	return decimal.Zero, nil
+}
+
+// txRef is a transaction of a custodian
+type txRef struct {
+	custodianID   int32
+	transactionID int32
+}
+
+// costBasisEvents lists the acquisitions and disposals of the custodians of a portfolio, sorted by time
+func costBasisEvents(custodians []*Custodian) []*costBasisEvent {
+	var events []*costBasisEvent
+	asset := func(leg *TransferLeg) *Asset {
+		if leg == nil {
+			return nil
+		}
+		return &Asset{Code: leg.Asset, Balance: leg.Amount}
+	}
+
+	// the fees are attached to the event of their transaction
+	fees := make(map[txRef]*Asset)
+	for _, c := range custodians {
+		for _, tx := range c.Transactions {
+			if fee := tx.FeePaid(); fee != nil {
+				fees[txRef{c.ID, tx.ID}] = fee
+			}
+		}
+	}
+	take := func(custID int32, txIDs ...int32) []*Asset {
+		var taken []*Asset
+		for _, id := range txIDs {
+			if fee, found := fees[txRef{custID, id}]; found {
+				taken = append(taken, fee)
+				delete(fees, txRef{custID, id})
+			}
+		}
+		return taken
+	}
+
+	for _, c := range custodians {
+		for _, tx := range c.Transactions {
+			switch c.GetTransactionType(tx) {
+			case ExternalDeposit:
+				events = append(events, &costBasisEvent{time: tx.Timestamp, acquired: &Asset{Code: tx.Asset, Balance: tx.Amount}, fees: take(c.ID, tx.ID)})
+			case ExternalWithdrawal:
+				events = append(events, &costBasisEvent{time: tx.Timestamp, disposed: &Asset{Code: tx.Asset, Balance: tx.Amount}, fees: take(c.ID, tx.ID)})
+			}
+		}
+		for _, e := range c.GetAssetExchanges() {
+			events = append(events, &costBasisEvent{time: e.Timestamp, disposed: e.From, acquired: e.To, fees: take(c.ID, e.FromTransactionID, e.ToTransactionID)})
+		}
+	}
+
+	// A transfer of an asset between two custodians of the portfolio keeps its lots,
+	// but a transfer which converts it is an exchange. A transfer with a single leg,
+	// from or to another custodian, is a deposit or a withdrawal.
+	for _, t := range MatchTransfers(custodians) {
+		if t.Source != nil && t.Destination != nil && t.Source.Asset == t.Destination.Asset {
+			continue
+		}
+		e := &costBasisEvent{time: t.Timestamp, disposed: asset(t.Source), acquired: asset(t.Destination)}
+		for _, leg := range []*TransferLeg{t.Source, t.Destination} {
+			if leg != nil {
+				e.fees = append(e.fees, take(leg.CustodianID, leg.TransactionID)...)
+			}
+		}
+		events = append(events, e)
+	}
+
+	// the fees left have no event, like the fees of the transfers keeping their lots
+	for _, c := range custodians {
+		for _, tx := range c.Transactions {
+			if fee := take(c.ID, tx.ID); len(fee) > 0 {
+				events = append(events, &costBasisEvent{time: tx.Timestamp, fees: fee})
+			}
+		}
+	}
+
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].time.Before(events[j].time)
+	})
+	return events
+}
+
+// openingEvents acquires the balances before the first transaction of the custodians at its time,
+// at a zero time when there's no transaction. It also returns the current balances.
+func openingEvents(custodians []*Custodian) ([]*costBasisEvent, map[string]decimal.Decimal) {
+	// the opening balances are the current ones minus the transactions
+	balances := make(map[string]decimal.Decimal)
+	opening := make(map[string]decimal.Decimal)
+	var first time.Time
+	for _, c := range custodians {
+		for _, a := range c.Assets {
+			balances[a.Code] = balances[a.Code].Add(a.Balance)
+			opening[a.Code] = opening[a.Code].Add(a.Balance)
+		}
+		for _, tx := range c.Transactions {
+			if tx.Direction == DirectionIn {
+				opening[tx.Asset] = opening[tx.Asset].Sub(tx.Amount)
+			} else {
+				opening[tx.Asset] = opening[tx.Asset].Add(tx.Amount)
+			}
+			if fee := tx.FeePaid(); fee != nil {
+				opening[fee.Code] = opening[fee.Code].Add(fee.Balance)
+			}
+			if first.IsZero() || tx.Timestamp.Before(first) {
+				first = tx.Timestamp
+			}
+		}
+	}
+
+	var events []*costBasisEvent
+	for code, balance := range opening {
+		if balance.IsPositive() {
+			events = append(events, &costBasisEvent{time: first, acquired: &Asset{Code: code, Balance: balance}, opening: true})
+		}
+	}
+	sort.Slice(events, func(i, j int) bool {
+		return events[i].acquired.Code < events[j].acquired.Code
+	})
+	return events, balances
+}
+
+// ComputePnL tracks the lots of the assets of the custodians of a portfolio, and computes their cost basis
+// and their realized profit in the quote currency, with the rates at the time of each event.
+// The unrealized profit is the current value of the lots, at the current rate, minus their cost basis.
+//
+// The deposits are acquisitions and the withdrawals are disposals at their value, and so are the transfers
+// with custodians outside of the portfolio. A fee is the disposal of its asset for nothing, the fees paid
+// in the quote currency aren't part of the report. An asset exchange is the disposal of an asset for its value
+// and the acquisition of the other one for the same cost. The lots are pooled across the custodians, so
+// that a transfer between two of them keeps its lots. The balances before the first transaction are
+// acquired at its time, or at the current rates without any transaction.
+// The quote currency has no cost basis and isn't part of the report.
+func ComputePnL(custodians []*Custodian, quote string, method CostBasisMethod, rateAt RateAtFunc, rate RateFunc) *PnLReport {
+	positions := make(map[string]*position)
+	get := func(code string) *position {
+		p, found := positions[code]
+		if !found {
+			p = &position{pnl: &AssetPnL{Code: code}}
+			positions[code] = p
+		}
+		return p
+	}
+
+	opening, balances := openingEvents(custodians)
+	events := append(opening, costBasisEvents(custodians)...)
+
+	// without any transaction, the balances are acquired now, at the current rates
+	if len(opening) > 0 && opening[0].time.IsZero() {
+		current := rateAt
+		rateAt = func(from, to string, at time.Time) (decimal.Decimal, error) {
+			if at.IsZero() {
+				return rate(from, to)
+			}
+			return current(from, to, at)
+		}
+	}
+
+	for _, e := range events {
+		value, err := e.value(quote, rateAt)
+
+		for _, a := range []*Asset{e.disposed, e.acquired} {
+			if a == nil || a.Code == quote {
+				continue
+			}
+			p := get(a.Code)
+			if err != nil && p.pnl.Error == "" {
+				p.pnl.Error = err.Error()
+			}
+			if p.pnl.Error != "" {
+				continue
+			}
+			if a == e.disposed {
+				p.dispose(a.Balance, value, method)
+			} else {
+				p.acquire(e.time, a.Balance, value, method)
+			}
+		}
+
+		for _, fee := range e.fees {
+			if fee.Code == quote {
+				continue
+			}
+			if p := get(fee.Code); p.pnl.Error == "" {
+				p.dispose(fee.Balance, decimal.Zero, method)
+			}
+		}
+	}
+
+	report := &PnLReport{Quote: quote, Method: method, Assets: make([]*AssetPnL, 0, len(positions)), Complete: true}
+	for code, p := range positions {
+		pnl := p.pnl
+		report.Assets = append(report.Assets, pnl)
+		if pnl.Error != "" {
+			// without the lots, only the current balance is known
+			report.Complete = false
+			pnl.Quantity = balances[code]
+			pnl.Disposed, pnl.Proceeds, pnl.Realized, pnl.Uncovered = decimal.Zero, decimal.Zero, decimal.Zero, decimal.Zero
+			continue
+		}
+
+		for _, l := range p.lots {
+			pnl.Quantity = pnl.Quantity.Add(l.quantity)
+			pnl.CostBasis = pnl.CostBasis.Add(l.cost)
+		}
+		pnl.CostBasis = pnl.CostBasis.RoundBank(8)
+		pnl.Realized = pnl.Realized.RoundBank(8)
+
+		r, err := rate(code, quote)
+		if err != nil {
+			pnl.Error = fmt.Sprintf("no %s rate for %s: %v", quote, code, err)
+			report.Complete = false
+			continue
+		}
+		marketValue := pnl.Quantity.Mul(r).RoundBank(8)
+		unrealized := marketValue.Sub(pnl.CostBasis)
+		pnl.MarketValue, pnl.Unrealized = &marketValue, &unrealized
+		report.Realized = report.Realized.Add(pnl.Realized)
+		report.Unrealized = report.Unrealized.Add(unrealized)
+	}
+	sort.Slice(report.Assets, func(i, j int) bool {
+		return report.Assets[i].Code < report.Assets[j].Code
+	})
+	return report
+}
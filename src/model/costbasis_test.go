@@ -0,0 +1,129 @@
+package model
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+func TestComputePnL(t *testing.T) {
+	day := func(d int) time.Time {
+		return time.Date(2021, 5, d, 0, 0, 0, 0, time.UTC)
+	}
+	// BTC is worth 10000 GBP on the 1st, 20000 on the 2nd...
+	rateAt := func(from, to string, at time.Time) (decimal.Decimal, error) {
+		if from != "BTC" || to != "GBP" {
+			return decimal.Zero, errors.New("invalid currency pair")
+		}
+		return decimal.NewFromInt(int64(at.Day()) * 10000), nil
+	}
+	rate := func(from, to string) (decimal.Decimal, error) {
+		if from != "BTC" || to != "GBP" {
+			return decimal.Zero, errors.New("invalid currency pair")
+		}
+		return decimal.NewFromInt(50000), nil
+	}
+	btc := func(s string) decimal.Decimal {
+		return decimal.RequireFromString(s)
+	}
+
+	// the wallet had 1 BTC before the first transaction
+	wallet := &Custodian{ID: 1, Assets: []*Asset{{Code: "BTC", Balance: decimal.Zero}}}
+	exchange := &Custodian{ID: 2, Assets: []*Asset{{Code: "BTC", Balance: btc("1")}, {Code: "GBP", Balance: decimal.NewFromInt(120000)}}}
+	exchange.AddTransaction(
+		&Transaction{Asset: "GBP", Amount: decimal.NewFromInt(100000), Direction: DirectionIn, Timestamp: day(1)},
+		// 2 BTC for 40000 GBP
+		&Transaction{Asset: "GBP", Amount: decimal.NewFromInt(40000), Direction: DirectionOut, Timestamp: day(2), RelatedCustodianID: 2, RelatedCustodianTransactionID: 3},
+		&Transaction{Asset: "BTC", Amount: btc("2"), Direction: DirectionIn, Timestamp: day(2), RelatedCustodianID: 2, RelatedCustodianTransactionID: 2},
+		// from the wallet
+		&Transaction{Asset: "BTC", Amount: btc("1"), Direction: DirectionIn, Timestamp: day(3), RelatedCustodianID: 1, RelatedCustodianTransactionID: 1},
+		// 1.5 BTC sold for 60000 GBP
+		&Transaction{Asset: "BTC", Amount: btc("1.5"), Direction: DirectionOut, Timestamp: day(4), RelatedCustodianID: 2, RelatedCustodianTransactionID: 6},
+		&Transaction{Asset: "GBP", Amount: decimal.NewFromInt(60000), Direction: DirectionIn, Timestamp: day(4), RelatedCustodianID: 2, RelatedCustodianTransactionID: 5},
+		// 0.5 BTC withdrawn, for 20000 GBP
+		&Transaction{Asset: "BTC", Amount: btc("0.5"), Direction: DirectionOut, Timestamp: day(4)},
+	)
+	wallet.AddTransaction(
+		&Transaction{Asset: "BTC", Amount: btc("1"), Direction: DirectionOut, Timestamp: day(3), RelatedCustodianID: 2, RelatedCustodianTransactionID: 4},
+	)
+	custodians := []*Custodian{wallet, exchange}
+
+	for _, tt := range []struct {
+		method                          CostBasisMethod
+		costBasis, realized, unrealized string
+	}{
+		// the 1 BTC of the wallet, and 0.5 of the 2 bought, are sold for 60000
+		{FIFO, "20000", "50000", "30000"},
+		// 1.5 of the 2 BTC bought are sold, the 0.5 left are withdrawn
+		{LIFO, "10000", "40000", "40000"},
+		// the 3 BTC cost 50000
+		{AverageCost, "16666.66666667", "46666.66666667", "33333.33333333"},
+	} {
+		r := ComputePnL(custodians, "GBP", tt.method, rateAt, rate)
+		if r.Quote != "GBP" || r.Method != tt.method || !r.Complete || len(r.Assets) != 1 {
+			t.Fatalf("%s: unexpected report %+v", tt.method, r)
+		}
+		a := r.Assets[0]
+		if a.Code != "BTC" || !a.Quantity.Equal(btc("1")) || !a.Disposed.Equal(btc("2")) ||
+			!a.Proceeds.Equal(decimal.NewFromInt(80000)) || !a.Uncovered.IsZero() ||
+			!a.CostBasis.Equal(btc(tt.costBasis)) || !a.Realized.Equal(btc(tt.realized)) ||
+			a.MarketValue == nil || !a.MarketValue.Equal(decimal.NewFromInt(50000)) ||
+			a.Unrealized == nil || !a.Unrealized.Equal(btc(tt.unrealized)) {
+			t.Errorf("%s: unexpected BTC P&L %+v", tt.method, a)
+		}
+		if !r.Realized.Equal(a.Realized) || !r.Unrealized.Equal(*a.Unrealized) {
+			t.Errorf("%s: unexpected totals %+v", tt.method, r)
+		}
+	}
+
+	// a withdrawal of more than the lots, and an asset without rate
+	exchange.AddTransaction(
+		&Transaction{Asset: "BTC", Amount: btc("2"), Direction: DirectionOut, Timestamp: day(5)},
+		&Transaction{Asset: "ETH", Amount: btc("3"), Direction: DirectionIn, Timestamp: day(5)},
+	)
+	exchange.Assets = append(exchange.Assets, &Asset{Code: "ETH", Balance: btc("3")})
+	exchange.Assets[0].Balance = btc("-1")
+	r := ComputePnL(custodians, "GBP", FIFO, rateAt, rate)
+	if r.Complete || len(r.Assets) != 2 {
+		t.Fatalf("unexpected report %+v", r)
+	}
+	if a := r.Assets[0]; !a.Uncovered.Equal(btc("1")) || !a.Realized.Equal(decimal.NewFromInt(130000)) {
+		t.Errorf("unexpected BTC P&L %+v", a)
+	}
+	if a := r.Assets[1]; a.Code != "ETH" || a.Error == "" || !a.Quantity.Equal(btc("3")) || a.MarketValue != nil {
+		t.Errorf("unexpected ETH P&L %+v", a)
+	}
+
+	// without a current rate, the realized profit of the asset is left out of the total too
+	noRate := func(from, to string) (decimal.Decimal, error) {
+		return decimal.Zero, errors.New("no rate")
+	}
+	r = ComputePnL(custodians, "GBP", FIFO, rateAt, noRate)
+	if a := r.Assets[0]; a.Error == "" || !a.Realized.Equal(decimal.NewFromInt(130000)) {
+		t.Errorf("unexpected BTC P&L without a current rate %+v", a)
+	}
+	if r.Complete || !r.Realized.IsZero() || !r.Unrealized.IsZero() {
+		t.Errorf("unexpected totals without a current rate %+v", r)
+	}
+
+	// a fee is disposed of for nothing, a fee in the quote currency isn't
+	fee, gbpFee := btc("0.1"), decimal.NewFromInt(10)
+	wallet = &Custodian{ID: 4, Assets: []*Asset{{Code: "BTC", Balance: btc("0.9")}, {Code: "GBP", Balance: decimal.NewFromInt(30)}}}
+	wallet.AddTransaction(
+		&Transaction{Asset: "BTC", Amount: btc("1"), Direction: DirectionIn, Timestamp: day(1), Fee: &fee, FeeAsset: "BTC"},
+		&Transaction{Asset: "GBP", Amount: decimal.NewFromInt(40), Direction: DirectionIn, Timestamp: day(1), Fee: &gbpFee, FeeAsset: "GBP"},
+	)
+	r = ComputePnL([]*Custodian{wallet}, "GBP", FIFO, rateAt, rate)
+	if a := r.Assets[0]; len(r.Assets) != 1 || !a.Quantity.Equal(btc("0.9")) || !a.Disposed.Equal(fee) ||
+		!a.Proceeds.IsZero() || !a.Realized.Equal(decimal.NewFromInt(-1000)) {
+		t.Errorf("unexpected BTC P&L with a fee %+v", r.Assets)
+	}
+
+	// without any transaction, the balances have no profit
+	r = ComputePnL([]*Custodian{{ID: 3, Assets: []*Asset{{Code: "BTC", Balance: btc("2")}}}}, "GBP", FIFO, rateAt, rate)
+	if a := r.Assets[0]; !a.CostBasis.Equal(decimal.NewFromInt(100000)) || !a.Unrealized.IsZero() {
+		t.Errorf("unexpected BTC P&L %+v", a)
+	}
+}
@@ -0,0 +1,100 @@
+package model
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+// ExchangeSummary sums up the exchanges of a pair
+type ExchangeSummary struct {
+	Pair  string          `json:"pair"`
+	Count int             `json:"count"`
+	From  decimal.Decimal `json:"from"`
+	To    decimal.Decimal `json:"to"`
+	// AveragePrice is the amount of To received for one From, over all the exchanges
+	AveragePrice decimal.Decimal `json:"average_price"`
+
+	// Value is the sum of the values of the exchanges, when they were valued,
+	// and Unvalued the number of exchanges which couldn't be
+	Value    *decimal.Decimal `json:"value,omitempty"`
+	Unvalued int              `json:"unvalued,omitempty"`
+}
+
+// ValueExchanges values each exchange in the quote currency, with the rates at the time of the exchange.
+// An exchange with the quote currency is worth its amount in it, without a rate.
+// The values are rounded to 8 decimals, and an exchange without a rate gets an error instead of a value.
+func ValueExchanges(ex []AssetExchange, quote string, rateAt RateAtFunc) {
+	for i := range ex {
+		e := &ex[i]
+		value, err := tradeValue(e.From, e.To, quote, e.Timestamp, rateAt)
+		if err != nil {
+			e.ValueError = err.Error()
+			continue
+		}
+		e.Value = &value
+	}
+}
+
+// tradeValue is the value in the quote currency of the from asset given for the to asset at a time,
+// rounded to 8 decimals. A trade with the quote currency is worth its amount in it.
+func tradeValue(from, to *Asset, quote string, at time.Time, rateAt RateAtFunc) (decimal.Decimal, error) {
+	if to.Code == quote {
+		return to.Balance, nil
+	}
+	return assetValue(from, quote, at, rateAt)
+}
+
+// assetValue is the value of the asset in the quote currency at a time, rounded to 8 decimals
+func assetValue(a *Asset, quote string, at time.Time, rateAt RateAtFunc) (decimal.Decimal, error) {
+	if a.Code == quote {
+		return a.Balance, nil
+	}
+	rate, err := rateAt(a.Code, quote, at)
+	if err != nil {
+		return decimal.Zero, fmt.Errorf("no %s rate for %s: %v", quote, a.Code, err)
+	}
+	return a.Balance.Mul(rate).RoundBank(8), nil
+}
+
+// SummarizeExchanges sums up the exchanges by pair, sorted by Pair.
+// The summaries have a Value when the exchanges were valued with ValueExchanges.
+func SummarizeExchanges(ex []AssetExchange) []*ExchangeSummary {
+	pairs := make(map[string]*ExchangeSummary)
+	res := make([]*ExchangeSummary, 0)
+	for i := range ex {
+		e := &ex[i]
+		s, found := pairs[e.Pair()]
+		if !found {
+			s = &ExchangeSummary{Pair: e.Pair()}
+			pairs[e.Pair()] = s
+			res = append(res, s)
+		}
+		s.Count++
+		s.From = s.From.Add(e.From.Balance)
+		s.To = s.To.Add(e.To.Balance)
+
+		switch {
+		case e.Value != nil:
+			v := *e.Value
+			if s.Value != nil {
+				v = v.Add(*s.Value)
+			}
+			s.Value = &v
+		case e.ValueError != "":
+			s.Unvalued++
+		}
+	}
+
+	for _, s := range res {
+		if !s.From.IsZero() {
+			s.AveragePrice = s.To.DivRound(s.From, 8)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Pair < res[j].Pair
+	})
+	return res
+}
@@ -0,0 +1,86 @@
+package model
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+func TestGetAssetExchanges(t *testing.T) {
+	at := time.Date(2021, 5, 20, 10, 0, 0, 0, time.UTC)
+	c := &Custodian{ID: 3}
+	c.AddTransaction(
+		&Transaction{Asset: "BTC", Amount: decimal.RequireFromString("0.5"), Direction: DirectionOut, Timestamp: at, RelatedCustodianID: 3, RelatedCustodianTransactionID: 2},
+		&Transaction{Asset: "GBP", Amount: decimal.NewFromInt(20000), Direction: DirectionIn, Timestamp: at, RelatedCustodianID: 3, RelatedCustodianTransactionID: 1},
+		&Transaction{Asset: "GBP", Amount: decimal.NewFromInt(100), Direction: DirectionIn},
+		// the IN leg is missing
+		&Transaction{Asset: "BTC", Amount: decimal.RequireFromString("0.1"), Direction: DirectionOut, RelatedCustodianID: 3, RelatedCustodianTransactionID: 9},
+	)
+
+	ex := c.GetAssetExchanges()
+	if len(ex) != 1 {
+		t.Fatalf("expected 1 exchange, got %d", len(ex))
+	}
+	e := ex[0]
+	if e.CustodianID != 3 || e.FromTransactionID != 1 || e.ToTransactionID != 2 || !e.Timestamp.Equal(at) ||
+		e.Pair() != "BTC/GBP" || !e.Price.Equal(decimal.NewFromInt(40000)) {
+		t.Errorf("unexpected exchange %+v", e)
+	}
+}
+
+func TestValueExchanges(t *testing.T) {
+	day := func(d int) time.Time {
+		return time.Date(2021, 5, d, 0, 0, 0, 0, time.UTC)
+	}
+	exchange := func(d int, from, fromAmount, to, toAmount string) AssetExchange {
+		return AssetExchange{
+			Timestamp: day(d),
+			From:      &Asset{Code: from, Balance: decimal.RequireFromString(fromAmount)},
+			To:        &Asset{Code: to, Balance: decimal.RequireFromString(toAmount)},
+		}
+	}
+	ex := []AssetExchange{
+		exchange(1, "GBP", "40000", "BTC", "1"),
+		exchange(2, "BTC", "0.5", "GBP", "21000"),
+		exchange(3, "ETH", "2", "BTC", "0.1"),
+		exchange(4, "ETH", "1", "BTC", "0.05"),
+	}
+	rateAt := func(from, to string, at time.Time) (decimal.Decimal, error) {
+		if from == "ETH" && to == "GBP" && at.Equal(day(3)) {
+			return decimal.NewFromInt(2000), nil
+		}
+		return decimal.Zero, errors.New("no rate at this time")
+	}
+
+	ValueExchanges(ex, "GBP", rateAt)
+	for i, expected := range []string{"40000", "21000", "4000", ""} {
+		switch {
+		case expected == "" && (ex[i].Value != nil || ex[i].ValueError == ""):
+			t.Errorf("exchange %d: expected an error, got %+v", i, ex[i])
+		case expected != "" && (ex[i].Value == nil || !ex[i].Value.Equal(decimal.RequireFromString(expected))):
+			t.Errorf("exchange %d: expected a value of %s, got %+v", i, expected, ex[i])
+		}
+	}
+
+	summaries := SummarizeExchanges(ex)
+	if len(summaries) != 3 {
+		t.Fatalf("expected 3 pairs, got %d", len(summaries))
+	}
+	for i, pair := range []string{"BTC/GBP", "ETH/BTC", "GBP/BTC"} {
+		if summaries[i].Pair != pair {
+			t.Errorf("expected pair %d to be %s, got %s", i, pair, summaries[i].Pair)
+		}
+	}
+	eth := summaries[1]
+	if eth.Count != 2 || !eth.From.Equal(decimal.NewFromInt(3)) || !eth.AveragePrice.Equal(decimal.RequireFromString("0.05")) ||
+		eth.Value == nil || !eth.Value.Equal(decimal.NewFromInt(4000)) || eth.Unvalued != 1 {
+		t.Errorf("unexpected ETH/BTC summary %+v", eth)
+	}
+
+	// without a valuation, the summaries have no value
+	if s := SummarizeExchanges([]AssetExchange{exchange(1, "GBP", "40000", "BTC", "1")}); s[0].Value != nil || s[0].Unvalued != 0 {
+		t.Errorf("unexpected summary %+v", s[0])
+	}
+}
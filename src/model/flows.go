@@ -0,0 +1,92 @@
+package model
+
+import (
+	"sort"
+
+	"github.com/shopspring/decimal"
+)
+
+// AssetFlows are the movements of an asset in and out of a portfolio, and between its custodians
+type AssetFlows struct {
+	Code string `json:"code"`
+
+	// Deposits and Withdrawals are the external deposits and withdrawals of the custodians
+	Deposits    decimal.Decimal `json:"deposits"`
+	Withdrawals decimal.Decimal `json:"withdrawals"`
+	// UnlinkedIn and UnlinkedOut are the transfers from and to custodians outside of the portfolio
+	UnlinkedIn  decimal.Decimal `json:"unlinked_in"`
+	UnlinkedOut decimal.Decimal `json:"unlinked_out"`
+	// ExternalIn and ExternalOut are the flows in and out of the portfolio, both of the above
+	ExternalIn  decimal.Decimal `json:"external_in"`
+	ExternalOut decimal.Decimal `json:"external_out"`
+	// Net is ExternalIn minus ExternalOut
+	Net decimal.Decimal `json:"net"`
+
+	// InternalIn and InternalOut are the transfers between the custodians of the portfolio.
+	// They only cancel out when the transfers are between the same assets.
+	InternalIn  decimal.Decimal `json:"internal_in"`
+	InternalOut decimal.Decimal `json:"internal_out"`
+
+	// Fees are paid by the custodians on top of the flows, they're not part of Net
+	Fees decimal.Decimal `json:"fees"`
+}
+
+// NetFlows returns the flows of each asset of a portfolio made of the custodians, sorted by Code.
+// A transfer between two of the custodians is internal, and a transfer with another custodian is external,
+// like a deposit or a withdrawal. The internal asset exchanges aren't flows.
+func NetFlows(custodians []*Custodian) []*AssetFlows {
+	linked := make(map[int32]bool, len(custodians))
+	for _, c := range custodians {
+		linked[c.ID] = true
+	}
+
+	flows := make(map[string]*AssetFlows)
+	get := func(code string) *AssetFlows {
+		f, found := flows[code]
+		if !found {
+			f = &AssetFlows{Code: code}
+			flows[code] = f
+		}
+		return f
+	}
+	for _, c := range custodians {
+		for _, tx := range c.Transactions {
+			if fee := tx.FeePaid(); fee != nil {
+				f := get(fee.Code)
+				f.Fees = f.Fees.Add(fee.Balance)
+			}
+
+			f := get(tx.Asset)
+
+			switch c.GetTransactionType(tx) {
+			case ExternalDeposit:
+				f.Deposits = f.Deposits.Add(tx.Amount)
+			case ExternalWithdrawal:
+				f.Withdrawals = f.Withdrawals.Add(tx.Amount)
+			case ForeignTransfer:
+				switch {
+				case linked[tx.RelatedCustodianID] && tx.Direction == DirectionIn:
+					f.InternalIn = f.InternalIn.Add(tx.Amount)
+				case linked[tx.RelatedCustodianID]:
+					f.InternalOut = f.InternalOut.Add(tx.Amount)
+				case tx.Direction == DirectionIn:
+					f.UnlinkedIn = f.UnlinkedIn.Add(tx.Amount)
+				default:
+					f.UnlinkedOut = f.UnlinkedOut.Add(tx.Amount)
+				}
+			}
+		}
+	}
+
+	res := make([]*AssetFlows, 0, len(flows))
+	for _, f := range flows {
+		f.ExternalIn = f.Deposits.Add(f.UnlinkedIn)
+		f.ExternalOut = f.Withdrawals.Add(f.UnlinkedOut)
+		f.Net = f.ExternalIn.Sub(f.ExternalOut)
+		res = append(res, f)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Code < res[j].Code
+	})
+	return res
+}
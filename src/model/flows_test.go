@@ -0,0 +1,67 @@
+package model
+
+import (
+	"testing"
+
+	"github.com/shopspring/decimal"
+)
+
+func TestNetFlows(t *testing.T) {
+	tx := func(dir, asset string, amount int64, relCust int32) *Transaction {
+		return &Transaction{Asset: asset, Amount: decimal.NewFromInt(amount), Direction: dir, RelatedCustodianID: relCust, RelatedCustodianTransactionID: relCust}
+	}
+
+	wallet := &Custodian{ID: 1}
+	wallet.AddTransaction(
+		tx(DirectionIn, "BTC", 5, 0),  // deposit
+		tx(DirectionOut, "BTC", 2, 2), // to the exchange
+		tx(DirectionOut, "BTC", 1, 9), // to a custodian outside of the portfolio
+	)
+	exchange := &Custodian{ID: 2}
+	exchange.AddTransaction(
+		tx(DirectionIn, "BTC", 2, 1),      // from the wallet
+		tx(DirectionOut, "BTC", 1, 2),     // sold
+		tx(DirectionIn, "GBP", 40000, 2),  // bought
+		tx(DirectionOut, "GBP", 30000, 0), // withdrawal, with a fee
+		tx(DirectionIn, "GBP", 1000, 9),   // from a custodian outside of the portfolio
+		tx(DirectionIn, "ETH", 3, 1),      // from the wallet, in another asset
+	)
+
+	fee := decimal.NewFromInt(5)
+	exchange.Transactions[3].Fee, exchange.Transactions[3].FeeAsset = &fee, "GBP"
+
+	flows := NetFlows([]*Custodian{wallet, exchange})
+	if len(flows) != 3 {
+		t.Fatalf("expected 3 assets, got %d", len(flows))
+	}
+	expected := []struct {
+		code                                        string
+		externalIn, externalOut, net, intIn, intOut int64
+	}{
+		{"BTC", 5, 1, 4, 2, 2},
+		{"ETH", 0, 0, 0, 3, 0},
+		{"GBP", 1000, 30000, -29000, 0, 0},
+	}
+	for i, e := range expected {
+		f := flows[i]
+		if f.Code != e.code || !f.ExternalIn.Equal(decimal.NewFromInt(e.externalIn)) ||
+			!f.ExternalOut.Equal(decimal.NewFromInt(e.externalOut)) || !f.Net.Equal(decimal.NewFromInt(e.net)) ||
+			!f.InternalIn.Equal(decimal.NewFromInt(e.intIn)) || !f.InternalOut.Equal(decimal.NewFromInt(e.intOut)) {
+			t.Errorf("unexpected flows %+v", f)
+		}
+	}
+
+	if btc := flows[0]; !btc.Deposits.Equal(decimal.NewFromInt(5)) || !btc.UnlinkedOut.Equal(decimal.NewFromInt(1)) {
+		t.Errorf("unexpected BTC flows %+v", btc)
+	}
+	if gbp := flows[2]; !gbp.Withdrawals.Equal(decimal.NewFromInt(30000)) || !gbp.UnlinkedIn.Equal(decimal.NewFromInt(1000)) ||
+		!gbp.Fees.Equal(decimal.NewFromInt(5)) {
+		t.Errorf("unexpected GBP flows %+v", gbp)
+	}
+
+	// without the wallet, its transfers with the exchange are external
+	flows = NetFlows([]*Custodian{exchange})
+	if btc := flows[0]; !btc.UnlinkedIn.Equal(decimal.NewFromInt(2)) || !btc.InternalIn.IsZero() {
+		t.Errorf("unexpected BTC flows %+v", btc)
+	}
+}
@@ -0,0 +1,106 @@
+package model
+
+import (
+	"sort"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+// RateAtFunc returns the amount of the `to` currency worth one unit of the `from` currency at a time
+type RateAtFunc func(from, to string, at time.Time) (decimal.Decimal, error)
+
+// AssetPoint is the balance of an asset at a time, with its value or the error which prevented valuing it
+type AssetPoint struct {
+	Time    time.Time        `json:"time"`
+	Balance decimal.Decimal  `json:"balance"`
+	Value   *decimal.Decimal `json:"value,omitempty"`
+	Error   string           `json:"error,omitempty"`
+}
+
+// TotalPoint is the value of a portfolio at a time, Complete is false when some assets have no rate
+type TotalPoint struct {
+	Time     time.Time       `json:"time"`
+	Value    decimal.Decimal `json:"value"`
+	Complete bool            `json:"complete"`
+}
+
+// PortfolioHistory is the value of a portfolio over time, per asset and in total
+type PortfolioHistory struct {
+	Quote  string                   `json:"quote"`
+	Assets map[string][]*AssetPoint `json:"assets"`
+	Total  []*TotalPoint            `json:"total"`
+}
+
+// BalancesAt returns the holdings of the custodians at each time, sorted by Asset.Code.
+// They're replayed backwards from the current balances: the transactions after a time, and their fees, are undone.
+// The times must be in ascending order, and every asset appears at each time.
+func BalancesAt(custodians []*Custodian, times []time.Time) [][]*Asset {
+	balances := make(map[string]decimal.Decimal)
+	var txs []*Transaction
+	for _, c := range custodians {
+		for _, asset := range c.Assets {
+			balances[asset.Code] = balances[asset.Code].Add(asset.Balance)
+		}
+		txs = append(txs, c.Transactions...)
+	}
+	for _, tx := range txs {
+		balances[tx.Asset] = balances[tx.Asset].Add(decimal.Zero)
+		if fee := tx.FeePaid(); fee != nil {
+			balances[fee.Code] = balances[fee.Code].Add(decimal.Zero)
+		}
+	}
+
+	// the most recent transactions are undone first
+	sort.SliceStable(txs, func(i, j int) bool {
+		return txs[i].Timestamp.After(txs[j].Timestamp)
+	})
+
+	res := make([][]*Asset, len(times))
+	next := 0
+	for i := len(times) - 1; i >= 0; i-- {
+		for ; next < len(txs) && txs[next].Timestamp.After(times[i]); next++ {
+			tx := txs[next]
+			if tx.Direction == DirectionIn {
+				balances[tx.Asset] = balances[tx.Asset].Sub(tx.Amount)
+			} else {
+				balances[tx.Asset] = balances[tx.Asset].Add(tx.Amount)
+			}
+			if fee := tx.FeePaid(); fee != nil {
+				balances[fee.Code] = balances[fee.Code].Add(fee.Balance)
+			}
+		}
+
+		assets := make([]*Asset, 0, len(balances))
+		for code, balance := range balances {
+			assets = append(assets, &Asset{Code: code, Balance: balance})
+		}
+		SortAssetsByCode(assets)
+		res[i] = assets
+	}
+	return res
+}
+
+// ValueHistory values the holdings of the custodians at each time, with the rates at this time.
+// The times must be in ascending order.
+func ValueHistory(custodians []*Custodian, times []time.Time, quote string, rateAt RateAtFunc) *PortfolioHistory {
+	h := &PortfolioHistory{Quote: quote, Assets: make(map[string][]*AssetPoint), Total: make([]*TotalPoint, 0, len(times))}
+
+	for i, holdings := range BalancesAt(custodians, times) {
+		at := times[i]
+		v := ValueHoldings(holdings, quote, func(from, to string) (decimal.Decimal, error) {
+			return rateAt(from, to, at)
+		})
+
+		h.Total = append(h.Total, &TotalPoint{Time: at, Value: v.Total, Complete: v.Complete})
+		for _, asset := range v.Holdings {
+			h.Assets[asset.Code] = append(h.Assets[asset.Code], &AssetPoint{
+				Time:    at,
+				Balance: asset.Balance,
+				Value:   asset.Value,
+				Error:   asset.Error,
+			})
+		}
+	}
+	return h
+}
@@ -0,0 +1,57 @@
+package model
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+func TestValueHistory(t *testing.T) {
+	day := func(d int) time.Time {
+		return time.Date(2021, 5, d, 0, 0, 0, 0, time.UTC)
+	}
+
+	// 1 BTC deposited on the 2nd, 0.5 BTC exchanged for 20000 GBP on the 4th
+	c := &Custodian{ID: 1, Assets: []*Asset{
+		{Code: "BTC", Balance: decimal.RequireFromString("0.5")},
+		{Code: "GBP", Balance: decimal.NewFromInt(20000)},
+	}}
+	c.AddTransaction(
+		&Transaction{Asset: "BTC", Amount: decimal.NewFromInt(1), Direction: DirectionIn, Timestamp: day(2)},
+		&Transaction{Asset: "BTC", Amount: decimal.RequireFromString("0.5"), Direction: DirectionOut, Timestamp: day(4), RelatedCustodianID: 1, RelatedCustodianTransactionID: 3},
+		&Transaction{Asset: "GBP", Amount: decimal.NewFromInt(20000), Direction: DirectionIn, Timestamp: day(4), RelatedCustodianID: 1, RelatedCustodianTransactionID: 2},
+	)
+
+	// BTC is worth 40000 GBP, and there's no rate before the 2nd
+	rateAt := func(from, to string, at time.Time) (decimal.Decimal, error) {
+		switch {
+		case from == to:
+			return decimal.NewFromInt(1), nil
+		case at.Before(day(2)):
+			return decimal.Zero, errors.New("no rate")
+		}
+		return decimal.NewFromInt(40000), nil
+	}
+
+	times := []time.Time{day(1), day(2), day(3), day(4), day(5)}
+	h := ValueHistory([]*Custodian{c}, times, "GBP", rateAt)
+
+	if len(h.Total) != 5 || len(h.Assets["BTC"]) != 5 || len(h.Assets["GBP"]) != 5 {
+		t.Fatalf("expected 5 points per series, got %+v", h)
+	}
+	for i, want := range []string{"0", "1", "1", "0.5", "0.5"} {
+		if p := h.Assets["BTC"][i]; p.Balance.String() != want || !p.Time.Equal(times[i]) {
+			t.Errorf("%v: expected %s BTC, got %s at %v", times[i], want, p.Balance, p.Time)
+		}
+	}
+	for i, want := range []string{"0", "40000", "40000", "40000", "40000"} {
+		if p := h.Total[i]; p.Value.String() != want || p.Complete != (i > 0) {
+			t.Errorf("%v: expected a total of %s, got %+v", times[i], want, p)
+		}
+	}
+	if p := h.Assets["BTC"][0]; p.Value != nil || p.Error == "" {
+		t.Errorf("expected an error without rate, got %+v", p)
+	}
+}
@@ -2,6 +2,7 @@ package model
 
 import (
 	"sort"
+	"time"
 
 	"github.com/shopspring/decimal"
 )
@@ -27,13 +28,18 @@ type Custodian struct {
 	Transactions []*Transaction `json:"transactions,omitempty"`
 }
 
+// LastTransactionID returns the ID of the last transaction of the custodian, 0 if it has none
+func (c *Custodian) LastTransactionID() int32 {
+	if len(c.Transactions) == 0 {
+		return 0
+	}
+	return c.Transactions[len(c.Transactions)-1].ID
+}
+
 // AddTransaction adds one or more new transactions to the custodian
 func (c *Custodian) AddTransaction(t ...*Transaction) {
 	// determine the last ID we added
-	startID := int32(0)
-	if len(c.Transactions) > 0 {
-		startID = c.Transactions[len(c.Transactions)-1].ID
-	}
+	startID := c.LastTransactionID()
 
 	// Set the IDs of the transactions we're adding
 	for idx, transaction := range t {
@@ -55,9 +61,27 @@ func SortAssetsByCode(a []*Asset) {
 	})
 }
 
+// AssetExchange is a trade between two assets of a custodian, From is given and To received
 type AssetExchange struct {
-	From *Asset
-	To   *Asset
+	CustodianID       int32     `json:"custodian_id"`
+	FromTransactionID int32     `json:"from_transaction_id"`
+	ToTransactionID   int32     `json:"to_transaction_id"`
+	Timestamp         time.Time `json:"timestamp"`
+
+	From *Asset `json:"from"`
+	To   *Asset `json:"to"`
+	// Price is the amount of To received for one From
+	Price decimal.Decimal `json:"price"`
+
+	// Value is the value of the trade in a quote currency, set by ValueExchanges,
+	// or the error which prevented valuing it
+	Value      *decimal.Decimal `json:"value,omitempty"`
+	ValueError string           `json:"value_error,omitempty"`
+}
+
+// Pair is the From/To pair of the exchange, like BTC/GBP
+func (e *AssetExchange) Pair() string {
+	return e.From.Code + "/" + e.To.Code
 }
 
 type Transaction struct {
@@ -65,9 +89,23 @@ type Transaction struct {
 	Asset     string          `json:"asset"`
 	Amount    decimal.Decimal `json:"amount"`
 	Direction string          `json:"direction"`
+	// Timestamp is when the transaction happened, in UTC
+	Timestamp time.Time `json:"timestamp"`
 
 	RelatedCustodianID            int32 `json:"related_custodian_id,omitempty"`
 	RelatedCustodianTransactionID int32 `json:"related_custodian_transaction_id,omitempty"`
+
+	// Fee is paid by the custodian in FeeAsset, on top of the Amount
+	Fee      *decimal.Decimal `json:"fee,omitempty"`
+	FeeAsset string           `json:"fee_asset,omitempty"`
+}
+
+// FeePaid returns the fee of the transaction, nil when it has none
+func (t *Transaction) FeePaid() *Asset {
+	if t.Fee == nil || t.Fee.IsZero() {
+		return nil
+	}
+	return &Asset{Code: t.FeeAsset, Balance: *t.Fee}
 }
 
 // TransactionsByID returns transactions indexed by ID for faster lookup
@@ -79,6 +117,18 @@ func IndexTransactionsByID(txs []*Transaction) map[int32]*Transaction {
 	return m
 }
 
+// FilterTransactionsByTime returns the transactions from `from` included to `to` excluded,
+// a zero time doesn't limit the range
+func FilterTransactionsByTime(txs []*Transaction, from, to time.Time) []*Transaction {
+	txl := make([]*Transaction, 0)
+	for _, tx := range txs {
+		if (from.IsZero() || !tx.Timestamp.Before(from)) && (to.IsZero() || tx.Timestamp.Before(to)) {
+			txl = append(txl, tx)
+		}
+	}
+	return txl
+}
+
 // GetTransactionType returns the Transaction Type
 func (c *Custodian) GetTransactionType(t *Transaction) TransactionType {
 
@@ -113,7 +163,18 @@ func (c *Custodian) FilterTransactionsByType(txtype TransactionType) []*Transact
 	return txl
 }
 
-// GetAssetExchanges returns the internal asset exchanges
+// Fees returns the total of the fees paid by the custodian for each asset, sorted by Asset.Code
+func (c *Custodian) Fees() []*Asset {
+	al := NewAssetList()
+	for _, tx := range c.Transactions {
+		if fee := tx.FeePaid(); fee != nil {
+			al.AddAssetValue(fee)
+		}
+	}
+	return al.GetAssets()
+}
+
+// GetAssetExchanges returns the internal asset exchanges, an OUT leg without its IN leg is skipped
 func (c *Custodian) GetAssetExchanges() []AssetExchange {
 	txs := c.FilterTransactionsByType(InternalAssetExchange)
 	txsmap := IndexTransactionsByID(txs)
@@ -122,11 +183,22 @@ func (c *Custodian) GetAssetExchanges() []AssetExchange {
 
 	for _, tx := range txs {
 		if tx.Direction == "OUT" { // start with the OUT tx
-			relatedTx := txsmap[tx.RelatedCustodianTransactionID]
-			ex = append(ex, AssetExchange{
-				From: &Asset{Code: tx.Asset, Balance: tx.Amount},
-				To:   &Asset{Code: relatedTx.Asset, Balance: relatedTx.Amount},
-			})
+			relatedTx, found := txsmap[tx.RelatedCustodianTransactionID]
+			if !found {
+				continue
+			}
+			e := AssetExchange{
+				CustodianID:       c.ID,
+				FromTransactionID: tx.ID,
+				ToTransactionID:   relatedTx.ID,
+				Timestamp:         tx.Timestamp,
+				From:              &Asset{Code: tx.Asset, Balance: tx.Amount},
+				To:                &Asset{Code: relatedTx.Asset, Balance: relatedTx.Amount},
+			}
+			if !tx.Amount.IsZero() {
+				e.Price = relatedTx.Amount.DivRound(tx.Amount, 8)
+			}
+			ex = append(ex, e)
 		}
 	}
 	return ex
@@ -135,13 +207,42 @@ func (c *Custodian) GetAssetExchanges() []AssetExchange {
 type User struct {
 	ID         int32   `json:"id"`
 	Custodians []int32 `json:"custodians"`
+	// Version is incremented by each modification of the user, a modification
+	// made from an older version is rejected
+	Version int64 `json:"version"`
+
+	// Links tells how each linked custodian is reached, by custodian ID.
+	// Custodians without a link use the default adapter.
+	Links map[int32]*CustodianLink `json:"links,omitempty"`
+}
+
+// CustodianLink tells which adapter reaches a custodian linked by a user, and with which credentials
+type CustodianLink struct {
+	Adapter string `json:"adapter"`
+	// Credentials are passed to the adapter, they're never sent to clients
+	Credentials map[string]string `json:"-"`
 }
 
 func NewUser(id int32) *User {
-	u := &User{id, []int32{}}
+	u := &User{ID: id, Custodians: []int32{}}
 	return u
 }
 
+// Linked reports whether the user links the custodian
+func (u *User) Linked(custID int32) bool {
+	for _, id := range u.Custodians {
+		if id == custID {
+			return true
+		}
+	}
+	return false
+}
+
+// Link returns how the custodian linked by the user is reached, nil for the default adapter
+func (u *User) Link(custID int32) *CustodianLink {
+	return u.Links[custID]
+}
+
 // AssetList makes adding assets together much easier
 type AssetList struct {
 	assetsMap map[string]*Asset
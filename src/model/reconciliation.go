@@ -0,0 +1,89 @@
+package model
+
+import (
+	"sort"
+
+	"github.com/shopspring/decimal"
+)
+
+// AssetReconciliation compares the balance of an asset replayed from the transactions with the reported one
+type AssetReconciliation struct {
+	Code         string          `json:"code"`
+	Opening      decimal.Decimal `json:"opening"`
+	In           decimal.Decimal `json:"in"`
+	Out          decimal.Decimal `json:"out"`
+	Fees         decimal.Decimal `json:"fees"`
+	Transactions int             `json:"transactions"`
+	// Replayed is the opening balance plus the incoming transactions minus the outgoing ones and the fees
+	Replayed decimal.Decimal `json:"replayed"`
+	Reported decimal.Decimal `json:"reported"`
+	// Discrepancy is the reported balance minus the replayed one
+	Discrepancy decimal.Decimal `json:"discrepancy"`
+	Reconciled  bool            `json:"reconciled"`
+}
+
+// Reconciliation is the result of the reconciliation of a custodian, Reconciled when every asset is
+type Reconciliation struct {
+	CustodianID int32                  `json:"custodian_id"`
+	Tolerance   decimal.Decimal        `json:"tolerance"`
+	Assets      []*AssetReconciliation `json:"assets"`
+	Reconciled  bool                   `json:"reconciled"`
+}
+
+// Reconcile replays the transactions of the custodian from the opening balances, and compares the result
+// with the reported balances of its assets. An asset is reconciled when the discrepancy is within the tolerance.
+// Every asset with a reported balance or a transaction is reconciled, sorted by Code: the opening balances
+// of the other assets are ignored, so that the same opening balances can be used for every custodian.
+func Reconcile(c *Custodian, opening []*Asset, tolerance decimal.Decimal) *Reconciliation {
+	assets := make(map[string]*AssetReconciliation)
+	get := func(code string) *AssetReconciliation {
+		ar, found := assets[code]
+		if !found {
+			ar = &AssetReconciliation{Code: code}
+			assets[code] = ar
+		}
+		return ar
+	}
+
+	for _, asset := range c.Assets {
+		ar := get(asset.Code)
+		ar.Reported = ar.Reported.Add(asset.Balance)
+	}
+	for _, tx := range c.Transactions {
+		ar := get(tx.Asset)
+		ar.Transactions++
+		if tx.Direction == DirectionIn {
+			ar.In = ar.In.Add(tx.Amount)
+		} else {
+			ar.Out = ar.Out.Add(tx.Amount)
+		}
+		if fee := tx.FeePaid(); fee != nil {
+			ar := get(fee.Code)
+			ar.Fees = ar.Fees.Add(fee.Balance)
+		}
+	}
+
+	for _, asset := range opening {
+		if ar, found := assets[asset.Code]; found {
+			ar.Opening = ar.Opening.Add(asset.Balance)
+		}
+	}
+
+	r := &Reconciliation{
+		CustodianID: c.ID,
+		Tolerance:   tolerance,
+		Assets:      make([]*AssetReconciliation, 0, len(assets)),
+		Reconciled:  true,
+	}
+	for _, ar := range assets {
+		ar.Replayed = ar.Opening.Add(ar.In).Sub(ar.Out).Sub(ar.Fees)
+		ar.Discrepancy = ar.Reported.Sub(ar.Replayed)
+		ar.Reconciled = ar.Discrepancy.Abs().LessThanOrEqual(tolerance)
+		r.Reconciled = r.Reconciled && ar.Reconciled
+		r.Assets = append(r.Assets, ar)
+	}
+	sort.Slice(r.Assets, func(i, j int) bool {
+		return r.Assets[i].Code < r.Assets[j].Code
+	})
+	return r
+}
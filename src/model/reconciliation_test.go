@@ -0,0 +1,75 @@
+package model
+
+import (
+	"testing"
+
+	"github.com/shopspring/decimal"
+)
+
+func TestReconcile(t *testing.T) {
+	c := &Custodian{
+		ID: 2,
+		Assets: []*Asset{
+			{Code: "BTC", Balance: decimal.RequireFromString("1.23456789")},
+			{Code: "GBP", Balance: decimal.RequireFromString("150")},
+		},
+	}
+	c.AddTransaction(
+		&Transaction{Asset: "BTC", Amount: decimal.RequireFromString("0.234567891"), Direction: DirectionIn},
+		&Transaction{Asset: "GBP", Amount: decimal.RequireFromString("60"), Direction: DirectionOut},
+		&Transaction{Asset: "ETH", Amount: decimal.RequireFromString("2"), Direction: DirectionIn},
+	)
+	opening := []*Asset{
+		{Code: "BTC", Balance: decimal.NewFromInt(1)},
+		{Code: "GBP", Balance: decimal.NewFromInt(200)},
+		{Code: "USD", Balance: decimal.NewFromInt(300)},
+	}
+
+	r := Reconcile(c, opening, decimal.RequireFromString("0.00000001"))
+	if r.CustodianID != 2 || r.Reconciled {
+		t.Errorf("expected custodian 2 not to reconcile, got %+v", r)
+	}
+	if len(r.Assets) != 3 {
+		t.Fatalf("expected 3 assets without USD, got %d", len(r.Assets))
+	}
+
+	// the balance was rounded to 8 decimals, within the tolerance
+	btc := r.Assets[0]
+	if btc.Code != "BTC" || !btc.Reconciled || btc.Transactions != 1 ||
+		!btc.Replayed.Equal(decimal.RequireFromString("1.234567891")) ||
+		!btc.Discrepancy.Equal(decimal.RequireFromString("-0.000000001")) {
+		t.Errorf("unexpected BTC reconciliation %+v", btc)
+	}
+
+	// a transaction without a reported asset
+	eth := r.Assets[1]
+	if eth.Code != "ETH" || eth.Reconciled || !eth.Discrepancy.Equal(decimal.NewFromInt(-2)) {
+		t.Errorf("unexpected ETH reconciliation %+v", eth)
+	}
+
+	gbp := r.Assets[2]
+	if gbp.Code != "GBP" || gbp.Reconciled || !gbp.Out.Equal(decimal.NewFromInt(60)) ||
+		!gbp.Discrepancy.Equal(decimal.NewFromInt(10)) {
+		t.Errorf("unexpected GBP reconciliation %+v", gbp)
+	}
+
+	if r := Reconcile(c, opening, decimal.NewFromInt(10)); !r.Reconciled {
+		t.Errorf("expected every asset to reconcile within a tolerance of 10, got %+v", r)
+	}
+}
+
+func TestReconcile_fees(t *testing.T) {
+	fee := decimal.RequireFromString("0.001")
+	c := &Custodian{
+		ID:     1,
+		Assets: []*Asset{{Code: "BTC", Balance: decimal.RequireFromString("0.899")}},
+	}
+	c.AddTransaction(
+		&Transaction{Asset: "BTC", Amount: decimal.RequireFromString("0.1"), Direction: DirectionOut, RelatedCustodianID: 2, Fee: &fee, FeeAsset: "BTC"},
+	)
+
+	r := Reconcile(c, []*Asset{{Code: "BTC", Balance: decimal.NewFromInt(1)}}, decimal.Zero)
+	if btc := r.Assets[0]; !r.Reconciled || !btc.Fees.Equal(fee) || !btc.Replayed.Equal(btc.Reported) {
+		t.Errorf("expected the fee to reconcile, got %+v", btc)
+	}
+}
@@ -0,0 +1,132 @@
+package model
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+// TransferStatus tells if both legs of a transfer between custodians were found and agree
+type TransferStatus string
+
+const (
+	// TransferMatched is a transfer with both legs, pointing to each other
+	TransferMatched TransferStatus = "matched"
+	// TransferMismatched is a transfer whose legs don't agree with each other
+	TransferMismatched TransferStatus = "mismatched"
+	// TransferOrphaned is a transfer with a missing leg, at a custodian we know
+	TransferOrphaned TransferStatus = "orphaned"
+	// TransferUnlinked is a transfer with a custodian we don't know, only one leg can be found
+	TransferUnlinked TransferStatus = "unlinked"
+)
+
+// TransferLeg is one of the transactions of a transfer
+type TransferLeg struct {
+	CustodianID   int32           `json:"custodian_id"`
+	TransactionID int32           `json:"transaction_id"`
+	Asset         string          `json:"asset"`
+	Amount        decimal.Decimal `json:"amount"`
+}
+
+// Transfer is a movement of funds from a Source custodian to a Destination custodian.
+// A transfer which isn't matched has a Reason, and may miss one of its legs.
+type Transfer struct {
+	Timestamp   time.Time      `json:"timestamp"`
+	Source      *TransferLeg   `json:"source,omitempty"`
+	Destination *TransferLeg   `json:"destination,omitempty"`
+	Status      TransferStatus `json:"status"`
+	Reason      string         `json:"reason,omitempty"`
+}
+
+func newTransferLeg(custID int32, tx *Transaction) *TransferLeg {
+	return &TransferLeg{CustodianID: custID, TransactionID: tx.ID, Asset: tx.Asset, Amount: tx.Amount}
+}
+
+// MatchTransfers pairs the OUT and IN legs of the transfers between the custodians, from their
+// RelatedCustodianID and RelatedCustodianTransactionID. The legs at a custodian which isn't in the list are unlinked.
+// The internal asset exchanges aren't transfers. The transfers are sorted by Timestamp.
+func MatchTransfers(custodians []*Custodian) []*Transfer {
+	txsByCustodian := make(map[int32]map[int32]*Transaction, len(custodians))
+	for _, c := range custodians {
+		txsByCustodian[c.ID] = IndexTransactionsByID(c.Transactions)
+	}
+
+	var transfers []*Transfer
+	// IN legs already paired with an OUT leg
+	paired := make(map[*Transaction]bool)
+
+	// Start with the OUT legs, and look for their IN leg
+	for _, c := range custodians {
+		for _, tx := range c.FilterTransactionsByType(ForeignTransfer) {
+			if tx.Direction != DirectionOut {
+				continue
+			}
+			t := &Transfer{Timestamp: tx.Timestamp, Source: newTransferLeg(c.ID, tx), Status: TransferMatched}
+			transfers = append(transfers, t)
+
+			related, known := txsByCustodian[tx.RelatedCustodianID]
+			if !known {
+				t.Status = TransferUnlinked
+				t.Reason = fmt.Sprintf("custodian %d is not linked", tx.RelatedCustodianID)
+				continue
+			}
+			in, found := related[tx.RelatedCustodianTransactionID]
+			if !found {
+				t.Status = TransferOrphaned
+				t.Reason = fmt.Sprintf("transaction %d of custodian %d not found", tx.RelatedCustodianTransactionID, tx.RelatedCustodianID)
+				continue
+			}
+			t.Destination = newTransferLeg(tx.RelatedCustodianID, in)
+			if in.Direction != DirectionIn {
+				t.Status = TransferMismatched
+				t.Reason = "both legs are outgoing"
+				continue
+			}
+			paired[in] = true
+			switch {
+			case in.RelatedCustodianID != c.ID || in.RelatedCustodianTransactionID != tx.ID:
+				t.Status = TransferMismatched
+				t.Reason = fmt.Sprintf("the incoming leg points to transaction %d of custodian %d",
+					in.RelatedCustodianTransactionID, in.RelatedCustodianID)
+			case in.Asset == tx.Asset && !in.Amount.Equal(tx.Amount):
+				t.Status = TransferMismatched
+				t.Reason = fmt.Sprintf("%s %s sent but %s received", tx.Amount, tx.Asset, in.Amount)
+			}
+		}
+	}
+
+	// Then the IN legs without an OUT leg
+	for _, c := range custodians {
+		for _, tx := range c.FilterTransactionsByType(ForeignTransfer) {
+			if tx.Direction != DirectionIn || paired[tx] {
+				continue
+			}
+			t := &Transfer{Timestamp: tx.Timestamp, Destination: newTransferLeg(c.ID, tx), Status: TransferOrphaned}
+			transfers = append(transfers, t)
+
+			related, known := txsByCustodian[tx.RelatedCustodianID]
+			out, found := related[tx.RelatedCustodianTransactionID]
+			switch {
+			case !known:
+				t.Status = TransferUnlinked
+				t.Reason = fmt.Sprintf("custodian %d is not linked", tx.RelatedCustodianID)
+			case !found:
+				t.Reason = fmt.Sprintf("transaction %d of custodian %d not found", tx.RelatedCustodianTransactionID, tx.RelatedCustodianID)
+			case out.Direction != DirectionOut:
+				t.Status = TransferMismatched
+				t.Reason = "both legs are incoming"
+			default:
+				// the OUT leg is reported with the IN leg it points to
+				t.Status = TransferMismatched
+				t.Reason = fmt.Sprintf("transaction %d of custodian %d points to another transaction", out.ID, tx.RelatedCustodianID)
+			}
+		}
+	}
+
+	sort.SliceStable(transfers, func(i, j int) bool {
+		return transfers[i].Timestamp.Before(transfers[j].Timestamp)
+	})
+	return transfers
+}
@@ -0,0 +1,89 @@
+package model
+
+import (
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+func TestMatchTransfers(t *testing.T) {
+	at := func(hour int) time.Time {
+		return time.Date(2021, 5, 20, hour, 0, 0, 0, time.UTC)
+	}
+	leg := func(id int32, hour int, dir, asset, amount string, relCust, relTx int32) *Transaction {
+		return &Transaction{
+			ID:                            id,
+			Asset:                         asset,
+			Amount:                        decimal.RequireFromString(amount),
+			Direction:                     dir,
+			Timestamp:                     at(hour),
+			RelatedCustodianID:            relCust,
+			RelatedCustodianTransactionID: relTx,
+		}
+	}
+
+	wallet := &Custodian{ID: 1, Transactions: []*Transaction{
+		leg(1, 1, DirectionOut, "BTC", "1", 2, 1),     // matched
+		leg(2, 2, DirectionOut, "BTC", "0.5", 2, 2),   // received 0.4
+		leg(3, 3, DirectionOut, "BTC", "0.1", 2, 99),  // orphaned
+		leg(4, 4, DirectionIn, "BTC", "2", 9, 1),      // from an unlinked custodian
+		leg(5, 5, DirectionIn, "BTC", "0.2", 0, 0),    // deposit, not a transfer
+		leg(6, 6, DirectionOut, "BTC", "0.3", 2, 3),   // the IN leg points elsewhere
+		leg(7, 7, DirectionOut, "BTC", "0.7", 2, 5),   // to a GBP leg
+		leg(8, 8, DirectionOut, "BTC", "0.1", 1, 9),   // exchange, not a transfer
+		leg(9, 8, DirectionIn, "GBP", "4000", 1, 8),   // exchange, not a transfer
+		leg(10, 9, DirectionOut, "BTC", "0.1", 2, 99), // orphaned too
+	}}
+	exchange := &Custodian{ID: 2, Transactions: []*Transaction{
+		leg(1, 1, DirectionIn, "BTC", "1", 1, 1),
+		leg(2, 2, DirectionIn, "BTC", "0.4", 1, 2),
+		leg(3, 6, DirectionIn, "BTC", "0.3", 1, 10),
+		leg(4, 0, DirectionIn, "BTC", "0.3", 1, 50), // orphaned
+		leg(5, 7, DirectionIn, "GBP", "28000", 1, 7),
+	}}
+
+	transfers := MatchTransfers([]*Custodian{wallet, exchange})
+	expected := []struct {
+		status      TransferStatus
+		source      int32
+		destination int32
+	}{
+		{TransferOrphaned, 0, 4},
+		{TransferMatched, 1, 1},
+		{TransferMismatched, 2, 2},
+		{TransferOrphaned, 3, 0},
+		{TransferUnlinked, 0, 4},
+		{TransferMismatched, 6, 3},
+		{TransferMatched, 7, 5},
+		{TransferOrphaned, 10, 0},
+	}
+	if len(transfers) != len(expected) {
+		t.Fatalf("expected %d transfers, got %d", len(expected), len(transfers))
+	}
+	for i, e := range expected {
+		tr := transfers[i]
+		var source, destination int32
+		if tr.Source != nil {
+			source = tr.Source.TransactionID
+		}
+		if tr.Destination != nil {
+			destination = tr.Destination.TransactionID
+		}
+		if tr.Status != e.status || source != e.source || destination != e.destination {
+			t.Errorf("transfer %d: expected %s %d->%d, got %s %d->%d (%s)", i, e.status, e.source, e.destination,
+				tr.Status, source, destination, tr.Reason)
+		}
+		if (tr.Status == TransferMatched) != (tr.Reason == "") {
+			t.Errorf("transfer %d: unexpected reason %q", i, tr.Reason)
+		}
+	}
+
+	if tr := transfers[2]; tr.Reason != "0.5 BTC sent but 0.4 received" {
+		t.Errorf("unexpected reason %q", tr.Reason)
+	}
+	if tr := transfers[6]; tr.Source.Asset != "BTC" || tr.Destination.Asset != "GBP" ||
+		tr.Destination.CustodianID != 2 || !tr.Destination.Amount.Equal(decimal.NewFromInt(28000)) {
+		t.Errorf("unexpected transfer %+v -> %+v", tr.Source, tr.Destination)
+	}
+}
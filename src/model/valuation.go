@@ -0,0 +1,52 @@
+package model
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+// RateFunc returns the amount of the `to` currency worth one unit of the `from` currency
+type RateFunc func(from, to string) (decimal.Decimal, error)
+
+// AssetValue is an asset with its value in the quote currency, or the error which prevented valuing it
+type AssetValue struct {
+	Code    string           `json:"code"`
+	Balance decimal.Decimal  `json:"balance"`
+	Value   *decimal.Decimal `json:"value,omitempty"`
+	Error   string           `json:"error,omitempty"`
+}
+
+// Valuation is the value of holdings in a quote currency
+type Valuation struct {
+	Quote    string        `json:"quote"`
+	Holdings []*AssetValue `json:"holdings"`
+	// Total is the sum of the values, it leaves out the assets which have no rate
+	Total decimal.Decimal `json:"total"`
+	// Complete is false when some assets have no rate
+	Complete bool `json:"complete"`
+	// RatesAsOf is when the rates were published, if known
+	RatesAsOf *time.Time `json:"rates_as_of,omitempty"`
+}
+
+// ValueHoldings converts each asset to the quote currency, rounded to 8 decimals.
+// An asset without a rate gets an error instead of a value, and the others are still valued.
+func ValueHoldings(holdings []*Asset, quote string, rate RateFunc) *Valuation {
+	v := &Valuation{Quote: quote, Holdings: make([]*AssetValue, 0, len(holdings)), Complete: true}
+	for _, asset := range holdings {
+		av := &AssetValue{Code: asset.Code, Balance: asset.Balance}
+		v.Holdings = append(v.Holdings, av)
+
+		r, err := rate(asset.Code, quote)
+		if err != nil {
+			av.Error = fmt.Sprintf("no %s rate for %s: %v", quote, asset.Code, err)
+			v.Complete = false
+			continue
+		}
+		value := asset.Balance.Mul(r).RoundBank(8)
+		av.Value = &value
+		v.Total = v.Total.Add(value)
+	}
+	return v
+}
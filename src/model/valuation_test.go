@@ -0,0 +1,46 @@
+package model
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/shopspring/decimal"
+)
+
+func TestValueHoldings(t *testing.T) {
+	rates := map[string]decimal.Decimal{
+		"BTC": decimal.NewFromInt(40000),
+		"ETH": decimal.NewFromInt(2500),
+		"GBP": decimal.NewFromInt(1),
+	}
+	rate := func(from, to string) (decimal.Decimal, error) {
+		r, ok := rates[from]
+		if !ok || to != "GBP" {
+			return decimal.Zero, errors.New("invalid currency pair")
+		}
+		return r, nil
+	}
+
+	v := ValueHoldings([]*Asset{
+		{Code: "BTC", Balance: decimal.RequireFromString("0.5")},
+		{Code: "DOGE", Balance: decimal.NewFromInt(1000)},
+		{Code: "ETH", Balance: decimal.RequireFromString("2")},
+		{Code: "GBP", Balance: decimal.RequireFromString("100.25")},
+	}, "GBP", rate)
+
+	if v.Quote != "GBP" || v.Complete {
+		t.Errorf("expected an incomplete GBP valuation, got %+v", v)
+	}
+	if !v.Total.Equal(decimal.RequireFromString("25100.25")) {
+		t.Errorf("unexpected total %v", v.Total)
+	}
+	if len(v.Holdings) != 4 {
+		t.Fatalf("expected 4 holdings, got %d", len(v.Holdings))
+	}
+	if doge := v.Holdings[1]; doge.Value != nil || doge.Error == "" {
+		t.Errorf("expected an error for DOGE, got %+v", doge)
+	}
+	if btc := v.Holdings[0]; btc.Value == nil || !btc.Value.Equal(decimal.NewFromInt(20000)) || btc.Error != "" {
+		t.Errorf("unexpected BTC value %+v", btc)
+	}
+}
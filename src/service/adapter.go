@@ -0,0 +1,192 @@
+package service
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/bottlepay/portfolio-data/model"
+)
+
+// DefaultAdapter is the adapter of the custodians which don't specify one: the mock data service
+const DefaultAdapter = "mock"
+
+// HTTPDoer runs HTTP requests, like http.Client or RetryingClient
+type HTTPDoer interface {
+	Do(*http.Request) (*http.Response, error)
+}
+
+// Account is a custodian linked by a user, with the adapter and credentials used to reach it
+type Account struct {
+	ID          int32
+	Adapter     string
+	Credentials map[string]string
+}
+
+// AccountKey identifies an account in the cache and the circuit breakers.
+// The same custodian linked with other adapters or credentials is another account,
+// which doesn't share its data or its health.
+type AccountKey struct {
+	ID      int32
+	Adapter string
+	// Credentials is a hash of the credentials, which aren't kept in the keys
+	Credentials string
+}
+
+func (k AccountKey) String() string {
+	return fmt.Sprintf("%d:%s:%s", k.ID, k.Adapter, k.Credentials)
+}
+
+// Key returns the key of the account
+func (a *Account) Key() AccountKey {
+	key := AccountKey{ID: a.ID, Adapter: a.Adapter}
+	if key.Adapter == "" {
+		key.Adapter = DefaultAdapter
+	}
+	if len(a.Credentials) > 0 {
+		names := make([]string, 0, len(a.Credentials))
+		for name := range a.Credentials {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		h := sha256.New()
+		for _, name := range names {
+			fmt.Fprintf(h, "%q=%q\n", name, a.Credentials[name])
+		}
+		key.Credentials = hex.EncodeToString(h.Sum(nil))
+	}
+	return key
+}
+
+// UserAccounts returns the accounts of the custodians linked by the user, in the same order
+func UserAccounts(u *model.User) []*Account {
+	accounts := make([]*Account, 0, len(u.Custodians))
+	for _, id := range u.Custodians {
+		accounts = append(accounts, UserAccount(u, id))
+	}
+	return accounts
+}
+
+// UserAccount returns the account of a custodian linked by the user
+func UserAccount(u *model.User, custID int32) *Account {
+	acc := &Account{ID: custID}
+	if link := u.Link(custID); link != nil {
+		acc.Adapter = link.Adapter
+		acc.Credentials = link.Credentials
+	}
+	return acc
+}
+
+// defaultAccounts returns the accounts of custodians reached with the default adapter
+func defaultAccounts(custodianIDs []int32) []*Account {
+	accounts := make([]*Account, 0, len(custodianIDs))
+	for _, id := range custodianIDs {
+		accounts = append(accounts, &Account{ID: id})
+	}
+	return accounts
+}
+
+// Capabilities describes what a CustodianAdapter supports
+type Capabilities struct {
+	// Transactions is true when the adapter can list the transactions, not only the balances
+	Transactions bool
+	// IncrementalTransactions is true when the transactions can be listed from the cursor of a previous sync
+	IncrementalTransactions bool
+	// ConditionalRequests is true when unmodified custodians aren't downloaded again
+	ConditionalRequests bool
+}
+
+// TransactionsPage is one page of the transactions of an account
+type TransactionsPage struct {
+	Transactions []*model.Transaction
+	// More is true when other transactions follow this page
+	More bool
+	// Cursor lists the transactions after this page
+	Cursor string
+}
+
+// CustodianAdapter reaches the API of a wallet or an exchange
+type CustodianAdapter interface {
+	// Capabilities describes what the adapter supports
+	Capabilities() Capabilities
+	// FetchBalances returns the balance of each asset of the account
+	FetchBalances(context.Context, *Account) ([]*model.Asset, error)
+	// FetchTransactions returns the page of transactions after the cursor, the first one when it's empty
+	FetchTransactions(ctx context.Context, acc *Account, cursor string) (*TransactionsPage, error)
+}
+
+// CustodianFetcher is implemented by the adapters which fetch a whole custodian more efficiently
+// than its balances and its transactions pages
+type CustodianFetcher interface {
+	// FetchCustodian fetches the custodian, reusing the cached entry if it has one
+	FetchCustodian(ctx context.Context, acc *Account, cached *CacheEntry) (*CacheEntry, error)
+}
+
+// AdapterRegistry holds the custodian adapters by name
+type AdapterRegistry map[string]CustodianAdapter
+
+// Get returns the adapter with this name, or the default one for an empty name
+func (r AdapterRegistry) Get(name string) (CustodianAdapter, error) {
+	if name == "" {
+		name = DefaultAdapter
+	}
+	if a, found := r[name]; found {
+		return a, nil
+	}
+	return nil, fmt.Errorf("unknown custodian adapter %q", name)
+}
+
+// WithAdapter registers the adapter under this name, for the accounts which use it
+func WithAdapter(name string, a CustodianAdapter) CustodianSvcOption {
+	return func(c *CustodianSvc) {
+		c.adapters[name] = a
+	}
+}
+
+// fetchWithAdapter fetches the balances and the transactions of the account.
+// With a cached entry, only the transactions after its cursor are fetched if the adapter supports it.
+func fetchWithAdapter(ctx context.Context, a CustodianAdapter, acc *Account, cached *CacheEntry) (*CacheEntry, error) {
+	if f, ok := a.(CustodianFetcher); ok {
+		return f.FetchCustodian(ctx, acc, cached)
+	}
+
+	assets, err := a.FetchBalances(ctx, acc)
+	if err != nil {
+		return nil, err
+	}
+	entry := &CacheEntry{Custodian: &model.Custodian{ID: acc.ID, Assets: assets}}
+
+	caps := a.Capabilities()
+	if !caps.Transactions {
+		return entry, nil
+	}
+
+	var base *model.Custodian
+	if cached != nil && caps.IncrementalTransactions && cached.Cursor != "" {
+		base = cached.Custodian
+		entry.Cursor = cached.Cursor
+	}
+	for {
+		page, err := a.FetchTransactions(ctx, acc, entry.Cursor)
+		if err != nil {
+			return nil, err
+		}
+		entry.Custodian.Transactions = append(entry.Custodian.Transactions, page.Transactions...)
+
+		progressed := page.Cursor != entry.Cursor
+		entry.Cursor = page.Cursor
+		// an adapter which doesn't move its cursor forward would loop forever
+		if !page.More || !progressed {
+			break
+		}
+	}
+
+	if base != nil {
+		entry.Custodian = mergeTransactions(base, entry.Custodian)
+	}
+	return entry, nil
+}
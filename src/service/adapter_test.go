@@ -0,0 +1,210 @@
+package service
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bottlepay/portfolio-data/model"
+	"github.com/shopspring/decimal"
+)
+
+// fakeAdapter serves custodians from memory, pageSize transactions at a time
+type fakeAdapter struct {
+	custodians map[int32]*model.Custodian
+	pageSize   int
+	caps       Capabilities
+
+	cursors []string
+	l       sync.Mutex
+}
+
+func (a *fakeAdapter) Capabilities() Capabilities {
+	return a.caps
+}
+
+func (a *fakeAdapter) FetchBalances(ctx context.Context, acc *Account) ([]*model.Asset, error) {
+	return a.custodians[acc.ID].Assets, nil
+}
+
+func (a *fakeAdapter) FetchTransactions(ctx context.Context, acc *Account, cursor string) (*TransactionsPage, error) {
+	a.l.Lock()
+	a.cursors = append(a.cursors, cursor)
+	a.l.Unlock()
+
+	start, _ := strconv.Atoi(cursor)
+	txs := a.custodians[acc.ID].Transactions[start:]
+	page := &TransactionsPage{Transactions: txs, Cursor: cursor}
+	if len(txs) > a.pageSize {
+		page.Transactions = txs[:a.pageSize]
+		page.More = true
+	}
+	page.Cursor = strconv.Itoa(start + len(page.Transactions))
+	return page, nil
+}
+
+func newFakeCustodian(id int32, txCount int) *model.Custodian {
+	cust := &model.Custodian{ID: id, Assets: []*model.Asset{{Code: "BTC", Balance: decimal.NewFromInt(int64(txCount))}}}
+	for i := 0; i < txCount; i++ {
+		cust.AddTransaction(&model.Transaction{Asset: "BTC", Amount: decimal.NewFromInt(1), Direction: model.DirectionIn})
+	}
+	return cust
+}
+
+func TestCustodianSvc_adapters(t *testing.T) {
+	fake := &fakeAdapter{
+		custodians: map[int32]*model.Custodian{7: newFakeCustodian(7, 5)},
+		pageSize:   2,
+		caps:       Capabilities{Transactions: true},
+	}
+	svc := NewCustodianSvc("http://localhost:1/custodian/", WithAdapter("fake", fake))
+
+	user := model.NewUser(1)
+	user.Custodians = []int32{7}
+	user.Links = map[int32]*model.CustodianLink{7: {Adapter: "fake"}}
+
+	res, err := svc.FetchAccounts(context.Background(), UserAccounts(user)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res[0].Transactions) != 5 || res[0].Assets[0].Balance.IntPart() != 5 {
+		t.Errorf("expected the 5 transactions and the balance, got %+v", res[0])
+	}
+	if want := []string{"", "2", "4"}; !reflect.DeepEqual(fake.cursors, want) {
+		t.Errorf("expected cursors %v, got %v", want, fake.cursors)
+	}
+
+	user.Links[7].Adapter = "unknown"
+	if _, err := svc.FetchAccounts(context.Background(), UserAccounts(user)...); err == nil {
+		t.Error("an unknown adapter should return an error")
+	}
+}
+
+func TestCustodianSvc_adapter_incremental(t *testing.T) {
+	cust := newFakeCustodian(7, 3)
+	fake := &fakeAdapter{
+		custodians: map[int32]*model.Custodian{7: cust},
+		pageSize:   10,
+		caps:       Capabilities{Transactions: true, IncrementalTransactions: true},
+	}
+
+	now := time.Date(2021, 5, 20, 12, 0, 0, 0, time.UTC)
+	policy := CachePolicy{TTL: time.Minute, KeepExpired: time.Hour}
+	cache := NewLRUCache(10, policy.MaxAge())
+	svc := NewCustodianSvc("http://localhost:1/custodian/", WithAdapter("fake", fake), WithCache(cache, policy))
+	cache.now = func() time.Time { return now }
+	svc.cacher.now = cache.now
+
+	acc := &Account{ID: 7, Adapter: "fake"}
+	if _, err := svc.FetchAccounts(context.Background(), acc); err != nil {
+		t.Fatal(err)
+	}
+
+	cust.AddTransaction(&model.Transaction{Asset: "BTC", Amount: decimal.NewFromInt(1), Direction: model.DirectionIn})
+	now = now.Add(2 * time.Minute)
+	res, err := svc.FetchAccounts(context.Background(), acc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res[0].Transactions) != 4 {
+		t.Errorf("expected 4 transactions, got %d", len(res[0].Transactions))
+	}
+	if len(fake.cursors) != 2 || fake.cursors[1] != "3" {
+		t.Errorf("the sync should resume after the cached transactions, got cursors %v", fake.cursors)
+	}
+}
+
+// credentialsAdapter returns the balance written in the api_key credential, and fails with a bad one
+type credentialsAdapter struct {
+	calls int32
+}
+
+func (a *credentialsAdapter) Capabilities() Capabilities {
+	return Capabilities{}
+}
+
+func (a *credentialsAdapter) FetchBalances(ctx context.Context, acc *Account) ([]*model.Asset, error) {
+	atomic.AddInt32(&a.calls, 1)
+	balance, err := decimal.NewFromString(acc.Credentials["api_key"])
+	if err != nil {
+		return nil, &HTTPStatusError{http.StatusServiceUnavailable}
+	}
+	return []*model.Asset{{Code: "BTC", Balance: balance}}, nil
+}
+
+func (a *credentialsAdapter) FetchTransactions(ctx context.Context, acc *Account, cursor string) (*TransactionsPage, error) {
+	return &TransactionsPage{}, nil
+}
+
+func TestAccount_Key(t *testing.T) {
+	acc := &Account{ID: 1, Credentials: map[string]string{"api_key": "key", "api_secret": "secret"}}
+	same := &Account{ID: 1, Adapter: DefaultAdapter, Credentials: map[string]string{"api_secret": "secret", "api_key": "key"}}
+	if acc.Key() != same.Key() {
+		t.Errorf("expected the same key for the same account, got %v and %v", acc.Key(), same.Key())
+	}
+	if key := acc.Key(); strings.Contains(key.String(), "secret") {
+		t.Errorf("the key shouldn't contain the credentials, got %v", key)
+	}
+
+	for _, other := range []*Account{
+		{ID: 2, Credentials: acc.Credentials},
+		{ID: 1, Adapter: "coinbase", Credentials: acc.Credentials},
+		{ID: 1, Credentials: map[string]string{"api_key": "key", "api_secret": "other"}},
+		{ID: 1},
+	} {
+		if other.Key() == acc.Key() {
+			t.Errorf("expected another key for %+v", other)
+		}
+	}
+}
+
+func TestCustodianSvc_accounts_same_custodian(t *testing.T) {
+	fake := &credentialsAdapter{}
+	cache := NewLRUCache(10, time.Minute)
+	svc := NewCustodianSvc("http://localhost:1/custodian/",
+		WithAdapter("fake", fake),
+		WithCache(cache, CachePolicy{TTL: time.Minute}),
+		WithBreakerPolicy(BreakerPolicy{FailureThreshold: 1, CoolDown: time.Minute}),
+	)
+
+	// two users linked the same custodian with other credentials
+	first := &Account{ID: 1, Adapter: "fake", Credentials: map[string]string{"api_key": "1"}}
+	second := &Account{ID: 1, Adapter: "fake", Credentials: map[string]string{"api_key": "2"}}
+	balance := func(acc *Account) string {
+		res, err := svc.FetchAccounts(context.Background(), acc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res[0].Assets[0].Balance.String()
+	}
+
+	if b := balance(first); b != "1" {
+		t.Errorf("first account: got balance %s", b)
+	}
+	if b := balance(second); b != "2" {
+		t.Errorf("the second account shouldn't get the cached data of the first one, got balance %s", b)
+	}
+	if b := balance(first); b != "1" || atomic.LoadInt32(&fake.calls) != 2 {
+		t.Errorf("each account should be cached, got balance %s after %d calls", b, fake.calls)
+	}
+
+	// bad credentials open the circuit of their account only
+	bad := &Account{ID: 1, Adapter: "fake", Credentials: map[string]string{"api_key": "bad"}}
+	svc.FetchAllAccounts(context.Background(), bad)
+	if status := svc.FetchAllAccounts(context.Background(), bad)[0].Status(); status.Status != StatusCircuitOpen {
+		t.Errorf("expected %s status, got %s", StatusCircuitOpen, status.Status)
+	}
+	svc.Invalidate(context.Background(), 1)
+	if b := balance(second); b != "2" || atomic.LoadInt32(&fake.calls) != 4 {
+		t.Errorf("the second account should be fetched again despite the open circuit, got balance %s after %d calls", b, fake.calls)
+	}
+	if states := svc.BreakerStates(); len(states) != 3 {
+		t.Errorf("expected a breaker per account, got %+v", states)
+	}
+}
@@ -0,0 +1,282 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bottlepay/portfolio-data/model"
+	"github.com/shopspring/decimal"
+)
+
+// BinanceAdapter reaches custodians with a Binance-style API: the balances of /api/v3/account,
+// the trades of /api/v3/myTrades, and the deposit and withdrawal histories.
+// It needs the "api_key" and "api_secret" credentials to sign its requests, and the "symbols"
+// whose trades are listed, comma separated like "BTCGBP,ETHBTC", because trades are listed per symbol.
+type BinanceAdapter struct {
+	url      string
+	http     HTTPDoer
+	now      func() time.Time
+	pageSize int
+}
+
+// NewBinanceAdapter creates a BinanceAdapter for the API at the base URL, like https://api.binance.com
+func NewBinanceAdapter(u string, doer HTTPDoer) *BinanceAdapter {
+	return &BinanceAdapter{url: u, http: doer, now: time.Now, pageSize: 1000}
+}
+
+// Binance statuses of the completed deposits and withdrawals
+const (
+	binanceDepositSuccess     = 1
+	binanceWithdrawalComplete = 6
+)
+
+type binanceBalance struct {
+	Asset  string          `json:"asset"`
+	Free   decimal.Decimal `json:"free"`
+	Locked decimal.Decimal `json:"locked"`
+}
+
+type binanceSymbol struct {
+	Symbol     string `json:"symbol"`
+	BaseAsset  string `json:"baseAsset"`
+	QuoteAsset string `json:"quoteAsset"`
+}
+
+type binanceTrade struct {
+	ID       int64           `json:"id"`
+	Symbol   string          `json:"symbol"`
+	Qty      decimal.Decimal `json:"qty"`
+	QuoteQty decimal.Decimal `json:"quoteQty"`
+	Time     int64           `json:"time"`
+	IsBuyer  bool            `json:"isBuyer"`
+}
+
+type binanceDeposit struct {
+	Coin       string          `json:"coin"`
+	Amount     decimal.Decimal `json:"amount"`
+	Status     int             `json:"status"`
+	InsertTime int64           `json:"insertTime"`
+}
+
+type binanceWithdrawal struct {
+	Coin      string          `json:"coin"`
+	Amount    decimal.Decimal `json:"amount"`
+	Status    int             `json:"status"`
+	ApplyTime string          `json:"applyTime"`
+}
+
+func (a *BinanceAdapter) Capabilities() Capabilities {
+	// transaction IDs are given by ordering the whole history, it can't be synced incrementally
+	return Capabilities{Transactions: true}
+}
+
+func (a *BinanceAdapter) FetchBalances(ctx context.Context, acc *Account) ([]*model.Asset, error) {
+	account := &struct {
+		Balances []*binanceBalance `json:"balances"`
+	}{}
+	if err := a.get(ctx, acc, "/api/v3/account", url.Values{}, true, account); err != nil {
+		return nil, err
+	}
+
+	// Binance lists every asset it supports, most of them empty
+	al := model.NewAssetList()
+	for _, b := range account.Balances {
+		if total := b.Free.Add(b.Locked); !total.IsZero() {
+			al.AddAssetValue(&model.Asset{Code: b.Asset, Balance: total})
+		}
+	}
+	return al.GetAssets(), nil
+}
+
+// FetchTransactions returns all the trades, deposits and withdrawals in a single page,
+// they come from different lists which need to be ordered together
+func (a *BinanceAdapter) FetchTransactions(ctx context.Context, acc *Account, cursor string) (*TransactionsPage, error) {
+	var legs []*leg
+
+	trades, err := a.trades(ctx, acc)
+	if err != nil {
+		return nil, err
+	}
+	legs = append(legs, trades...)
+
+	var deposits []*binanceDeposit
+	err = a.listOffset(ctx, acc, "/sapi/v1/capital/deposit/hisrec", func(data json.RawMessage) (int, error) {
+		var page []*binanceDeposit
+		err := json.Unmarshal(data, &page)
+		deposits = append(deposits, page...)
+		return len(page), err
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range deposits {
+		if d.Status == binanceDepositSuccess {
+			legs = append(legs, &leg{
+				time:      time.Unix(0, d.InsertTime*int64(time.Millisecond)),
+				asset:     d.Coin,
+				amount:    d.Amount,
+				direction: model.DirectionIn,
+			})
+		}
+	}
+
+	var withdrawals []*binanceWithdrawal
+	err = a.listOffset(ctx, acc, "/sapi/v1/capital/withdraw/history", func(data json.RawMessage) (int, error) {
+		var page []*binanceWithdrawal
+		err := json.Unmarshal(data, &page)
+		withdrawals = append(withdrawals, page...)
+		return len(page), err
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, w := range withdrawals {
+		if w.Status != binanceWithdrawalComplete {
+			continue
+		}
+		applied, err := time.Parse("2006-01-02 15:04:05", w.ApplyTime)
+		if err != nil {
+			return nil, &DecodeError{err}
+		}
+		legs = append(legs, &leg{
+			time:      applied,
+			asset:     w.Coin,
+			amount:    w.Amount,
+			direction: model.DirectionOut,
+		})
+	}
+
+	return &TransactionsPage{Transactions: buildTransactions(acc.ID, legs)}, nil
+}
+
+// trades returns the two legs of each trade of the configured symbols
+func (a *BinanceAdapter) trades(ctx context.Context, acc *Account) ([]*leg, error) {
+	symbols := binanceSymbols(acc)
+	if len(symbols) == 0 {
+		return nil, nil
+	}
+
+	info := &struct {
+		Symbols []*binanceSymbol `json:"symbols"`
+	}{}
+	query := url.Values{}
+	query.Set("symbols", `["`+strings.Join(symbols, `","`)+`"]`)
+	if err := a.get(ctx, acc, "/api/v3/exchangeInfo", query, false, info); err != nil {
+		return nil, err
+	}
+
+	var legs []*leg
+	for _, symbol := range info.Symbols {
+		fromID := int64(0)
+		for {
+			query := url.Values{}
+			query.Set("symbol", symbol.Symbol)
+			query.Set("fromId", strconv.FormatInt(fromID, 10))
+			query.Set("limit", strconv.Itoa(a.pageSize))
+
+			var page []*binanceTrade
+			if err := a.get(ctx, acc, "/api/v3/myTrades", query, true, &page); err != nil {
+				return nil, err
+			}
+			for _, t := range page {
+				legs = append(legs, binanceLegs(symbol, t)...)
+				fromID = t.ID + 1
+			}
+			if len(page) < a.pageSize {
+				break
+			}
+		}
+	}
+	return legs, nil
+}
+
+// binanceLegs splits a trade: a buyer gets the base asset for the quote asset, a seller the opposite
+func binanceLegs(symbol *binanceSymbol, t *binanceTrade) []*leg {
+	at := time.Unix(0, t.Time*int64(time.Millisecond))
+	pair := fmt.Sprintf("%s:%d", t.Symbol, t.ID)
+	base := &leg{time: at, asset: symbol.BaseAsset, amount: t.Qty, direction: model.DirectionIn, pair: pair}
+	quote := &leg{time: at, asset: symbol.QuoteAsset, amount: t.QuoteQty, direction: model.DirectionOut, pair: pair}
+	if !t.IsBuyer {
+		base.direction, quote.direction = model.DirectionOut, model.DirectionIn
+	}
+	// the asset given away comes first
+	if base.direction == model.DirectionOut {
+		return []*leg{base, quote}
+	}
+	return []*leg{quote, base}
+}
+
+// binanceSymbols returns the symbols listed in the "symbols" credential
+func binanceSymbols(acc *Account) []string {
+	var symbols []string
+	for _, s := range strings.Split(acc.Credentials["symbols"], ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			symbols = append(symbols, strings.ToUpper(s))
+		}
+	}
+	return symbols
+}
+
+// listOffset gets every page of a history, each returns the number of items of a page
+func (a *BinanceAdapter) listOffset(ctx context.Context, acc *Account, path string, each func(json.RawMessage) (int, error)) error {
+	for offset := 0; ; offset += a.pageSize {
+		query := url.Values{}
+		query.Set("offset", strconv.Itoa(offset))
+		query.Set("limit", strconv.Itoa(a.pageSize))
+
+		var data json.RawMessage
+		if err := a.get(ctx, acc, path, query, true, &data); err != nil {
+			return err
+		}
+		n, err := each(data)
+		if err != nil {
+			return &DecodeError{err}
+		}
+		if n < a.pageSize {
+			return nil
+		}
+	}
+}
+
+// get runs a GET request on the path, signed if needed, and decodes the response in out
+func (a *BinanceAdapter) get(ctx context.Context, acc *Account, path string, query url.Values, signed bool, out interface{}) error {
+	rawQuery := query.Encode()
+	if signed {
+		query.Set("timestamp", strconv.FormatInt(a.now().UnixNano()/int64(time.Millisecond), 10))
+		rawQuery = query.Encode()
+		rawQuery += "&signature=" + signHMAC(acc.Credentials["api_secret"], rawQuery)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", a.url+path+"?"+rawQuery, nil)
+	if err != nil {
+		return fmt.Errorf("Binance GET request Error: %v", err)
+	}
+	if signed {
+		req.Header.Set("X-MBX-APIKEY", acc.Credentials["api_key"])
+	}
+
+	res, err := a.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("Binance GET Error: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != 200 {
+		return &HTTPStatusError{res.StatusCode}
+	}
+	if err := json.NewDecoder(res.Body).Decode(out); err != nil {
+		return &DecodeError{err}
+	}
+	return nil
+}
+
+func init() {
+	// Check interface implementation
+	var _ CustodianAdapter = (*BinanceAdapter)(nil)
+}
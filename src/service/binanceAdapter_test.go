@@ -0,0 +1,99 @@
+package service
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newBinanceFixtureServer(t *testing.T) *httptest.Server {
+	files := map[string]string{
+		"/api/v3/account": "account.json",
+		`/api/v3/exchangeInfo?symbols=["BTCGBP","ETHBTC"]`:   "exchangeInfo.json",
+		"/api/v3/myTrades?fromId=0&limit=2&symbol=BTCGBP":    "trades_btcgbp_1.json",
+		"/api/v3/myTrades?fromId=3&limit=2&symbol=BTCGBP":    "trades_btcgbp_2.json",
+		"/api/v3/myTrades?fromId=0&limit=2&symbol=ETHBTC":    "empty.json",
+		"/sapi/v1/capital/deposit/hisrec?limit=2&offset=0":   "deposits.json",
+		"/sapi/v1/capital/deposit/hisrec?limit=2&offset=2":   "empty.json",
+		"/sapi/v1/capital/withdraw/history?limit=2&offset=0": "withdrawals.json",
+		"/sapi/v1/capital/withdraw/history?limit=2&offset=2": "empty.json",
+	}
+	return newFixtureServer(t, "binance", files, func(r *http.Request) (string, bool) {
+		query := r.URL.Query()
+		signed := query.Get("signature") != ""
+		if signed {
+			// the signature covers the whole query string before it
+			i := strings.Index(r.URL.RawQuery, "&signature=")
+			if r.Header.Get("X-MBX-APIKEY") != "key" || query.Get("signature") != signHMAC("secret", r.URL.RawQuery[:i]) {
+				return "", false
+			}
+		}
+		query.Del("signature")
+		query.Del("timestamp")
+
+		key := r.URL.Path
+		if len(query) > 0 {
+			key += "?" + query.Encode()
+		}
+		key, _ = url.QueryUnescape(key)
+		return key, true
+	})
+}
+
+func TestBinanceAdapter(t *testing.T) {
+	ts := newBinanceFixtureServer(t)
+	defer ts.Close()
+
+	a := NewBinanceAdapter(ts.URL, http.DefaultClient)
+	a.pageSize = 2
+	a.now = func() time.Time { return time.Unix(1620295200, 0) }
+	acc := &Account{ID: 4, Adapter: "binance", Credentials: map[string]string{
+		"api_key": "key", "api_secret": "secret", "symbols": "btcgbp, ETHBTC",
+	}}
+
+	// the empty ETH balance is left out
+	assets, err := a.FetchBalances(context.Background(), acc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(assets) != 2 || assets[0].Code != "BTC" || assets[0].Balance.String() != "2" ||
+		assets[1].Code != "GBP" || assets[1].Balance.String() != "100" {
+		t.Errorf("unexpected balances %+v %+v", assets[0], assets[1])
+	}
+
+	// the pending deposit and the cancelled withdrawal are left out, each trade has two legs
+	page, err := a.FetchTransactions(context.Background(), acc, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if page.More {
+		t.Error("expected a single page")
+	}
+	checkTransactions(t, page.Transactions, []string{
+		"BTC 1 IN 0",
+		"GBP 4000 OUT 3",
+		"BTC 0.1 IN 2",
+		"BTC 0.05 OUT 5",
+		"GBP 2100 IN 4",
+		"GBP 420.5 OUT 7",
+		"BTC 0.01 IN 6",
+		"BTC 0.2 OUT 0",
+	})
+}
+
+func TestBinanceAdapter_unauthorized(t *testing.T) {
+	ts := newBinanceFixtureServer(t)
+	defer ts.Close()
+
+	a := NewBinanceAdapter(ts.URL, http.DefaultClient)
+	acc := &Account{ID: 4, Adapter: "binance", Credentials: map[string]string{"api_key": "key", "api_secret": "wrong"}}
+
+	_, err := a.FetchBalances(context.Background(), acc)
+	if se, ok := err.(*HTTPStatusError); !ok || se.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected a 401 error, got %v", err)
+	}
+}
@@ -0,0 +1,285 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/bottlepay/portfolio-data/bitcoin"
+	"github.com/bottlepay/portfolio-data/model"
+	"github.com/shopspring/decimal"
+)
+
+// BitcoinAdapter tracks a watch-only Bitcoin wallet with an Esplora-compatible block explorer API.
+// The wallet is either the "xpub" credential, an account extended public key (xpub, ypub or zpub)
+// whose receive and change addresses are derived, or the "addresses" credential, comma separated.
+type BitcoinAdapter struct {
+	url      string
+	http     HTTPDoer
+	gapLimit int
+}
+
+// NewBitcoinAdapter creates a BitcoinAdapter for the Esplora API at the base URL, like https://blockstream.info/api
+func NewBitcoinAdapter(u string, doer HTTPDoer) *BitcoinAdapter {
+	return &BitcoinAdapter{url: strings.TrimSuffix(u, "/"), http: doer, gapLimit: DefaultGapLimit}
+}
+
+// DefaultGapLimit is the number of consecutive unused addresses after which a wallet stops being scanned (BIP 44)
+const DefaultGapLimit = 20
+
+// esploraPageSize is the number of confirmed transactions of each page of an address history
+const esploraPageSize = 25
+
+type esploraStats struct {
+	FundedTxoSum int64 `json:"funded_txo_sum"`
+	SpentTxoSum  int64 `json:"spent_txo_sum"`
+	TxCount      int   `json:"tx_count"`
+}
+
+type esploraAddress struct {
+	ChainStats   esploraStats `json:"chain_stats"`
+	MempoolStats esploraStats `json:"mempool_stats"`
+}
+
+type esploraOutput struct {
+	Address string `json:"scriptpubkey_address"`
+	Value   int64  `json:"value"`
+}
+
+type esploraTx struct {
+	TxID string `json:"txid"`
+	Vin  []struct {
+		// the output spent by the input, missing for coinbase inputs
+		Prevout *esploraOutput `json:"prevout"`
+	} `json:"vin"`
+	Vout   []*esploraOutput `json:"vout"`
+	Status struct {
+		Confirmed   bool  `json:"confirmed"`
+		BlockHeight int64 `json:"block_height"`
+		BlockTime   int64 `json:"block_time"`
+	} `json:"status"`
+}
+
+// bitcoinWallet is the result of a wallet scan
+type bitcoinWallet struct {
+	addresses map[string]bool
+	// confirmed balance in satoshis
+	balance int64
+	txs     map[string]*esploraTx
+}
+
+func (a *BitcoinAdapter) Capabilities() Capabilities {
+	// transaction IDs are given by ordering the whole history, it can't be synced incrementally
+	return Capabilities{Transactions: true}
+}
+
+func (a *BitcoinAdapter) FetchBalances(ctx context.Context, acc *Account) ([]*model.Asset, error) {
+	w, err := a.scan(ctx, acc)
+	if err != nil {
+		return nil, err
+	}
+	return w.assets(), nil
+}
+
+// FetchTransactions returns all the confirmed transactions of the wallet in a single page
+func (a *BitcoinAdapter) FetchTransactions(ctx context.Context, acc *Account, cursor string) (*TransactionsPage, error) {
+	w, err := a.scan(ctx, acc)
+	if err != nil {
+		return nil, err
+	}
+	return &TransactionsPage{Transactions: w.transactions(acc.ID)}, nil
+}
+
+// FetchCustodian scans the wallet once, for both the balance and the transactions
+func (a *BitcoinAdapter) FetchCustodian(ctx context.Context, acc *Account, cached *CacheEntry) (*CacheEntry, error) {
+	w, err := a.scan(ctx, acc)
+	if err != nil {
+		return nil, err
+	}
+	return &CacheEntry{Custodian: &model.Custodian{
+		ID:           acc.ID,
+		Assets:       w.assets(),
+		Transactions: w.transactions(acc.ID),
+	}}, nil
+}
+
+// scan gets the balance and the transactions of every address of the wallet
+func (a *BitcoinAdapter) scan(ctx context.Context, acc *Account) (*bitcoinWallet, error) {
+	w := &bitcoinWallet{addresses: make(map[string]bool), txs: make(map[string]*esploraTx)}
+
+	if xpub := acc.Credentials["xpub"]; xpub != "" {
+		key, err := bitcoin.ParseExtendedKey(xpub)
+		if err != nil {
+			return nil, fmt.Errorf("invalid xpub: %w", err)
+		}
+		// the receive chain, then the change chain
+		for _, chain := range []uint32{0, 1} {
+			if err := a.scanChain(ctx, w, key, chain); err != nil {
+				return nil, err
+			}
+		}
+		return w, nil
+	}
+
+	addresses := strings.Split(acc.Credentials["addresses"], ",")
+	for _, address := range addresses {
+		if address = strings.TrimSpace(address); address != "" {
+			if _, err := a.scanAddress(ctx, w, address); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if len(w.addresses) == 0 {
+		return nil, fmt.Errorf("the bitcoin adapter needs an xpub or addresses credential")
+	}
+	return w, nil
+}
+
+// scanChain scans the addresses of a chain until gapLimit consecutive addresses were never used
+func (a *BitcoinAdapter) scanChain(ctx context.Context, w *bitcoinWallet, key *bitcoin.ExtendedKey, chain uint32) error {
+	chainKey, err := key.Child(chain)
+	if err != nil {
+		return err
+	}
+
+	gap := 0
+	for index := uint32(0); gap < a.gapLimit && index < bitcoin.HardenedIndex; index++ {
+		child, err := chainKey.Child(index)
+		if err == bitcoin.ErrUnusableChild {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		used, err := a.scanAddress(ctx, w, child.Address())
+		if err != nil {
+			return err
+		}
+		if used {
+			gap = 0
+		} else {
+			gap++
+		}
+	}
+	return nil
+}
+
+// scanAddress adds the balance and the confirmed transactions of the address to the wallet,
+// and tells if the address was ever used. An address scanned already isn't counted twice.
+func (a *BitcoinAdapter) scanAddress(ctx context.Context, w *bitcoinWallet, address string) (bool, error) {
+	if w.addresses[address] {
+		return false, nil
+	}
+	stats := &esploraAddress{}
+	if err := a.get(ctx, "/address/"+url.PathEscape(address), stats); err != nil {
+		return false, err
+	}
+	w.addresses[address] = true
+	w.balance += stats.ChainStats.FundedTxoSum - stats.ChainStats.SpentTxoSum
+
+	// the history is paged by the ID of the last transaction seen, from the most recent one
+	for remaining, last := stats.ChainStats.TxCount, ""; remaining > 0; {
+		path := "/address/" + url.PathEscape(address) + "/txs/chain"
+		if last != "" {
+			path += "/" + last
+		}
+		var page []*esploraTx
+		if err := a.get(ctx, path, &page); err != nil {
+			return false, err
+		}
+		for _, tx := range page {
+			if tx.Status.Confirmed {
+				w.txs[tx.TxID] = tx
+			}
+			last = tx.TxID
+		}
+		remaining -= len(page)
+		if len(page) < esploraPageSize {
+			break
+		}
+	}
+	return stats.ChainStats.TxCount+stats.MempoolStats.TxCount > 0, nil
+}
+
+func (w *bitcoinWallet) assets() []*model.Asset {
+	return []*model.Asset{{Code: "BTC", Balance: satoshis(w.balance)}}
+}
+
+// transactions returns a transaction for each Bitcoin transaction changing the wallet balance:
+// the outputs paying the wallet minus the wallet outputs it spends. So the fees are part of the OUT amounts,
+// and the change outputs aren't counted.
+func (w *bitcoinWallet) transactions(custID int32) []*model.Transaction {
+	txs := make([]*esploraTx, 0, len(w.txs))
+	for _, tx := range w.txs {
+		txs = append(txs, tx)
+	}
+	sort.Slice(txs, func(i, j int) bool {
+		if txs[i].Status.BlockHeight != txs[j].Status.BlockHeight {
+			return txs[i].Status.BlockHeight < txs[j].Status.BlockHeight
+		}
+		return txs[i].TxID < txs[j].TxID
+	})
+
+	var legs []*leg
+	for _, tx := range txs {
+		var net int64
+		for _, out := range tx.Vout {
+			if w.addresses[out.Address] {
+				net += out.Value
+			}
+		}
+		for _, in := range tx.Vin {
+			if in.Prevout != nil && w.addresses[in.Prevout.Address] {
+				net -= in.Prevout.Value
+			}
+		}
+		if net == 0 {
+			continue
+		}
+
+		l := &leg{time: time.Unix(tx.Status.BlockTime, 0), asset: "BTC", amount: satoshis(net), direction: model.DirectionIn}
+		if net < 0 {
+			l.amount, l.direction = satoshis(-net), model.DirectionOut
+		}
+		legs = append(legs, l)
+	}
+	return buildTransactions(custID, legs)
+}
+
+func satoshis(sats int64) decimal.Decimal {
+	return decimal.New(sats, -8)
+}
+
+// get runs a GET request on the path, and decodes the response in out
+func (a *BitcoinAdapter) get(ctx context.Context, path string, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", a.url+path, nil)
+	if err != nil {
+		return fmt.Errorf("Esplora GET request Error: %v", err)
+	}
+
+	res, err := a.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("Esplora GET Error: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != 200 {
+		return &HTTPStatusError{res.StatusCode}
+	}
+	if err := json.NewDecoder(res.Body).Decode(out); err != nil {
+		return &DecodeError{err}
+	}
+	return nil
+}
+
+func init() {
+	// Check interface implementation
+	var _ CustodianAdapter = (*BitcoinAdapter)(nil)
+	var _ CustodianFetcher = (*BitcoinAdapter)(nil)
+}
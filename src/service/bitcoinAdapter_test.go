@@ -0,0 +1,208 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// the first addresses of the account zpub of the "abandon abandon ... about" mnemonic (BIP 84)
+const (
+	testZpub     = "zpub6rFR7y4Q2AijBEqTUquhVz398htDFrtymD9xYYfG1m4wAcvPhXNfE3EfH1r1ADqtfSdVCToUG868RvUUkgDKf31mGDtKsAYz2oz2AGutZYs"
+	testReceive0 = "bc1qcr8te4kr609gcawutmrza0j4xv80jy8z306fyu"
+	testReceive1 = "bc1qnjg0jd8228aq7egyzacy8cys3knf9xvrerkf9g"
+	testChange0  = "bc1q8c6fshw2dlwun7ekn9qwf37cu2rn755upcp6el"
+	testExternal = "1BgGZ9tcN4rm9KBzDn7KprQz87SZ26SAMH"
+)
+
+// fakeEsplora is an in-memory stand-in of the Esplora address API, its transactions are all confirmed
+type fakeEsplora struct {
+	txs []*esploraTx
+
+	l         sync.Mutex
+	addresses []string
+}
+
+func (e *fakeEsplora) addTx(id string, height int64, in []*esploraOutput, out []*esploraOutput) {
+	tx := &esploraTx{TxID: id, Vout: out}
+	for _, prevout := range in {
+		tx.Vin = append(tx.Vin, struct {
+			Prevout *esploraOutput `json:"prevout"`
+		}{prevout})
+	}
+	tx.Status.Confirmed = true
+	tx.Status.BlockHeight = height
+	tx.Status.BlockTime = 1620000000 + height*600
+	e.txs = append(e.txs, tx)
+}
+
+// history returns the transactions of the address, the most recent first
+func (e *fakeEsplora) history(address string) []*esploraTx {
+	var txs []*esploraTx
+	for i := len(e.txs) - 1; i >= 0; i-- {
+		tx := e.txs[i]
+		found := false
+		for _, out := range tx.Vout {
+			found = found || out.Address == address
+		}
+		for _, in := range tx.Vin {
+			found = found || in.Prevout.Address == address
+		}
+		if found {
+			txs = append(txs, tx)
+		}
+	}
+	return txs
+}
+
+func (e *fakeEsplora) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/address/"), "/")
+	address := parts[0]
+	history := e.history(address)
+
+	if len(parts) == 1 {
+		e.l.Lock()
+		e.addresses = append(e.addresses, address)
+		e.l.Unlock()
+
+		stats := &esploraAddress{}
+		stats.ChainStats.TxCount = len(history)
+		for _, tx := range history {
+			for _, out := range tx.Vout {
+				if out.Address == address {
+					stats.ChainStats.FundedTxoSum += out.Value
+				}
+			}
+			for _, in := range tx.Vin {
+				if in.Prevout.Address == address {
+					stats.ChainStats.SpentTxoSum += in.Prevout.Value
+				}
+			}
+		}
+		json.NewEncoder(w).Encode(stats)
+		return
+	}
+
+	// /address/{address}/txs/chain[/{last_seen_txid}]
+	if len(parts) == 4 {
+		for i, tx := range history {
+			if tx.TxID == parts[3] {
+				history = history[i+1:]
+				break
+			}
+		}
+	}
+	if len(history) > esploraPageSize {
+		history = history[:esploraPageSize]
+	}
+	json.NewEncoder(w).Encode(history)
+}
+
+func newFakeWallet() *fakeEsplora {
+	e := &fakeEsplora{}
+	e.addTx("a", 100,
+		[]*esploraOutput{{Address: testExternal, Value: 100000}},
+		[]*esploraOutput{{Address: testReceive0, Value: 60000}, {Address: testExternal, Value: 39000}})
+	// spends the receive address, with the change and a 500 sats fee
+	e.addTx("b", 101,
+		[]*esploraOutput{{Address: testReceive0, Value: 60000}},
+		[]*esploraOutput{{Address: testExternal, Value: 20000}, {Address: testChange0, Value: 39500}})
+	// more than a page of small deposits
+	for i := 0; i < 27; i++ {
+		e.addTx(fmt.Sprintf("c%02d", i), int64(102+i),
+			[]*esploraOutput{{Address: testExternal, Value: 5000}},
+			[]*esploraOutput{{Address: testReceive1, Value: 1000}, {Address: testExternal, Value: 3900}})
+	}
+	return e
+}
+
+func TestBitcoinAdapter_xpub(t *testing.T) {
+	esplora := newFakeWallet()
+	ts := httptest.NewServer(esplora)
+	defer ts.Close()
+
+	a := NewBitcoinAdapter(ts.URL, http.DefaultClient)
+	a.gapLimit = 3
+	acc := &Account{ID: 1, Adapter: "bitcoin", Credentials: map[string]string{"xpub": testZpub}}
+
+	entry, err := a.FetchCustodian(context.Background(), acc, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if assets := entry.Custodian.Assets; len(assets) != 1 || assets[0].Balance.String() != "0.000665" {
+		t.Errorf("expected a balance of 66500 sats, got %v", assets[0].Balance)
+	}
+
+	txs := entry.Custodian.Transactions
+	if len(txs) != 29 {
+		t.Fatalf("expected 29 transactions, got %d", len(txs))
+	}
+	checkTransactions(t, txs[:3], []string{
+		"BTC 0.0006 IN 0",
+		"BTC 0.000205 OUT 0",
+		"BTC 0.00001 IN 0",
+	})
+
+	// 2 used and 3 unused receive addresses, 1 used and 3 unused change addresses
+	esplora.l.Lock()
+	defer esplora.l.Unlock()
+	if len(esplora.addresses) != 9 || esplora.addresses[0] != testReceive0 || esplora.addresses[5] != testChange0 {
+		t.Errorf("unexpected scanned addresses %v", esplora.addresses)
+	}
+}
+
+func TestBitcoinAdapter_addresses(t *testing.T) {
+	ts := httptest.NewServer(newFakeWallet())
+	defer ts.Close()
+
+	a := NewBitcoinAdapter(ts.URL, http.DefaultClient)
+	acc := &Account{ID: 1, Adapter: "bitcoin", Credentials: map[string]string{"addresses": testReceive0 + ", " + testChange0}}
+
+	assets, err := a.FetchBalances(context.Background(), acc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if assets[0].Balance.String() != "0.000395" {
+		t.Errorf("expected a balance of 39500 sats, got %v", assets[0].Balance)
+	}
+
+	page, err := a.FetchTransactions(context.Background(), acc, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkTransactions(t, page.Transactions, []string{
+		"BTC 0.0006 IN 0",
+		"BTC 0.000205 OUT 0",
+	})
+}
+
+func TestBitcoinAdapter_duplicated_address(t *testing.T) {
+	ts := httptest.NewServer(newFakeWallet())
+	defer ts.Close()
+
+	a := NewBitcoinAdapter(ts.URL, http.DefaultClient)
+	addresses := testReceive0 + "," + testChange0 + "," + testChange0
+	acc := &Account{ID: 1, Adapter: "bitcoin", Credentials: map[string]string{"addresses": addresses}}
+
+	assets, err := a.FetchBalances(context.Background(), acc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if assets[0].Balance.String() != "0.000395" {
+		t.Errorf("a duplicated address shouldn't be counted twice, got a balance of %v", assets[0].Balance)
+	}
+}
+
+func TestBitcoinAdapter_credentials(t *testing.T) {
+	a := NewBitcoinAdapter("http://localhost:1", http.DefaultClient)
+	for _, creds := range []map[string]string{nil, {"xpub": "xpub-invalid"}} {
+		if _, err := a.FetchBalances(context.Background(), &Account{ID: 1, Credentials: creds}); err == nil {
+			t.Errorf("expected an error for the credentials %v", creds)
+		}
+	}
+}
@@ -0,0 +1,220 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Circuit breaker states reported by BreakerState.State
+const (
+	BreakerClosed   = "closed"
+	BreakerOpen     = "open"
+	BreakerHalfOpen = "half_open"
+)
+
+// BreakerPolicy describes when the circuit breaker of a custodian opens and closes again
+type BreakerPolicy struct {
+	// FailureThreshold is the number of consecutive failures which opens the circuit, 0 disables the breakers
+	FailureThreshold int
+	// CoolDown is how long the circuit stays open before a probe request is let through
+	CoolDown time.Duration
+	// HalfOpenSuccesses is the number of successful probes needed to close the circuit
+	HalfOpenSuccesses int
+}
+
+// DefaultBreakerPolicy opens the circuit after 5 consecutive failures, and probes again after 30s
+func DefaultBreakerPolicy() BreakerPolicy {
+	return BreakerPolicy{
+		FailureThreshold:  5,
+		CoolDown:          30 * time.Second,
+		HalfOpenSuccesses: 1,
+	}
+}
+
+// WithBreakerPolicy sets the circuit breaker policy used for each custodian
+func WithBreakerPolicy(p BreakerPolicy) CustodianSvcOption {
+	return func(c *CustodianSvc) {
+		if p.HalfOpenSuccesses < 1 {
+			p.HalfOpenSuccesses = 1
+		}
+		c.breakers = newBreakers(p)
+	}
+}
+
+// CircuitOpenError is returned without any request when the circuit of a custodian is open
+type CircuitOpenError struct {
+	ID int32
+}
+
+func (e *CircuitOpenError) Error() string {
+	return fmt.Sprintf("Custodian %d circuit breaker is open", e.ID)
+}
+
+// BreakerState describes the circuit breaker of one account, as returned to API clients
+type BreakerState struct {
+	ID      int32  `json:"id"`
+	Adapter string `json:"adapter"`
+	// Account is the hash of the credentials of the account, if it has some
+	Account  string     `json:"account,omitempty"`
+	State    string     `json:"state"`
+	Failures int        `json:"consecutive_failures"`
+	OpenedAt *time.Time `json:"opened_at,omitempty"`
+}
+
+type breaker struct {
+	state     string
+	failures  int
+	successes int
+	// a half-open probe request is running
+	probing  bool
+	openedAt time.Time
+}
+
+// breakers holds the circuit breaker of each account, so that the bad credentials
+// of one account don't open the circuit of the other accounts of the same custodian
+type breakers struct {
+	policy BreakerPolicy
+	now    func() time.Time
+
+	m map[AccountKey]*breaker
+	l sync.Mutex
+}
+
+func newBreakers(p BreakerPolicy) *breakers {
+	return &breakers{
+		policy: p,
+		now:    time.Now,
+		m:      make(map[AccountKey]*breaker),
+	}
+}
+
+// get returns the breaker of the account, it must be called with the lock held
+func (b *breakers) get(key AccountKey) *breaker {
+	br, found := b.m[key]
+	if !found {
+		br = &breaker{state: BreakerClosed}
+		b.m[key] = br
+	}
+	return br
+}
+
+// allow returns a CircuitOpenError when no request should be sent to the account
+func (b *breakers) allow(key AccountKey) error {
+	if b.policy.FailureThreshold <= 0 {
+		return nil
+	}
+	b.l.Lock()
+	defer b.l.Unlock()
+
+	br := b.get(key)
+	switch br.state {
+	case BreakerOpen:
+		if b.now().Sub(br.openedAt) < b.policy.CoolDown {
+			return &CircuitOpenError{key.ID}
+		}
+		br.state = BreakerHalfOpen
+		br.successes = 0
+		fallthrough
+	case BreakerHalfOpen:
+		// only one probe at a time
+		if br.probing {
+			return &CircuitOpenError{key.ID}
+		}
+		br.probing = true
+	}
+	return nil
+}
+
+// record updates the breaker of the account with the outcome of a request
+func (b *breakers) record(key AccountKey, err error) {
+	if b.policy.FailureThreshold <= 0 {
+		return
+	}
+	b.l.Lock()
+	defer b.l.Unlock()
+
+	br := b.get(key)
+	wasProbe := br.probing
+	br.probing = false
+
+	// we cancelled the request ourselves, it says nothing about the custodian
+	if errors.Is(err, context.Canceled) {
+		return
+	}
+
+	if !isBreakerFailure(err) {
+		switch br.state {
+		case BreakerHalfOpen:
+			if wasProbe {
+				br.successes++
+			}
+			if br.successes >= b.policy.HalfOpenSuccesses {
+				br.state = BreakerClosed
+				br.failures = 0
+			}
+		case BreakerClosed:
+			br.failures = 0
+		}
+		return
+	}
+
+	br.failures++
+	switch br.state {
+	case BreakerHalfOpen:
+		if wasProbe {
+			b.open(br)
+		}
+	case BreakerClosed:
+		if br.failures >= b.policy.FailureThreshold {
+			b.open(br)
+		}
+	}
+}
+
+func (b *breakers) open(br *breaker) {
+	br.state = BreakerOpen
+	br.openedAt = b.now()
+}
+
+// states returns the state of every known account breaker, sorted by custodian ID
+func (b *breakers) states() []*BreakerState {
+	b.l.Lock()
+	defer b.l.Unlock()
+
+	states := make([]*BreakerState, 0, len(b.m))
+	for key, br := range b.m {
+		state := &BreakerState{ID: key.ID, Adapter: key.Adapter, Account: key.Credentials, State: br.state, Failures: br.failures}
+		if br.state != BreakerClosed {
+			openedAt := br.openedAt
+			state.OpenedAt = &openedAt
+		}
+		states = append(states, state)
+	}
+	sort.Slice(states, func(i, j int) bool {
+		if states[i].ID != states[j].ID {
+			return states[i].ID < states[j].ID
+		}
+		if states[i].Adapter != states[j].Adapter {
+			return states[i].Adapter < states[j].Adapter
+		}
+		return states[i].Account < states[j].Account
+	})
+	return states
+}
+
+// isBreakerFailure tells if the error means the custodian is unhealthy.
+// Client errors like 404 come from a custodian which is up and running.
+func isBreakerFailure(err error) bool {
+	if err == nil {
+		return false
+	}
+	var httpErr *HTTPStatusError
+	if errors.As(err, &httpErr) {
+		return httpErr.StatusCode >= 500 || httpErr.StatusCode == 429
+	}
+	return true
+}
@@ -0,0 +1,119 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func Test_breakers_transitions(t *testing.T) {
+	now := time.Date(2021, 5, 20, 12, 0, 0, 0, time.UTC)
+	b := newBreakers(BreakerPolicy{FailureThreshold: 2, CoolDown: time.Minute, HalfOpenSuccesses: 1})
+	b.now = func() time.Time { return now }
+	key := AccountKey{ID: 1, Adapter: DefaultAdapter}
+
+	failure := errors.New("connection reset")
+	state := func() string { return b.states()[0].State }
+
+	b.allow(key)
+	b.record(key, failure)
+	if state() != BreakerClosed {
+		t.Fatalf("one failure shouldn't open the circuit, got %s", state())
+	}
+	b.allow(key)
+	b.record(key, failure)
+	if state() != BreakerOpen {
+		t.Fatalf("two failures should open the circuit, got %s", state())
+	}
+
+	var circuitErr *CircuitOpenError
+	if err := b.allow(key); !errors.As(err, &circuitErr) {
+		t.Fatalf("an open circuit should fail fast, got %v", err)
+	}
+
+	// after the cool down, a single probe goes through
+	now = now.Add(time.Minute)
+	if err := b.allow(key); err != nil {
+		t.Fatalf("the probe should be allowed, got %v", err)
+	}
+	if err := b.allow(key); err == nil {
+		t.Fatal("only one probe should be allowed at a time")
+	}
+	b.record(key, failure)
+	if state() != BreakerOpen {
+		t.Fatalf("a failed probe should open the circuit again, got %s", state())
+	}
+
+	now = now.Add(time.Minute)
+	b.allow(key)
+	b.record(key, nil)
+	if state() != BreakerClosed {
+		t.Fatalf("a successful probe should close the circuit, got %s", state())
+	}
+}
+
+func Test_breakers_ignored_errors(t *testing.T) {
+	b := newBreakers(BreakerPolicy{FailureThreshold: 1, CoolDown: time.Minute, HalfOpenSuccesses: 1})
+	key := AccountKey{ID: 1, Adapter: DefaultAdapter}
+
+	b.allow(key)
+	b.record(key, context.Canceled)
+	b.allow(key)
+	b.record(key, &HTTPStatusError{http.StatusNotFound})
+	if state := b.states()[0]; state.State != BreakerClosed {
+		t.Errorf("cancellations and client errors shouldn't open the circuit, got %s", state.State)
+	}
+
+	b.allow(key)
+	b.record(key, &HTTPStatusError{http.StatusBadGateway})
+	if state := b.states()[0]; state.State != BreakerOpen || state.OpenedAt == nil {
+		t.Errorf("server errors should open the circuit, got %+v", state)
+	}
+}
+
+func Test_breakers_disabled(t *testing.T) {
+	b := newBreakers(BreakerPolicy{})
+	key := AccountKey{ID: 1, Adapter: DefaultAdapter}
+
+	for i := 0; i < 10; i++ {
+		if err := b.allow(key); err != nil {
+			t.Fatal(err)
+		}
+		b.record(key, errors.New("boom"))
+	}
+}
+
+func TestCustodianSvc_breaker_fails_fast(t *testing.T) {
+	var calls int32
+	ts := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		http.Error(rw, "down", http.StatusInternalServerError)
+	}))
+	defer ts.Close()
+
+	svc := NewCustodianSvc(ts.URL+"/custodian/",
+		WithRetryPolicy(RetryPolicy{MaxAttempts: 1}),
+		WithBreakerPolicy(BreakerPolicy{FailureThreshold: 3, CoolDown: time.Minute}),
+	)
+
+	for i := 0; i < 5; i++ {
+		svc.FetchAll(context.Background(), 1)
+	}
+	if atomic.LoadInt32(&calls) != 3 {
+		t.Errorf("expected 3 requests before the circuit opens, got %d", atomic.LoadInt32(&calls))
+	}
+
+	res := svc.FetchAll(context.Background(), 1)
+	if status := res[0].Status(); status.Status != StatusCircuitOpen {
+		t.Errorf("expected %s status, got %s", StatusCircuitOpen, status.Status)
+	}
+
+	states := svc.BreakerStates()
+	if len(states) != 1 || states[0].ID != 1 || states[0].State != BreakerOpen {
+		t.Errorf("unexpected breaker states %+v", states)
+	}
+}
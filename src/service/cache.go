@@ -0,0 +1,158 @@
+package service
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/bottlepay/portfolio-data/model"
+)
+
+// CacheEntry is a custodian stored in a CustodianCache
+type CacheEntry struct {
+	Custodian *model.Custodian `json:"custodian"`
+	FetchedAt time.Time        `json:"fetched_at"`
+
+	// validators for conditional requests, as sent by the custodian
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+	// Cursor lists the transactions after the cached ones, for the adapters which support it
+	Cursor string `json:"cursor,omitempty"`
+}
+
+// CustodianCache stores the custodians fetched by a CustodianSvc.
+// Errors are reported so that an unreachable cache can be bypassed.
+type CustodianCache interface {
+	// Get returns the cached entry of the account, or nil if there's none
+	Get(context.Context, AccountKey) (*CacheEntry, error)
+	// Set stores the entry of the account
+	Set(context.Context, AccountKey, *CacheEntry) error
+	// Invalidate removes every account of the custodian from the cache
+	Invalidate(context.Context, int32) error
+}
+
+// CachePolicy describes how long cached custodians are used
+type CachePolicy struct {
+	// TTL is how long a cached custodian is used without fetching it again
+	TTL time.Duration
+	// StaleWhileRevalidate is how long after the TTL a stale custodian is still returned,
+	// while a fresh copy is fetched in the background
+	StaleWhileRevalidate time.Duration
+	// KeepExpired is how long after the stale window an expired custodian is kept,
+	// to be revalidated with a conditional request instead of downloaded again
+	KeepExpired time.Duration
+}
+
+// MaxAge is how long a cache needs to keep the custodians
+func (p CachePolicy) MaxAge() time.Duration {
+	return p.TTL + p.StaleWhileRevalidate + p.KeepExpired
+}
+
+// DefaultCachePolicy uses cached custodians for 10s, stale ones for another minute,
+// and keeps expired ones for an hour
+func DefaultCachePolicy() CachePolicy {
+	return CachePolicy{
+		TTL:                  10 * time.Second,
+		StaleWhileRevalidate: time.Minute,
+		KeepExpired:          time.Hour,
+	}
+}
+
+// revalidateTimeout bounds the background refresh of a stale custodian
+const revalidateTimeout = 30 * time.Second
+
+// WithCache stores the fetched custodians in cache, and uses them according to the policy
+func WithCache(cache CustodianCache, p CachePolicy) CustodianSvcOption {
+	return func(c *CustodianSvc) {
+		c.cacher = &cacher{
+			cache:      cache,
+			policy:     p,
+			now:        time.Now,
+			refreshing: make(map[AccountKey]bool),
+		}
+	}
+}
+
+// cacher puts a CustodianCache in front of the custodian requests
+type cacher struct {
+	cache  CustodianCache
+	policy CachePolicy
+	now    func() time.Time
+
+	// accounts being revalidated in the background
+	refreshing map[AccountKey]bool
+	l          sync.Mutex
+}
+
+// fetchCached returns the cached custodian if it's recent enough, otherwise it fetches and caches it.
+// Stale custodians are returned right away and refreshed in the background.
+// Expired custodians are revalidated with a conditional request.
+func (c *CustodianSvc) fetchCached(ctx context.Context, acc *Account) (*model.Custodian, error) {
+	entry, err := c.cacher.cache.Get(ctx, acc.Key())
+	if err != nil {
+		log.Println("custodian cache get error:", err)
+	}
+	if entry != nil {
+		age := c.cacher.now().Sub(entry.FetchedAt)
+		if age < c.cacher.policy.TTL {
+			return entry.Custodian, nil
+		}
+		if age < c.cacher.policy.TTL+c.cacher.policy.StaleWhileRevalidate {
+			c.revalidate(acc, entry)
+			return entry.Custodian, nil
+		}
+	}
+
+	return c.fetchAndCache(ctx, acc, entry)
+}
+
+// fetchAndCache fetches the custodian, conditionally when it's cached, and stores it in the cache
+func (c *CustodianSvc) fetchAndCache(ctx context.Context, acc *Account, cached *CacheEntry) (*model.Custodian, error) {
+	fetchedAt := c.cacher.now()
+	entry, err := c.fetchDirect(ctx, acc, cached)
+	if err != nil {
+		return nil, err
+	}
+	entry.FetchedAt = fetchedAt
+	if err := c.cacher.cache.Set(ctx, acc.Key(), entry); err != nil {
+		log.Println("custodian cache set error:", err)
+	}
+	return entry.Custodian, nil
+}
+
+// revalidate refreshes the cached custodian in the background, once at a time
+func (c *CustodianSvc) revalidate(acc *Account, cached *CacheEntry) {
+	c.cacher.l.Lock()
+	defer c.cacher.l.Unlock()
+
+	key := acc.Key()
+	if c.cacher.refreshing[key] {
+		return
+	}
+	c.cacher.refreshing[key] = true
+
+	go func() {
+		defer func() {
+			c.cacher.l.Lock()
+			delete(c.cacher.refreshing, key)
+			c.cacher.l.Unlock()
+		}()
+
+		// the request which triggered the refresh may already be done
+		ctx, cancel := context.WithTimeout(context.Background(), revalidateTimeout)
+		defer cancel()
+
+		if _, err := c.fetchAndCache(ctx, acc, cached); err != nil {
+			log.Println("custodian revalidation error:", err)
+		}
+	}()
+}
+
+// Invalidate removes every account of the custodian from the cache, so that it's fetched again on the next request
+func (c *CustodianSvc) Invalidate(ctx context.Context, custID int32) error {
+	if c.cacher == nil {
+		return nil
+	}
+	return c.cacher.cache.Invalidate(ctx, custID)
+}
@@ -0,0 +1,111 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCustodianSvc_cache(t *testing.T) {
+	var calls int32
+	ts := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&calls, 1)
+		fmt.Fprintf(rw, `{"id":1,"assets":[{"code":"BTC","balance":"%d"}]}`, n)
+	}))
+	defer ts.Close()
+
+	now := time.Date(2021, 5, 20, 12, 0, 0, 0, time.UTC)
+	policy := CachePolicy{TTL: time.Minute, StaleWhileRevalidate: time.Hour}
+	cache := NewLRUCache(10, policy.MaxAge())
+	svc := NewCustodianSvc(ts.URL+"/custodian/", WithCache(cache, policy))
+	cache.now = func() time.Time { return now }
+	svc.cacher.now = cache.now
+
+	balance := func() string {
+		res, err := svc.FetchFromCustodian(context.Background(), 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res[0].Assets[0].Balance.String()
+	}
+
+	if b := balance(); b != "1" {
+		t.Errorf("first fetch: got balance %s", b)
+	}
+	if b := balance(); b != "1" || atomic.LoadInt32(&calls) != 1 {
+		t.Errorf("fresh custodian should come from the cache: got balance %s", b)
+	}
+
+	// the stale custodian is returned, and refreshed in the background
+	now = now.Add(2 * time.Minute)
+	if b := balance(); b != "1" {
+		t.Errorf("stale custodian should be returned: got balance %s", b)
+	}
+	deadline := time.Now().Add(time.Second)
+	for balance() != "2" {
+		if time.Now().After(deadline) {
+			t.Fatal("stale custodian wasn't revalidated")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := atomic.LoadInt32(&calls); n != 2 {
+		t.Errorf("stale custodian should be revalidated once, got %d calls", n)
+	}
+
+	svc.Invalidate(context.Background(), 1)
+	if b := balance(); b != "3" {
+		t.Errorf("invalidated custodian should be fetched: got balance %s", b)
+	}
+
+	// past the stale window, the custodian is fetched synchronously
+	now = now.Add(2 * time.Hour)
+	if b := balance(); b != "4" {
+		t.Errorf("expired custodian should be fetched: got balance %s", b)
+	}
+}
+
+func TestCustodianSvc_cache_conditional(t *testing.T) {
+	var full, notModified int32
+	ts := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("ETag", `"1-42"`)
+		if r.Header.Get("If-None-Match") == `"1-42"` {
+			atomic.AddInt32(&notModified, 1)
+			rw.WriteHeader(http.StatusNotModified)
+			return
+		}
+		atomic.AddInt32(&full, 1)
+		fmt.Fprint(rw, `{"id":1,"assets":[{"code":"BTC","balance":"1.5"}]}`)
+	}))
+	defer ts.Close()
+
+	now := time.Date(2021, 5, 20, 12, 0, 0, 0, time.UTC)
+	policy := CachePolicy{TTL: time.Minute, KeepExpired: time.Hour}
+	cache := NewLRUCache(10, policy.MaxAge())
+	svc := NewCustodianSvc(ts.URL+"/custodian/", WithCache(cache, policy))
+	cache.now = func() time.Time { return now }
+	svc.cacher.now = cache.now
+
+	for i := 0; i < 3; i++ {
+		// each fetch happens after the previous one expired
+		now = now.Add(2 * time.Minute)
+		res, err := svc.FetchFromCustodian(context.Background(), 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b := res[0].Assets[0].Balance.String(); b != "1.5" {
+			t.Errorf("fetch %d: got balance %s", i, b)
+		}
+	}
+	if full != 1 || notModified != 2 {
+		t.Errorf("expected 1 full and 2 conditional requests, got %d and %d", full, notModified)
+	}
+
+	entry, _ := cache.Get(context.Background(), (&Account{ID: 1}).Key())
+	if entry == nil || entry.ETag != `"1-42"` || !entry.FetchedAt.Equal(now) {
+		t.Errorf("the revalidated entry should be cached again, got %+v", entry)
+	}
+}
@@ -0,0 +1,238 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/bottlepay/portfolio-data/model"
+	"github.com/shopspring/decimal"
+)
+
+// CoinbaseAdapter reaches custodians with a Coinbase-style API: the balances of /v2/accounts,
+// and the transactions of /v2/accounts/{id}/transactions.
+// It needs the "api_key" and "api_secret" credentials to sign its requests.
+type CoinbaseAdapter struct {
+	url  string
+	http HTTPDoer
+	now  func() time.Time
+}
+
+// NewCoinbaseAdapter creates a CoinbaseAdapter for the API at the base URL, like https://api.coinbase.com
+func NewCoinbaseAdapter(u string, doer HTTPDoer) *CoinbaseAdapter {
+	return &CoinbaseAdapter{url: u, http: doer, now: time.Now}
+}
+
+const (
+	coinbaseVersion  = "2021-05-20"
+	coinbasePageSize = 100
+)
+
+type coinbaseMoney struct {
+	Amount   decimal.Decimal `json:"amount"`
+	Currency string          `json:"currency"`
+}
+
+type coinbasePage struct {
+	Pagination struct {
+		NextURI string `json:"next_uri"`
+	} `json:"pagination"`
+	Data json.RawMessage `json:"data"`
+}
+
+type coinbaseAccount struct {
+	ID      string        `json:"id"`
+	Balance coinbaseMoney `json:"balance"`
+}
+
+type coinbaseResource struct {
+	ID string `json:"id"`
+}
+
+type coinbaseTransaction struct {
+	ID        string        `json:"id"`
+	Type      string        `json:"type"`
+	Status    string        `json:"status"`
+	Amount    coinbaseMoney `json:"amount"`
+	CreatedAt time.Time     `json:"created_at"`
+
+	// the order behind buy, sell and trade transactions
+	Buy   *coinbaseResource `json:"buy,omitempty"`
+	Sell  *coinbaseResource `json:"sell,omitempty"`
+	Trade *coinbaseResource `json:"trade,omitempty"`
+}
+
+func (a *CoinbaseAdapter) Capabilities() Capabilities {
+	// transaction IDs are given by ordering the whole history, it can't be synced incrementally
+	return Capabilities{Transactions: true}
+}
+
+func (a *CoinbaseAdapter) FetchBalances(ctx context.Context, acc *Account) ([]*model.Asset, error) {
+	accounts, err := a.accounts(ctx, acc)
+	if err != nil {
+		return nil, err
+	}
+	return coinbaseBalances(accounts), nil
+}
+
+// FetchTransactions returns all the transactions in a single page,
+// the legs of the trades are spread across the accounts
+func (a *CoinbaseAdapter) FetchTransactions(ctx context.Context, acc *Account, cursor string) (*TransactionsPage, error) {
+	accounts, err := a.accounts(ctx, acc)
+	if err != nil {
+		return nil, err
+	}
+	txs, err := a.transactions(ctx, acc, accounts)
+	if err != nil {
+		return nil, err
+	}
+	return &TransactionsPage{Transactions: txs}, nil
+}
+
+// FetchCustodian lists the accounts once, for both the balances and the transactions
+func (a *CoinbaseAdapter) FetchCustodian(ctx context.Context, acc *Account, cached *CacheEntry) (*CacheEntry, error) {
+	accounts, err := a.accounts(ctx, acc)
+	if err != nil {
+		return nil, err
+	}
+	txs, err := a.transactions(ctx, acc, accounts)
+	if err != nil {
+		return nil, err
+	}
+	return &CacheEntry{Custodian: &model.Custodian{
+		ID:           acc.ID,
+		Assets:       coinbaseBalances(accounts),
+		Transactions: txs,
+	}}, nil
+}
+
+func (a *CoinbaseAdapter) accounts(ctx context.Context, acc *Account) ([]*coinbaseAccount, error) {
+	var accounts []*coinbaseAccount
+	err := a.list(ctx, acc, "/v2/accounts?limit="+strconv.Itoa(coinbasePageSize), func(data json.RawMessage) error {
+		var page []*coinbaseAccount
+		if err := json.Unmarshal(data, &page); err != nil {
+			return err
+		}
+		accounts = append(accounts, page...)
+		return nil
+	})
+	return accounts, err
+}
+
+// coinbaseBalances adds up the balances of the accounts, there may be several wallets of the same currency
+func coinbaseBalances(accounts []*coinbaseAccount) []*model.Asset {
+	al := model.NewAssetList()
+	for _, each := range accounts {
+		al.AddAssetValue(&model.Asset{Code: each.Balance.Currency, Balance: each.Balance.Amount})
+	}
+	return al.GetAssets()
+}
+
+// transactions lists the completed transactions of every account
+func (a *CoinbaseAdapter) transactions(ctx context.Context, acc *Account, accounts []*coinbaseAccount) ([]*model.Transaction, error) {
+	var legs []*leg
+	for _, each := range accounts {
+		path := fmt.Sprintf("/v2/accounts/%s/transactions?limit=%d&order=asc", each.ID, coinbasePageSize)
+		err := a.list(ctx, acc, path, func(data json.RawMessage) error {
+			var page []*coinbaseTransaction
+			if err := json.Unmarshal(data, &page); err != nil {
+				return err
+			}
+			for _, tx := range page {
+				if l := coinbaseLeg(tx); l != nil {
+					legs = append(legs, l)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return buildTransactions(acc.ID, legs), nil
+}
+
+// coinbaseLeg converts a completed transaction. Buys, sells and trades have one leg in each of the two
+// accounts involved, and they're paired by their order ID. The other types are external movements:
+// send, fiat_deposit, fiat_withdrawal, exchange_deposit, exchange_withdrawal...
+func coinbaseLeg(tx *coinbaseTransaction) *leg {
+	if tx.Status != "completed" || tx.Amount.Amount.IsZero() {
+		return nil
+	}
+
+	l := &leg{
+		time:      tx.CreatedAt,
+		asset:     tx.Amount.Currency,
+		amount:    tx.Amount.Amount.Abs(),
+		direction: model.DirectionIn,
+	}
+	if tx.Amount.Amount.IsNegative() {
+		l.direction = model.DirectionOut
+	}
+
+	var order *coinbaseResource
+	switch tx.Type {
+	case "buy":
+		order = tx.Buy
+	case "sell":
+		order = tx.Sell
+	case "trade":
+		order = tx.Trade
+	}
+	if order != nil && order.ID != "" {
+		l.pair = tx.Type + ":" + order.ID
+	}
+	return l
+}
+
+// list gets every page of a list, starting at path and following the next_uri of each page
+func (a *CoinbaseAdapter) list(ctx context.Context, acc *Account, path string, each func(json.RawMessage) error) error {
+	for path != "" {
+		page := &coinbasePage{}
+		if err := a.get(ctx, acc, path, page); err != nil {
+			return err
+		}
+		if err := each(page.Data); err != nil {
+			return &DecodeError{err}
+		}
+		path = page.Pagination.NextURI
+	}
+	return nil
+}
+
+// get runs a signed GET request on the path, and decodes the response in out
+func (a *CoinbaseAdapter) get(ctx context.Context, acc *Account, path string, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", a.url+path, nil)
+	if err != nil {
+		return fmt.Errorf("Coinbase GET request Error: %v", err)
+	}
+
+	timestamp := strconv.FormatInt(a.now().Unix(), 10)
+	req.Header.Set("CB-VERSION", coinbaseVersion)
+	req.Header.Set("CB-ACCESS-KEY", acc.Credentials["api_key"])
+	req.Header.Set("CB-ACCESS-TIMESTAMP", timestamp)
+	req.Header.Set("CB-ACCESS-SIGN", signHMAC(acc.Credentials["api_secret"], timestamp+"GET"+path))
+
+	res, err := a.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("Coinbase GET Error: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != 200 {
+		return &HTTPStatusError{res.StatusCode}
+	}
+	if err := json.NewDecoder(res.Body).Decode(out); err != nil {
+		return &DecodeError{err}
+	}
+	return nil
+}
+
+func init() {
+	// Check interface implementation
+	var _ CustodianAdapter = (*CoinbaseAdapter)(nil)
+	var _ CustodianFetcher = (*CoinbaseAdapter)(nil)
+}
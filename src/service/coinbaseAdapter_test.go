@@ -0,0 +1,121 @@
+package service
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/bottlepay/portfolio-data/model"
+)
+
+// newFixtureServer serves the files of testdata/dir, the route of each request is given by route,
+// which returns false when the request isn't correctly signed
+func newFixtureServer(t *testing.T, dir string, files map[string]string, route func(*http.Request) (string, bool)) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key, ok := route(r)
+		if !ok {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		file, found := files[key]
+		if !found {
+			t.Errorf("unexpected request %s", key)
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		body, err := ioutil.ReadFile(filepath.Join("testdata", dir, file))
+		if err != nil {
+			t.Error(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(body)
+	}))
+}
+
+// checkTransactions compares the transactions with the expected "asset amount direction related" lines
+func checkTransactions(t *testing.T, txs []*model.Transaction, want []string) {
+	t.Helper()
+	if len(txs) != len(want) {
+		t.Fatalf("expected %d transactions, got %d", len(want), len(txs))
+	}
+	for i, tx := range txs {
+		if tx.ID != int32(i+1) {
+			t.Errorf("transaction %d has ID %d", i, tx.ID)
+		}
+		got := tx.Asset + " " + tx.Amount.String() + " " + tx.Direction + " " + strconv.Itoa(int(tx.RelatedCustodianTransactionID))
+		if got != want[i] {
+			t.Errorf("transaction %d: expected %q, got %q", tx.ID, want[i], got)
+		}
+	}
+}
+
+func newCoinbaseFixtureServer(t *testing.T) *httptest.Server {
+	const btc, gbp = "2bbf394c-193b-5b2a-9155-3b4732659ede", "58542935-67b5-56e1-a3f9-42686e07fa40"
+	files := map[string]string{
+		"/v2/accounts?limit=100":                                    "accounts_1.json",
+		"/v2/accounts?limit=100&starting_after=" + btc:              "accounts_2.json",
+		"/v2/accounts/" + btc + "/transactions?limit=100&order=asc": "btc_transactions_1.json",
+		"/v2/accounts/" + btc + "/transactions?limit=100&order=asc&starting_after=8250fe29-f5ef-5fc5-8302-0fbacf6be51e": "btc_transactions_2.json",
+		"/v2/accounts/" + gbp + "/transactions?limit=100&order=asc":                                                     "gbp_transactions.json",
+	}
+	return newFixtureServer(t, "coinbase", files, func(r *http.Request) (string, bool) {
+		path := r.URL.RequestURI()
+		sign := signHMAC("secret", r.Header.Get("CB-ACCESS-TIMESTAMP")+r.Method+path)
+		return path, r.Header.Get("CB-ACCESS-KEY") == "key" && r.Header.Get("CB-ACCESS-SIGN") == sign
+	})
+}
+
+func TestCoinbaseAdapter(t *testing.T) {
+	ts := newCoinbaseFixtureServer(t)
+	defer ts.Close()
+
+	a := NewCoinbaseAdapter(ts.URL, http.DefaultClient)
+	a.now = func() time.Time { return time.Unix(1620295200, 0) }
+	acc := &Account{ID: 3, Adapter: "coinbase", Credentials: map[string]string{"api_key": "key", "api_secret": "secret"}}
+
+	entry, err := a.FetchCustodian(context.Background(), acc, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assets := entry.Custodian.Assets
+	if len(assets) != 2 || assets[0].Code != "BTC" || assets[0].Balance.String() != "0.55" ||
+		assets[1].Code != "GBP" || assets[1].Balance.String() != "1000" {
+		t.Errorf("unexpected balances %+v %+v", assets[0], assets[1])
+	}
+
+	// the pending send is left out, the buy is an exchange between the GBP and BTC accounts
+	checkTransactions(t, entry.Custodian.Transactions, []string{
+		"GBP 5000 IN 0",
+		"BTC 0.5 IN 0",
+		"GBP 4000 OUT 4",
+		"BTC 0.1 IN 3",
+		"BTC 0.05 OUT 0",
+	})
+	if ts := entry.Custodian.Transactions[0].Timestamp; !ts.Equal(time.Date(2021, 4, 30, 10, 0, 0, 0, time.UTC)) || ts.Location() != time.UTC {
+		t.Errorf("unexpected timestamp %v", ts)
+	}
+	if ex := entry.Custodian.GetAssetExchanges(); len(ex) != 1 || ex[0].From.Code != "GBP" || ex[0].To.Code != "BTC" {
+		t.Errorf("expected a GBP to BTC exchange, got %v", ex)
+	}
+}
+
+func TestCoinbaseAdapter_unauthorized(t *testing.T) {
+	ts := newCoinbaseFixtureServer(t)
+	defer ts.Close()
+
+	a := NewCoinbaseAdapter(ts.URL, http.DefaultClient)
+	acc := &Account{ID: 3, Adapter: "coinbase", Credentials: map[string]string{"api_key": "key", "api_secret": "wrong"}}
+
+	_, err := a.FetchBalances(context.Background(), acc)
+	if se, ok := err.(*HTTPStatusError); !ok || se.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected a 401 error, got %v", err)
+	}
+}
@@ -2,52 +2,262 @@ package service
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
+	"net"
 	"net/http"
-	"strconv"
+	"sync"
 
 	"github.com/bottlepay/portfolio-data/model"
 )
 
-// CustodianSvc runs HTTP requests to get Custodian data
+// DefaultConcurrency is the number of custodians fetched in parallel by default
+const DefaultConcurrency = 4
+
+// CustodianSvc gets Custodian data, using the adapter of each custodian account
 type CustodianSvc struct {
-	url string
+	// maximum number of custodians fetched at the same time
+	concurrency int
+
+	http     *RetryingClient
+	adapters AdapterRegistry
+	breakers *breakers
+	// nil when caching is disabled
+	cacher *cacher
+
+	// base URL and page size of the default mock adapter
+	url          string
+	syncPageSize int
+}
+
+// CustodianSvcOption configures optional behaviour of a CustodianSvc
+type CustodianSvcOption func(*CustodianSvc)
+
+// WithConcurrency sets the maximum number of custodians fetched in parallel.
+// 1 fetches the custodians one after another.
+func WithConcurrency(n int) CustodianSvcOption {
+	return func(c *CustodianSvc) {
+		if n < 1 {
+			n = 1
+		}
+		c.concurrency = n
+	}
+}
+
+// NewCustodianSvc creates a new CustodianSvc whose default adapter is the mock data service at the base URL
+func NewCustodianSvc(u string, opts ...CustodianSvcOption) *CustodianSvc {
+	c := &CustodianSvc{
+		concurrency:  DefaultConcurrency,
+		http:         NewRetryingClient(http.DefaultClient, DefaultRetryPolicy()),
+		adapters:     make(AdapterRegistry),
+		breakers:     newBreakers(DefaultBreakerPolicy()),
+		url:          u,
+		syncPageSize: DefaultSyncPageSize,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	if _, found := c.adapters[DefaultAdapter]; !found {
+		c.adapters[DefaultAdapter] = NewMockAdapter(c.url, c.http, c.syncPageSize)
+	}
+	return c
+}
+
+// CustodianResult is the outcome of fetching a single custodian
+type CustodianResult struct {
+	ID        int32
+	Custodian *model.Custodian
+	Err       error
 }
 
-// NewCustodianSvc creates a new CustodianSvc with the specified base URL
-func NewCustodianSvc(u string) *CustodianSvc {
-	return &CustodianSvc{u}
+// Fetch statuses reported by CustodianResult.Status
+const (
+	StatusOK          = "ok"
+	StatusTimeout     = "timeout"
+	StatusHTTPError   = "http_error"
+	StatusDecodeError = "decode_error"
+	StatusCircuitOpen = "circuit_open"
+	StatusError       = "error"
+)
+
+// HTTPStatusError is returned when a custodian answers with an unexpected HTTP status code
+type HTTPStatusError struct {
+	StatusCode int
+}
+
+func (e *HTTPStatusError) Error() string {
+	return fmt.Sprintf("Custodian GET Error: status code== %d", e.StatusCode)
+}
+
+// DecodeError is returned when a custodian payload can't be decoded
+type DecodeError struct {
+	Err error
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("Custodian GET JSON: %v", e.Err)
 }
 
-// FetchFromCustodian will return Custodian records for the specified IDs
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+// CustodianStatus describes the outcome of fetching one custodian, as returned to API clients
+type CustodianStatus struct {
+	ID         int32  `json:"id"`
+	Status     string `json:"status"`
+	HTTPStatus int    `json:"http_status,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// Status classifies the result as ok, timeout, http error, decode error, open circuit or generic error
+func (r *CustodianResult) Status() *CustodianStatus {
+	status := &CustodianStatus{ID: r.ID, Status: StatusOK}
+	if r.Err == nil {
+		return status
+	}
+	status.Error = r.Err.Error()
+
+	var httpErr *HTTPStatusError
+	var decodeErr *DecodeError
+	var circuitErr *CircuitOpenError
+	var netErr net.Error
+	switch {
+	case errors.As(r.Err, &circuitErr):
+		status.Status = StatusCircuitOpen
+	case errors.Is(r.Err, context.DeadlineExceeded):
+		status.Status = StatusTimeout
+	case errors.As(r.Err, &netErr) && netErr.Timeout():
+		status.Status = StatusTimeout
+	case errors.As(r.Err, &httpErr):
+		status.Status = StatusHTTPError
+		status.HTTPStatus = httpErr.StatusCode
+	case errors.As(r.Err, &decodeErr):
+		status.Status = StatusDecodeError
+	default:
+		status.Status = StatusError
+	}
+	return status
+}
+
+// FetchFromCustodian will return Custodian records for the specified IDs, in the same order.
+// The custodians are reached with the default adapter.
+// The first failure cancels the outstanding requests and is returned.
 func (c *CustodianSvc) FetchFromCustodian(ctx context.Context, custodianIDs ...int32) ([]*model.Custodian, error) {
-	results := make([]*model.Custodian, len(custodianIDs))
+	return c.FetchAccounts(ctx, defaultAccounts(custodianIDs)...)
+}
 
-	for i, custID := range custodianIDs {
-		custURL := c.url + strconv.Itoa(int(custID))
-		req, err := http.NewRequestWithContext(ctx, "GET", custURL, nil)
-		if err != nil {
-			return nil, fmt.Errorf("Custodian GET request Error: %v", err)
-		}
+// FetchAccounts will return Custodian records for the specified accounts, in the same order.
+// The first failure cancels the outstanding requests and is returned.
+func (c *CustodianSvc) FetchAccounts(ctx context.Context, accounts ...*Account) ([]*model.Custodian, error) {
+	results, err := c.fetch(ctx, true, accounts)
+	if err != nil {
+		return nil, err
+	}
 
-		client := http.DefaultClient
-		res, err := client.Do(req)
-		if err != nil {
-			return nil, fmt.Errorf("Custodian GET Error: %v", err)
+	custodians := make([]*model.Custodian, len(results))
+	for i, res := range results {
+		// the parent context may have been cancelled before any request failed
+		if res.Err != nil {
+			return nil, res.Err
 		}
+		custodians[i] = res.Custodian
+	}
+	return custodians, nil
+}
 
-		if res.StatusCode != 200 {
-			return nil, fmt.Errorf("Custodian GET Error: status code== %d", res.StatusCode)
-		}
-		defer res.Body.Close()
+// FetchAll returns one CustodianResult per ID, in the same order, using the default adapter.
+// Unlike FetchFromCustodian, a failing custodian doesn't stop the others from being fetched.
+func (c *CustodianSvc) FetchAll(ctx context.Context, custodianIDs ...int32) []*CustodianResult {
+	return c.FetchAllAccounts(ctx, defaultAccounts(custodianIDs)...)
+}
+
+// FetchAllAccounts returns one CustodianResult per account, in the same order.
+// Unlike FetchAccounts, a failing custodian doesn't stop the others from being fetched.
+func (c *CustodianSvc) FetchAllAccounts(ctx context.Context, accounts ...*Account) []*CustodianResult {
+	results, _ := c.fetch(ctx, false, accounts)
+	return results
+}
+
+// fetch runs at most c.concurrency requests at a time.
+// When failFast is true, the first error cancels the other requests and is returned.
+func (c *CustodianSvc) fetch(ctx context.Context, failFast bool, accounts []*Account) ([]*CustodianResult, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 
-		cust := &model.Custodian{}
-		if err = json.NewDecoder(res.Body).Decode(cust); err != nil {
-			return nil, fmt.Errorf("Custodian GET JSON: %v", err)
+	results := make([]*CustodianResult, len(accounts))
+	sem := make(chan struct{}, c.concurrency)
+
+	var (
+		wg       sync.WaitGroup
+		once     sync.Once
+		firstErr error
+	)
+
+	for i, acc := range accounts {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			results[i] = &CustodianResult{ID: acc.ID, Err: ctx.Err()}
+			continue
 		}
-		results[i] = cust
+
+		wg.Add(1)
+		go func(i int, acc *Account) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			cust, err := c.fetchOne(ctx, acc)
+			results[i] = &CustodianResult{ID: acc.ID, Custodian: cust, Err: err}
+
+			if err != nil && failFast {
+				once.Do(func() {
+					firstErr = err
+					cancel()
+				})
+			}
+		}(i, acc)
+	}
+	wg.Wait()
+
+	return results, firstErr
+}
+
+// HasAdapter tells if the custodians can be reached with the named adapter, the default one when it's empty
+func (c *CustodianSvc) HasAdapter(name string) bool {
+	_, err := c.adapters.Get(name)
+	return err == nil
+}
+
+// BreakerStates returns the circuit breaker state of each custodian fetched so far
+func (c *CustodianSvc) BreakerStates() []*BreakerState {
+	return c.breakers.states()
+}
+
+// fetchOne fetches a single custodian, from the cache when there's one
+func (c *CustodianSvc) fetchOne(ctx context.Context, acc *Account) (*model.Custodian, error) {
+	if c.cacher != nil {
+		return c.fetchCached(ctx, acc)
+	}
+	entry, err := c.fetchDirect(ctx, acc, nil)
+	if err != nil {
+		return nil, err
 	}
+	return entry.Custodian, nil
+}
 
-	return results, nil
+// fetchDirect fetches a single custodian with its adapter, unless the circuit breaker of the account is open.
+// The cached entry, if any, lets the adapter fetch only what changed.
+func (c *CustodianSvc) fetchDirect(ctx context.Context, acc *Account, cached *CacheEntry) (*CacheEntry, error) {
+	adapter, err := c.adapters.Get(acc.Adapter)
+	if err != nil {
+		return nil, err
+	}
+	key := acc.Key()
+	if err := c.breakers.allow(key); err != nil {
+		return nil, err
+	}
+	entry, err := fetchWithAdapter(ctx, adapter, acc, cached)
+	c.breakers.record(key, err)
+	return entry, err
 }
@@ -2,7 +2,13 @@ package service
 
 import (
 	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestCustodianSvc_FetchFromCustodian_fetch1(t *testing.T) {
@@ -62,3 +68,126 @@ func TestCustodianSvc_FetchFromCustodian_wrong_status_code(t *testing.T) {
 		t.Error("wrong status_code should return an error")
 	}
 }
+
+// newSlowCustodianServer serves custodians after a delay, failing for the IDs in failing
+func newSlowCustodianServer(delay func(id int) time.Duration, failing ...int) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		id, _ := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/custodian/"))
+		for _, f := range failing {
+			if f == id {
+				http.Error(rw, "boom", http.StatusInternalServerError)
+				return
+			}
+		}
+		select {
+		case <-time.After(delay(id)):
+		case <-r.Context().Done():
+			return
+		}
+		fmt.Fprintf(rw, `{"id":%d}`, id)
+	}))
+}
+
+func TestCustodianSvc_FetchFromCustodian_concurrent_order(t *testing.T) {
+	// the first custodians are the slowest, so they complete last
+	ts := newSlowCustodianServer(func(id int) time.Duration {
+		return time.Duration(10-id) * 10 * time.Millisecond
+	})
+	defer ts.Close()
+
+	svc := NewCustodianSvc(ts.URL+"/custodian/", WithConcurrency(3))
+
+	custIds := []int32{1, 2, 3, 4, 5, 6, 7, 8}
+	res, err := svc.FetchFromCustodian(context.Background(), custIds...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, c := range res {
+		if c.ID != custIds[i] {
+			t.Errorf("custodians in wrong order: got %d, expected %d", c.ID, custIds[i])
+		}
+	}
+}
+
+func TestCustodianSvc_FetchFromCustodian_cancels_on_failure(t *testing.T) {
+	ts := newSlowCustodianServer(func(id int) time.Duration {
+		return 10 * time.Second
+	}, 2)
+	defer ts.Close()
+
+	svc := NewCustodianSvc(ts.URL+"/custodian/", WithConcurrency(4))
+
+	start := time.Now()
+	_, err := svc.FetchFromCustodian(context.Background(), 1, 2, 3, 4)
+	if err == nil {
+		t.Fatal("a failing custodian should return an error")
+	}
+	if strings.Contains(err.Error(), "canceled") {
+		t.Errorf("expected the custodian error, got %v", err)
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Error("outstanding requests weren't cancelled")
+	}
+}
+
+func TestCustodianSvc_FetchAll_partial(t *testing.T) {
+	ts := newSlowCustodianServer(func(id int) time.Duration {
+		return 0
+	}, 3)
+	defer ts.Close()
+
+	svc := NewCustodianSvc(ts.URL+"/custodian/", WithConcurrency(2))
+
+	res := svc.FetchAll(context.Background(), 1, 2, 3, 4)
+	if len(res) != 4 {
+		t.Fatal("len != 4")
+	}
+	for i, r := range res {
+		if r.ID != int32(i+1) {
+			t.Errorf("results in wrong order: got %d, expected %d", r.ID, i+1)
+		}
+		if r.ID == 3 {
+			if r.Err == nil {
+				t.Error("custodian 3 should have failed")
+			}
+			continue
+		}
+		if r.Err != nil || r.Custodian.ID != r.ID {
+			t.Errorf("custodian %d should have been fetched: %v", r.ID, r.Err)
+		}
+	}
+}
+
+func TestCustodianResult_Status(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/custodian/1":
+			fmt.Fprint(rw, `{"id":1}`)
+		case "/custodian/2":
+			http.Error(rw, "unavailable", http.StatusServiceUnavailable)
+		case "/custodian/3":
+			fmt.Fprint(rw, `{"id":`)
+		case "/custodian/4":
+			time.Sleep(200 * time.Millisecond)
+			fmt.Fprint(rw, `{"id":4}`)
+		}
+	}))
+	defer ts.Close()
+
+	// a retry of the 503 could run out of time
+	svc := NewCustodianSvc(ts.URL+"/custodian/", WithRetryPolicy(RetryPolicy{MaxAttempts: 1}))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	want := []string{StatusOK, StatusHTTPError, StatusDecodeError, StatusTimeout}
+	for i, res := range svc.FetchAll(ctx, 1, 2, 3, 4) {
+		status := res.Status()
+		if status.Status != want[i] {
+			t.Errorf("custodian %d: got status %s, expected %s (%v)", res.ID, status.Status, want[i], res.Err)
+		}
+		if status.Status == StatusHTTPError && status.HTTPStatus != http.StatusServiceUnavailable {
+			t.Errorf("custodian %d: got http status %d", res.ID, status.HTTPStatus)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package service
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"sort"
+	"time"
+
+	"github.com/bottlepay/portfolio-data/model"
+	"github.com/shopspring/decimal"
+)
+
+// leg is a movement of funds read from an exchange API, before it becomes a model.Transaction
+type leg struct {
+	time      time.Time
+	asset     string
+	amount    decimal.Decimal
+	direction string
+	// the two legs of a trade share the same non-empty pair key
+	pair string
+}
+
+// buildTransactions orders the legs by time and numbers them from 1, like the mock data service does.
+// The two legs of each trade are linked as an internal asset exchange of the custodian,
+// a trade missing one of its legs is kept as an external movement.
+func buildTransactions(custID int32, legs []*leg) []*model.Transaction {
+	sort.SliceStable(legs, func(i, j int) bool {
+		return legs[i].time.Before(legs[j].time)
+	})
+
+	txs := make([]*model.Transaction, len(legs))
+	pairs := make(map[string][]int)
+	for i, l := range legs {
+		txs[i] = &model.Transaction{
+			ID:        int32(i + 1),
+			Asset:     l.asset,
+			Amount:    l.amount,
+			Direction: l.direction,
+			Timestamp: l.time.UTC(),
+		}
+		if l.pair != "" {
+			pairs[l.pair] = append(pairs[l.pair], i)
+		}
+	}
+
+	for _, idx := range pairs {
+		if len(idx) != 2 || txs[idx[0]].Direction == txs[idx[1]].Direction {
+			continue
+		}
+		a, b := txs[idx[0]], txs[idx[1]]
+		a.RelatedCustodianID, a.RelatedCustodianTransactionID = custID, b.ID
+		b.RelatedCustodianID, b.RelatedCustodianTransactionID = custID, a.ID
+	}
+	return txs
+}
+
+// signHMAC returns the hex encoded HMAC-SHA256 of the message, as both Coinbase and Binance sign their requests
+func signHMAC(secret, message string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(message))
+	return hex.EncodeToString(mac.Sum(nil))
+}
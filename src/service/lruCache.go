@@ -0,0 +1,107 @@
+package service
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+)
+
+// LRUCache is an in-memory CustodianCache holding a limited number of accounts.
+// The least recently used account is evicted first, and entries expire after a TTL.
+type LRUCache struct {
+	size int
+	ttl  time.Duration
+	now  func() time.Time
+
+	entries map[AccountKey]*list.Element
+	// most recently used first
+	order *list.List
+
+	l sync.Mutex
+}
+
+type lruItem struct {
+	key   AccountKey
+	entry *CacheEntry
+}
+
+// NewLRUCache creates a cache of size accounts, which expire ttl after being fetched.
+// A ttl of 0 never expires the entries.
+func NewLRUCache(size int, ttl time.Duration) *LRUCache {
+	if size < 1 {
+		size = 1
+	}
+	return &LRUCache{
+		size:    size,
+		ttl:     ttl,
+		now:     time.Now,
+		entries: make(map[AccountKey]*list.Element),
+		order:   list.New(),
+	}
+}
+
+func (c *LRUCache) Get(ctx context.Context, key AccountKey) (*CacheEntry, error) {
+	c.l.Lock()
+	defer c.l.Unlock()
+
+	elt, found := c.entries[key]
+	if !found {
+		return nil, nil
+	}
+	item := elt.Value.(*lruItem)
+	if c.ttl > 0 && c.now().Sub(item.entry.FetchedAt) >= c.ttl {
+		c.remove(elt)
+		return nil, nil
+	}
+	c.order.MoveToFront(elt)
+	return item.entry, nil
+}
+
+func (c *LRUCache) Set(ctx context.Context, key AccountKey, entry *CacheEntry) error {
+	c.l.Lock()
+	defer c.l.Unlock()
+
+	if elt, found := c.entries[key]; found {
+		elt.Value.(*lruItem).entry = entry
+		c.order.MoveToFront(elt)
+		return nil
+	}
+
+	c.entries[key] = c.order.PushFront(&lruItem{key, entry})
+	for c.order.Len() > c.size {
+		c.remove(c.order.Back())
+	}
+	return nil
+}
+
+func (c *LRUCache) Invalidate(ctx context.Context, id int32) error {
+	c.l.Lock()
+	defer c.l.Unlock()
+
+	for key, elt := range c.entries {
+		if key.ID == id {
+			c.remove(elt)
+		}
+	}
+	return nil
+}
+
+// Len returns the number of cached accounts, including expired ones not evicted yet
+func (c *LRUCache) Len() int {
+	c.l.Lock()
+	defer c.l.Unlock()
+
+	return c.order.Len()
+}
+
+// remove must be called with the lock held
+func (c *LRUCache) remove(elt *list.Element) {
+	c.order.Remove(elt)
+	delete(c.entries, elt.Value.(*lruItem).key)
+}
+
+func init() {
+	// Check interface implementation
+	var _ CustodianCache = (*LRUCache)(nil)
+}
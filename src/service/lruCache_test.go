@@ -0,0 +1,79 @@
+package service
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/bottlepay/portfolio-data/model"
+)
+
+func TestLRUCache(t *testing.T) {
+	now := time.Date(2021, 5, 20, 12, 0, 0, 0, time.UTC)
+	ctx := context.Background()
+
+	cache := NewLRUCache(2, time.Minute)
+	cache.now = func() time.Time { return now }
+
+	entry := func(id int32) *CacheEntry {
+		return &CacheEntry{Custodian: &model.Custodian{ID: id}, FetchedAt: now}
+	}
+	key := func(id int32) AccountKey {
+		return AccountKey{ID: id, Adapter: DefaultAdapter}
+	}
+
+	cache.Set(ctx, key(1), entry(1))
+	cache.Set(ctx, key(2), entry(2))
+	// 1 becomes the most recently used, so 2 is evicted by 3
+	if e, _ := cache.Get(ctx, key(1)); e == nil || e.Custodian.ID != 1 {
+		t.Fatalf("custodian 1 should be cached, got %v", e)
+	}
+	cache.Set(ctx, key(3), entry(3))
+
+	if e, _ := cache.Get(ctx, key(2)); e != nil {
+		t.Error("custodian 2 should have been evicted")
+	}
+	if cache.Len() != 2 {
+		t.Errorf("expected 2 cached custodians, got %d", cache.Len())
+	}
+
+	cache.Invalidate(ctx, 3)
+	if e, _ := cache.Get(ctx, key(3)); e != nil {
+		t.Error("custodian 3 should have been invalidated")
+	}
+
+	now = now.Add(time.Minute)
+	if e, _ := cache.Get(ctx, key(1)); e != nil {
+		t.Error("custodian 1 should have expired")
+	}
+	if cache.Len() != 0 {
+		t.Errorf("expected an empty cache, got %d custodians", cache.Len())
+	}
+}
+
+func TestLRUCache_accounts(t *testing.T) {
+	ctx := context.Background()
+	cache := NewLRUCache(10, 0)
+
+	first := AccountKey{ID: 1, Adapter: "coinbase", Credentials: "first"}
+	second := AccountKey{ID: 1, Adapter: "coinbase", Credentials: "second"}
+	other := AccountKey{ID: 2, Adapter: "coinbase", Credentials: "first"}
+	for _, key := range []AccountKey{first, second, other} {
+		cache.Set(ctx, key, &CacheEntry{Custodian: &model.Custodian{ID: key.ID}})
+	}
+	if cache.Len() != 3 {
+		t.Fatalf("expected an entry per account, got %d", cache.Len())
+	}
+
+	// every account of the custodian is invalidated
+	cache.Invalidate(ctx, 1)
+	if e, _ := cache.Get(ctx, first); e != nil {
+		t.Error("the first account should have been invalidated")
+	}
+	if e, _ := cache.Get(ctx, second); e != nil {
+		t.Error("the second account should have been invalidated")
+	}
+	if e, _ := cache.Get(ctx, other); e == nil {
+		t.Error("the other custodian should still be cached")
+	}
+}
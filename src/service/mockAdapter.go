@@ -0,0 +1,190 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/bottlepay/portfolio-data/model"
+)
+
+// MockAdapter reaches the custodians of the mock Wallet/Exchange data service, at the base URL + ID.
+// The optional "token" credential is sent as a bearer token.
+type MockAdapter struct {
+	url  string
+	http HTTPDoer
+	// number of new transactions fetched per request, 0 for all of them
+	pageSize int
+}
+
+// NewMockAdapter creates a MockAdapter for the data service at the base URL
+func NewMockAdapter(u string, doer HTTPDoer, pageSize int) *MockAdapter {
+	return &MockAdapter{url: u, http: doer, pageSize: pageSize}
+}
+
+func (a *MockAdapter) Capabilities() Capabilities {
+	return Capabilities{
+		Transactions:            true,
+		IncrementalTransactions: true,
+		ConditionalRequests:     true,
+	}
+}
+
+func (a *MockAdapter) FetchBalances(ctx context.Context, acc *Account) ([]*model.Asset, error) {
+	// there are no transactions after the last possible ID, only the balances are sent
+	query := url.Values{"since": {strconv.Itoa(math.MaxInt32)}}
+	entry, _, err := a.request(ctx, acc, query, nil)
+	if err != nil {
+		return nil, err
+	}
+	return entry.Custodian.Assets, nil
+}
+
+// FetchTransactions uses the ID of the last transaction as cursor
+func (a *MockAdapter) FetchTransactions(ctx context.Context, acc *Account, cursor string) (*TransactionsPage, error) {
+	query := url.Values{}
+	if cursor != "" {
+		query.Set("since", cursor)
+	}
+	if a.pageSize > 0 {
+		query.Set("limit", strconv.Itoa(a.pageSize))
+	}
+	entry, lastTxID, err := a.request(ctx, acc, query, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	page := &TransactionsPage{Transactions: entry.Custodian.Transactions, Cursor: cursor}
+	if len(page.Transactions) > 0 {
+		pageLastTxID := entry.Custodian.LastTransactionID()
+		page.Cursor = strconv.Itoa(int(pageLastTxID))
+		page.More = pageLastTxID < lastTxID
+	}
+	return page, nil
+}
+
+// FetchCustodian fetches the balances and transactions at once. With a cached entry, the first request
+// is conditional, and only the transactions after the cached ones are fetched, page by page.
+func (a *MockAdapter) FetchCustodian(ctx context.Context, acc *Account, cached *CacheEntry) (*CacheEntry, error) {
+	// only the first request is conditional, the validators apply to the whole custodian
+	entry, lastTxID, err := a.sync(ctx, acc, cached, true)
+	if err != nil {
+		return nil, err
+	}
+
+	for lastTxID > entry.Custodian.LastTransactionID() {
+		next, nextLastTxID, err := a.sync(ctx, acc, entry, false)
+		if err != nil {
+			return nil, err
+		}
+		progressed := next.Custodian.LastTransactionID() > entry.Custodian.LastTransactionID()
+		entry, lastTxID = next, nextLastTxID
+		// the custodian didn't send the transactions it announced, don't loop forever
+		if !progressed {
+			break
+		}
+	}
+	return entry, nil
+}
+
+// sync asks for the transactions after the cached ones, and merges them into a copy of the cached custodian.
+// It returns the last transaction ID announced by the custodian, or -1 when it doesn't support paging.
+func (a *MockAdapter) sync(ctx context.Context, acc *Account, cached *CacheEntry, conditional bool) (*CacheEntry, int32, error) {
+	var query url.Values
+	var validators *CacheEntry
+	if cached != nil {
+		query = url.Values{"since": {strconv.Itoa(int(cached.Custodian.LastTransactionID()))}}
+		if a.pageSize > 0 {
+			query.Set("limit", strconv.Itoa(a.pageSize))
+		}
+		if conditional {
+			validators = cached
+		}
+	}
+
+	entry, lastTxID, err := a.request(ctx, acc, query, validators)
+	if err != nil {
+		return nil, -1, err
+	}
+	// not modified, or the custodian ignored since and sent all the transactions
+	if lastTxID < 0 {
+		return entry, -1, nil
+	}
+	if cached != nil {
+		entry.Custodian = mergeTransactions(cached.Custodian, entry.Custodian)
+	}
+	return entry, lastTxID, nil
+}
+
+// request runs the HTTP request for a single custodian, conditional when validators are given.
+// It returns the last transaction ID announced by the custodian, or -1 when there's none.
+func (a *MockAdapter) request(ctx context.Context, acc *Account, query url.Values, validators *CacheEntry) (*CacheEntry, int32, error) {
+	custURL := a.url + strconv.Itoa(int(acc.ID))
+	if len(query) > 0 {
+		custURL += "?" + query.Encode()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", custURL, nil)
+	if err != nil {
+		return nil, -1, fmt.Errorf("Custodian GET request Error: %v", err)
+	}
+	if token := acc.Credentials["token"]; token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	if validators != nil {
+		if validators.ETag != "" {
+			req.Header.Set("If-None-Match", validators.ETag)
+		}
+		if validators.LastModified != "" {
+			req.Header.Set("If-Modified-Since", validators.LastModified)
+		}
+	}
+
+	res, err := a.http.Do(req)
+	if err != nil {
+		return nil, -1, fmt.Errorf("Custodian GET Error: %w", err)
+	}
+	defer res.Body.Close()
+
+	entry := &CacheEntry{
+		ETag:         res.Header.Get("ETag"),
+		LastModified: res.Header.Get("Last-Modified"),
+	}
+
+	if res.StatusCode == http.StatusNotModified && validators != nil {
+		entry.Custodian = validators.Custodian
+		// a 304 doesn't have to repeat the validators
+		if entry.ETag == "" {
+			entry.ETag = validators.ETag
+		}
+		if entry.LastModified == "" {
+			entry.LastModified = validators.LastModified
+		}
+		return entry, -1, nil
+	}
+
+	if res.StatusCode != 200 {
+		return nil, -1, &HTTPStatusError{res.StatusCode}
+	}
+
+	entry.Custodian = &model.Custodian{}
+	if err = json.NewDecoder(res.Body).Decode(entry.Custodian); err != nil {
+		return nil, -1, &DecodeError{err}
+	}
+
+	lastTxID, err := strconv.ParseInt(res.Header.Get("X-Last-Transaction-Id"), 10, 32)
+	if err != nil {
+		return entry, -1, nil
+	}
+	return entry, int32(lastTxID), nil
+}
+
+func init() {
+	// Check interface implementation
+	var _ CustodianAdapter = (*MockAdapter)(nil)
+	var _ CustodianFetcher = (*MockAdapter)(nil)
+}
@@ -0,0 +1,54 @@
+package service
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"testing"
+
+	"github.com/bottlepay/portfolio-data/model"
+)
+
+func TestMockAdapter(t *testing.T) {
+	cust := newFakeCustodian(1, 5)
+
+	var l sync.Mutex
+	var queries []string
+	ts := newPagingCustodianServer(cust, &l, &queries)
+	defer ts.Close()
+
+	a := NewMockAdapter(ts.URL+"/custodian/", http.DefaultClient, 2)
+	acc := &Account{ID: 1}
+
+	assets, err := a.FetchBalances(context.Background(), acc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(assets) != 1 || assets[0].Balance.IntPart() != 5 {
+		t.Errorf("unexpected balances %v", assets)
+	}
+
+	var txs []*model.Transaction
+	cursor := ""
+	for {
+		page, err := a.FetchTransactions(context.Background(), acc, cursor)
+		if err != nil {
+			t.Fatal(err)
+		}
+		txs = append(txs, page.Transactions...)
+		cursor = page.Cursor
+		if !page.More {
+			break
+		}
+	}
+	if len(txs) != 5 || cursor != "5" {
+		t.Errorf("expected 5 transactions up to cursor 5, got %d up to %s", len(txs), cursor)
+	}
+
+	l.Lock()
+	defer l.Unlock()
+	// the balances, then 3 pages of 2 transactions
+	if len(queries) != 4 {
+		t.Errorf("unexpected queries %v", queries)
+	}
+}
@@ -0,0 +1,293 @@
+package service
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ErrCacheUnavailable is returned while the cache server can't be reached
+var ErrCacheUnavailable = errors.New("custodian cache unavailable")
+
+const (
+	// redisTimeout bounds each command, the cache must never be slower than the custodians
+	redisTimeout = 200 * time.Millisecond
+	// redisRetryDelay is how long the cache is bypassed after a connection error
+	redisRetryDelay = 5 * time.Second
+	redisMaxIdle    = 8
+)
+
+// RedisCache is a CustodianCache shared by several trackers, stored in a server speaking the Redis protocol.
+// The custodians are stored as JSON, which keeps the decimals as strings so they don't lose precision.
+type RedisCache struct {
+	addr     string
+	password string
+	prefix   string
+	ttl      time.Duration
+	now      func() time.Time
+
+	// idle connections
+	conns chan *redisConn
+
+	// the cache is bypassed until this time after a connection error
+	downUntil time.Time
+	l         sync.Mutex
+}
+
+type redisConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+// NewRedisCache creates a cache on the Redis server at addr, whose entries expire ttl after being fetched.
+// A ttl of 0 never expires the entries. An empty password skips authentication.
+func NewRedisCache(addr, password string, ttl time.Duration) *RedisCache {
+	return &RedisCache{
+		addr:     addr,
+		password: password,
+		prefix:   "portfolio:custodian:",
+		ttl:      ttl,
+		now:      time.Now,
+		conns:    make(chan *redisConn, redisMaxIdle),
+	}
+}
+
+func (c *RedisCache) key(key AccountKey) string {
+	return c.prefix + key.String()
+}
+
+// accountsKey is the set of the cached accounts of the custodian, so that they can be invalidated together
+func (c *RedisCache) accountsKey(id int32) string {
+	return c.prefix + "accounts:" + strconv.Itoa(int(id))
+}
+
+func (c *RedisCache) Get(ctx context.Context, key AccountKey) (*CacheEntry, error) {
+	reply, err := c.do(ctx, "GET", c.key(key))
+	if err != nil || reply == nil {
+		return nil, err
+	}
+	data, ok := reply.([]byte)
+	if !ok {
+		return nil, fmt.Errorf("redis GET: unexpected reply %v", reply)
+	}
+
+	entry := &CacheEntry{}
+	if err := json.Unmarshal(data, entry); err != nil {
+		return nil, fmt.Errorf("redis GET JSON: %v", err)
+	}
+	return entry, nil
+}
+
+func (c *RedisCache) Set(ctx context.Context, key AccountKey, entry *CacheEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	args := []string{"SET", c.key(key), string(data)}
+	if c.ttl > 0 {
+		// the entry may be stored some time after it was fetched
+		ttl := c.ttl - c.now().Sub(entry.FetchedAt)
+		if ttl <= 0 {
+			return nil
+		}
+		args = append(args, "PX", strconv.FormatInt(int64(ttl/time.Millisecond)+1, 10))
+	}
+	if _, err := c.do(ctx, args...); err != nil {
+		return err
+	}
+
+	if _, err := c.do(ctx, "SADD", c.accountsKey(key.ID), c.key(key)); err != nil {
+		return err
+	}
+	if c.ttl > 0 {
+		// the set outlives the entries added to it
+		_, err = c.do(ctx, "PEXPIRE", c.accountsKey(key.ID), strconv.FormatInt(int64(c.ttl/time.Millisecond)+1, 10))
+	}
+	return err
+}
+
+func (c *RedisCache) Invalidate(ctx context.Context, id int32) error {
+	reply, err := c.do(ctx, "SMEMBERS", c.accountsKey(id))
+	if err != nil {
+		return err
+	}
+	members, ok := reply.([]interface{})
+	if !ok {
+		return fmt.Errorf("redis SMEMBERS: unexpected reply %v", reply)
+	}
+
+	args := []string{"DEL", c.accountsKey(id)}
+	for _, member := range members {
+		if key, ok := member.([]byte); ok {
+			args = append(args, string(key))
+		}
+	}
+	_, err = c.do(ctx, args...)
+	return err
+}
+
+// do runs a command and returns its reply: nil, string, int64, []byte or []interface{}
+func (c *RedisCache) do(ctx context.Context, args ...string) (interface{}, error) {
+	c.l.Lock()
+	down := c.now().Before(c.downUntil)
+	c.l.Unlock()
+	if down {
+		return nil, ErrCacheUnavailable
+	}
+
+	conn, err := c.conn(ctx)
+	if err != nil {
+		c.markDown()
+		return nil, fmt.Errorf("%w: %v", ErrCacheUnavailable, err)
+	}
+
+	reply, err := conn.do(ctx, args...)
+	var redisErr redisError
+	switch {
+	case err == nil:
+		c.release(conn)
+	case errors.As(err, &redisErr):
+		// the connection is still usable after an error reply
+		c.release(conn)
+	default:
+		conn.Close()
+		c.markDown()
+	}
+	return reply, err
+}
+
+func (c *RedisCache) markDown() {
+	c.l.Lock()
+	defer c.l.Unlock()
+	c.downUntil = c.now().Add(redisRetryDelay)
+}
+
+// conn returns an idle connection, or dials a new one
+func (c *RedisCache) conn(ctx context.Context) (*redisConn, error) {
+	select {
+	case conn := <-c.conns:
+		return conn, nil
+	default:
+	}
+
+	dialer := &net.Dialer{Timeout: redisTimeout}
+	nc, err := dialer.DialContext(ctx, "tcp", c.addr)
+	if err != nil {
+		return nil, err
+	}
+	conn := &redisConn{nc, bufio.NewReader(nc)}
+
+	if c.password != "" {
+		if _, err := conn.do(ctx, "AUTH", c.password); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// release puts the connection back in the idle pool, or closes it when the pool is full
+func (c *RedisCache) release(conn *redisConn) {
+	select {
+	case c.conns <- conn:
+	default:
+		conn.Close()
+	}
+}
+
+// Close closes the idle connections
+func (c *RedisCache) Close() error {
+	for {
+		select {
+		case conn := <-c.conns:
+			conn.Close()
+		default:
+			return nil
+		}
+	}
+}
+
+// redisError is an error reply from the server
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+// do sends the command as an array of bulk strings and reads the reply
+func (conn *redisConn) do(ctx context.Context, args ...string) (interface{}, error) {
+	deadline := time.Now().Add(redisTimeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	if err := conn.SetDeadline(deadline); err != nil {
+		return nil, err
+	}
+
+	w := bufio.NewWriter(conn)
+	fmt.Fprintf(w, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(w, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if err := w.Flush(); err != nil {
+		return nil, err
+	}
+	return readReply(conn.r)
+}
+
+// readReply reads a reply in the Redis serialization protocol (RESP)
+func readReply(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, fmt.Errorf("redis: malformed reply %q", line)
+	}
+	kind, line := line[0], line[1:len(line)-2]
+
+	switch kind {
+	case '+':
+		return line, nil
+	case '-':
+		return nil, redisError(line)
+	case ':':
+		return strconv.ParseInt(line, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, err
+		}
+		return data[:n], nil
+	case '*':
+		n, err := strconv.Atoi(line)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		items := make([]interface{}, n)
+		for i := range items {
+			if items[i], err = readReply(r); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("redis: unknown reply type %q", kind)
+}
+
+func init() {
+	// Check interface implementation
+	var _ CustodianCache = (*RedisCache)(nil)
+}
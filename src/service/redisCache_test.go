@@ -0,0 +1,272 @@
+package service
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bottlepay/portfolio-data/model"
+	"github.com/shopspring/decimal"
+)
+
+// fakeRedis is an in-process server speaking enough of the Redis protocol for RedisCache
+type fakeRedis struct {
+	ln       net.Listener
+	password string
+
+	data    map[string]string
+	sets    map[string]map[string]bool
+	expires map[string]time.Time
+	l       sync.Mutex
+}
+
+func newFakeRedis(t *testing.T, password string) *fakeRedis {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeRedis{
+		ln:       ln,
+		password: password,
+		data:     make(map[string]string),
+		sets:     make(map[string]map[string]bool),
+		expires:  make(map[string]time.Time),
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *fakeRedis) Addr() string {
+	return s.ln.Addr().String()
+}
+
+func (s *fakeRedis) Close() {
+	s.ln.Close()
+}
+
+func (s *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	authenticated := s.password == ""
+
+	for {
+		reply, err := readReply(r)
+		if err != nil {
+			return
+		}
+		var args []string
+		for _, arg := range reply.([]interface{}) {
+			args = append(args, string(arg.([]byte)))
+		}
+
+		switch {
+		case strings.ToUpper(args[0]) == "AUTH":
+			authenticated = args[1] == s.password
+			if !authenticated {
+				fmt.Fprint(conn, "-WRONGPASS invalid password\r\n")
+				continue
+			}
+			fmt.Fprint(conn, "+OK\r\n")
+		case !authenticated:
+			fmt.Fprint(conn, "-NOAUTH Authentication required.\r\n")
+		default:
+			fmt.Fprint(conn, s.exec(args))
+		}
+	}
+}
+
+func (s *fakeRedis) exec(args []string) string {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	for _, key := range args[1:] {
+		if exp, found := s.expires[key]; found && time.Now().After(exp) {
+			delete(s.data, key)
+			delete(s.sets, key)
+			delete(s.expires, key)
+		}
+	}
+
+	key := args[1]
+	switch strings.ToUpper(args[0]) {
+	case "GET":
+		v, found := s.data[key]
+		if !found {
+			return "$-1\r\n"
+		}
+		return fmt.Sprintf("$%d\r\n%s\r\n", len(v), v)
+	case "SET":
+		s.data[key] = args[2]
+		delete(s.expires, key)
+		if len(args) == 5 && strings.ToUpper(args[3]) == "PX" {
+			ms, _ := strconv.Atoi(args[4])
+			s.expires[key] = time.Now().Add(time.Duration(ms) * time.Millisecond)
+		}
+		return "+OK\r\n"
+	case "PEXPIRE":
+		ms, _ := strconv.Atoi(args[2])
+		s.expires[key] = time.Now().Add(time.Duration(ms) * time.Millisecond)
+		return ":1\r\n"
+	case "SADD":
+		if s.sets[key] == nil {
+			s.sets[key] = make(map[string]bool)
+		}
+		for _, member := range args[2:] {
+			s.sets[key][member] = true
+		}
+		return fmt.Sprintf(":%d\r\n", len(args)-2)
+	case "SMEMBERS":
+		reply := fmt.Sprintf("*%d\r\n", len(s.sets[key]))
+		for member := range s.sets[key] {
+			reply += fmt.Sprintf("$%d\r\n%s\r\n", len(member), member)
+		}
+		return reply
+	case "DEL":
+		deleted := 0
+		for _, key := range args[1:] {
+			_, data := s.data[key]
+			_, set := s.sets[key]
+			if data || set {
+				deleted++
+			}
+			delete(s.data, key)
+			delete(s.sets, key)
+			delete(s.expires, key)
+		}
+		return fmt.Sprintf(":%d\r\n", deleted)
+	}
+	return "-ERR unknown command\r\n"
+}
+
+func TestRedisCache(t *testing.T) {
+	srv := newFakeRedis(t, "secret")
+	defer srv.Close()
+
+	ctx := context.Background()
+	cache := NewRedisCache(srv.Addr(), "secret", time.Minute)
+	key := AccountKey{ID: 1, Adapter: DefaultAdapter}
+	defer cache.Close()
+
+	if e, err := cache.Get(ctx, key); e != nil || err != nil {
+		t.Fatalf("empty cache: got %v, %v", e, err)
+	}
+
+	// more digits than a float64 can hold
+	balance := decimal.RequireFromString("12345678901234567890.123456789012345678")
+	fetchedAt := time.Now().UTC().Truncate(time.Millisecond)
+	err := cache.Set(ctx, key, &CacheEntry{
+		Custodian: &model.Custodian{ID: 1, Assets: []*model.Asset{{Code: "BTC", Balance: balance}}},
+		FetchedAt: fetchedAt,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e, err := cache.Get(ctx, key)
+	if err != nil || e == nil {
+		t.Fatalf("custodian 1 should be cached: got %v, %v", e, err)
+	}
+	if !e.Custodian.Assets[0].Balance.Equal(balance) {
+		t.Errorf("balance lost precision: got %s, want %s", e.Custodian.Assets[0].Balance, balance)
+	}
+	if !e.FetchedAt.Equal(fetchedAt) {
+		t.Errorf("got fetch time %v, want %v", e.FetchedAt, fetchedAt)
+	}
+
+	// the other accounts of the custodian are invalidated with it
+	other := AccountKey{ID: 1, Adapter: "coinbase", Credentials: "hash"}
+	if err := cache.Set(ctx, other, &CacheEntry{Custodian: &model.Custodian{ID: 1}, FetchedAt: fetchedAt}); err != nil {
+		t.Fatal(err)
+	}
+	if e, _ := cache.Get(ctx, other); e == nil || len(e.Custodian.Assets) != 0 {
+		t.Fatalf("the other account should have its own entry, got %+v", e)
+	}
+
+	if err := cache.Invalidate(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+	if e, _ := cache.Get(ctx, key); e != nil {
+		t.Error("custodian 1 should have been invalidated")
+	}
+	if e, _ := cache.Get(ctx, other); e != nil {
+		t.Error("the other account of custodian 1 should have been invalidated")
+	}
+}
+
+func TestRedisCache_expiry(t *testing.T) {
+	srv := newFakeRedis(t, "")
+	defer srv.Close()
+
+	ctx := context.Background()
+	cache := NewRedisCache(srv.Addr(), "", 50*time.Millisecond)
+	key := AccountKey{ID: 1, Adapter: DefaultAdapter}
+	defer cache.Close()
+
+	cache.Set(ctx, key, &CacheEntry{Custodian: &model.Custodian{ID: 1}, FetchedAt: time.Now()})
+	if e, _ := cache.Get(ctx, key); e == nil {
+		t.Fatal("custodian 1 should be cached")
+	}
+	time.Sleep(100 * time.Millisecond)
+	if e, _ := cache.Get(ctx, key); e != nil {
+		t.Error("custodian 1 should have expired")
+	}
+}
+
+func TestRedisCache_wrong_password(t *testing.T) {
+	srv := newFakeRedis(t, "secret")
+	defer srv.Close()
+
+	cache := NewRedisCache(srv.Addr(), "wrong", time.Minute)
+	key := AccountKey{ID: 1, Adapter: DefaultAdapter}
+	if _, err := cache.Get(context.Background(), key); !errors.Is(err, ErrCacheUnavailable) {
+		t.Errorf("expected ErrCacheUnavailable, got %v", err)
+	}
+}
+
+func TestCustodianSvc_redis_unreachable(t *testing.T) {
+	// nothing listens there once the listener is closed
+	srv := newFakeRedis(t, "")
+	addr := srv.Addr()
+	srv.Close()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(rw, `{"id":1}`)
+	}))
+	defer ts.Close()
+
+	cache := NewRedisCache(addr, "", time.Minute)
+	key := AccountKey{ID: 1, Adapter: DefaultAdapter}
+	svc := NewCustodianSvc(ts.URL+"/custodian/", WithCache(cache, DefaultCachePolicy()))
+
+	for i := 0; i < 2; i++ {
+		res, err := svc.FetchFromCustodian(context.Background(), 1)
+		if err != nil {
+			t.Fatalf("an unreachable cache should be bypassed: %v", err)
+		}
+		if res[0].ID != 1 {
+			t.Errorf("Wrong custodian: %d", res[0].ID)
+		}
+	}
+
+	// the cache is bypassed without trying to connect again
+	if _, err := cache.Get(context.Background(), key); err != ErrCacheUnavailable {
+		t.Errorf("expected ErrCacheUnavailable, got %v", err)
+	}
+}
@@ -0,0 +1,154 @@
+package service
+
+import (
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// RetryPolicy describes how failed custodian requests are retried
+type RetryPolicy struct {
+	// MaxAttempts is the total number of attempts, 1 disables retries
+	MaxAttempts int
+	// BaseDelay is the delay before the first retry, it doubles with each attempt
+	BaseDelay time.Duration
+	// MaxDelay caps the exponential backoff
+	MaxDelay time.Duration
+	// Jitter is the fraction (0 to 1) of each delay which is randomized
+	Jitter float64
+	// RetryableStatusCodes are the HTTP status codes worth retrying
+	RetryableStatusCodes []int
+}
+
+// DefaultRetryPolicy retries transient errors twice, starting with a 100ms delay
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts: 3,
+		BaseDelay:   100 * time.Millisecond,
+		MaxDelay:    2 * time.Second,
+		Jitter:      0.5,
+		RetryableStatusCodes: []int{
+			http.StatusTooManyRequests,
+			http.StatusBadGateway,
+			http.StatusServiceUnavailable,
+			http.StatusGatewayTimeout,
+		},
+	}
+}
+
+// WithRetryPolicy sets the retry policy used for custodian requests
+func WithRetryPolicy(p RetryPolicy) CustodianSvcOption {
+	return func(c *CustodianSvc) {
+		c.http.policy = p.normalized()
+	}
+}
+
+// WithHTTPClient sets the HTTP client used for custodian requests
+func WithHTTPClient(client *http.Client) CustodianSvcOption {
+	return func(c *CustodianSvc) {
+		c.http.client = client
+	}
+}
+
+// RetryingClient runs HTTP requests, retrying them according to a RetryPolicy
+type RetryingClient struct {
+	client *http.Client
+	policy RetryPolicy
+}
+
+// NewRetryingClient creates a RetryingClient sending its requests with client
+func NewRetryingClient(client *http.Client, p RetryPolicy) *RetryingClient {
+	return &RetryingClient{client: client, policy: p.normalized()}
+}
+
+func (p RetryPolicy) normalized() RetryPolicy {
+	if p.MaxAttempts < 1 {
+		p.MaxAttempts = 1
+	}
+	return p
+}
+
+func (p RetryPolicy) isRetryableStatus(code int) bool {
+	for _, each := range p.RetryableStatusCodes {
+		if each == code {
+			return true
+		}
+	}
+	return false
+}
+
+// backoff returns the delay to wait before the retry following attempt n (starting at 1)
+func (p RetryPolicy) backoff(n int) time.Duration {
+	delay := p.BaseDelay
+	for i := 1; i < n && delay < p.MaxDelay; i++ {
+		delay *= 2
+	}
+	if p.MaxDelay > 0 && delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+	if p.Jitter > 0 {
+		delay -= time.Duration(float64(delay) * p.Jitter * rand.Float64())
+	}
+	return delay
+}
+
+// parseRetryAfter reads a Retry-After header, given in seconds or as an HTTP date
+func parseRetryAfter(h string, now time.Time) (time.Duration, bool) {
+	if h == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(h); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if date, err := http.ParseTime(h); err == nil {
+		if d := date.Sub(now); d > 0 {
+			return d, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+// Do runs the request, retrying network errors and retryable status codes according to the policy.
+// It gives up early when the next attempt wouldn't start before the context deadline.
+func (c *RetryingClient) Do(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+
+	for attempt := 1; ; attempt++ {
+		res, err := c.client.Do(req)
+
+		retryable := false
+		delay := c.policy.backoff(attempt)
+		switch {
+		case err != nil:
+			// don't retry our own cancellations and timeouts
+			retryable = ctx.Err() == nil
+		case c.policy.isRetryableStatus(res.StatusCode):
+			retryable = true
+			if after, ok := parseRetryAfter(res.Header.Get("Retry-After"), time.Now()); ok {
+				delay = after
+			}
+		}
+
+		if !retryable || attempt >= c.policy.MaxAttempts {
+			return res, err
+		}
+		if deadline, ok := ctx.Deadline(); ok && time.Now().Add(delay).After(deadline) {
+			return res, err
+		}
+
+		// the body of a response we're about to retry won't be read
+		if res != nil {
+			res.Body.Close()
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		}
+	}
+}
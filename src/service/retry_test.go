@@ -0,0 +1,147 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newFlakyCustodianServer answers with status for the first failures requests, then serves the custodian
+func newFlakyCustodianServer(failures int32, status int, retryAfter string) (*httptest.Server, *int32) {
+	var calls int32
+	ts := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) <= failures {
+			if retryAfter != "" {
+				rw.Header().Set("Retry-After", retryAfter)
+			}
+			http.Error(rw, "flaky", status)
+			return
+		}
+		fmt.Fprint(rw, `{"id":1}`)
+	}))
+	return ts, &calls
+}
+
+func TestCustodianSvc_retry_transient_status(t *testing.T) {
+	ts, calls := newFlakyCustodianServer(2, http.StatusBadGateway, "")
+	defer ts.Close()
+
+	svc := NewCustodianSvc(ts.URL+"/custodian/", WithRetryPolicy(RetryPolicy{
+		MaxAttempts:          3,
+		BaseDelay:            time.Millisecond,
+		RetryableStatusCodes: []int{http.StatusBadGateway},
+	}))
+
+	res, err := svc.FetchFromCustodian(context.Background(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res[0].ID != 1 {
+		t.Errorf("Wrong custodian: %d", res[0].ID)
+	}
+	if *calls != 3 {
+		t.Errorf("expected 3 attempts, got %d", *calls)
+	}
+}
+
+func TestCustodianSvc_retry_gives_up(t *testing.T) {
+	ts, calls := newFlakyCustodianServer(10, http.StatusServiceUnavailable, "")
+	defer ts.Close()
+
+	svc := NewCustodianSvc(ts.URL+"/custodian/", WithRetryPolicy(RetryPolicy{
+		MaxAttempts:          2,
+		BaseDelay:            time.Millisecond,
+		RetryableStatusCodes: []int{http.StatusServiceUnavailable},
+	}))
+
+	res := svc.FetchAll(context.Background(), 1)
+	if status := res[0].Status(); status.HTTPStatus != http.StatusServiceUnavailable {
+		t.Errorf("expected the last status code, got %+v", status)
+	}
+	if *calls != 2 {
+		t.Errorf("expected 2 attempts, got %d", *calls)
+	}
+}
+
+func TestCustodianSvc_retry_not_retryable(t *testing.T) {
+	ts, calls := newFlakyCustodianServer(1, http.StatusNotFound, "")
+	defer ts.Close()
+
+	svc := NewCustodianSvc(ts.URL + "/custodian/")
+
+	if _, err := svc.FetchFromCustodian(context.Background(), 1); err == nil {
+		t.Error("404 should return an error")
+	}
+	if *calls != 1 {
+		t.Errorf("404 shouldn't be retried, got %d attempts", *calls)
+	}
+}
+
+func TestCustodianSvc_retry_respects_deadline(t *testing.T) {
+	// the server asks to come back in an hour, which is past our deadline
+	ts, calls := newFlakyCustodianServer(1, http.StatusTooManyRequests, "3600")
+	defer ts.Close()
+
+	svc := NewCustodianSvc(ts.URL + "/custodian/")
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	start := time.Now()
+	if _, err := svc.FetchFromCustodian(ctx, 1); err == nil {
+		t.Error("429 should return an error when the retry can't happen before the deadline")
+	}
+	if time.Since(start) > 500*time.Millisecond {
+		t.Error("should give up immediately instead of waiting for the deadline")
+	}
+	if *calls != 1 {
+		t.Errorf("expected 1 attempt, got %d", *calls)
+	}
+}
+
+func Test_parseRetryAfter(t *testing.T) {
+	now := time.Date(2021, 5, 20, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name   string
+		header string
+		want   time.Duration
+		wantOk bool
+	}{
+		{"empty", "", 0, false},
+		{"seconds", "120", 2 * time.Minute, true},
+		{"negative", "-1", 0, false},
+		{"http date", "Thu, 20 May 2021 12:00:30 GMT", 30 * time.Second, true},
+		{"past date", "Thu, 20 May 2021 11:00:00 GMT", 0, true},
+		{"garbage", "soon", 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := parseRetryAfter(tt.header, now)
+			if got != tt.want || ok != tt.wantOk {
+				t.Errorf("parseRetryAfter() = %v, %v, want %v, %v", got, ok, tt.want, tt.wantOk)
+			}
+		})
+	}
+}
+
+func TestRetryPolicy_backoff(t *testing.T) {
+	p := RetryPolicy{BaseDelay: 100 * time.Millisecond, MaxDelay: time.Second}
+
+	want := []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond, 800 * time.Millisecond, time.Second, time.Second}
+	for i, w := range want {
+		if got := p.backoff(i + 1); got != w {
+			t.Errorf("backoff(%d) = %v, want %v", i+1, got, w)
+		}
+	}
+
+	p.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		if got := p.backoff(1); got < 50*time.Millisecond || got > 100*time.Millisecond {
+			t.Fatalf("jittered backoff(1) = %v, out of bounds", got)
+		}
+	}
+}
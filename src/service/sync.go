@@ -0,0 +1,39 @@
+package service
+
+import (
+	"github.com/bottlepay/portfolio-data/model"
+)
+
+// DefaultSyncPageSize is the number of new transactions fetched per request by default
+const DefaultSyncPageSize = 500
+
+// WithSyncPageSize sets the number of new transactions fetched per request when a cached custodian is synced.
+// 0 fetches all the new transactions at once.
+func WithSyncPageSize(n int) CustodianSvcOption {
+	return func(c *CustodianSvc) {
+		if n < 0 {
+			n = 0
+		}
+		c.syncPageSize = n
+	}
+}
+
+// mergeTransactions returns a custodian with the assets of page, and the transactions of cached
+// followed by the ones of page after its high-water mark. cached isn't modified, it may be shared.
+func mergeTransactions(cached, page *model.Custodian) *model.Custodian {
+	hwm := cached.LastTransactionID()
+
+	txs := make([]*model.Transaction, len(cached.Transactions), len(cached.Transactions)+len(page.Transactions))
+	copy(txs, cached.Transactions)
+	for _, tx := range page.Transactions {
+		if tx.ID > hwm {
+			txs = append(txs, tx)
+		}
+	}
+
+	return &model.Custodian{
+		ID:           page.ID,
+		Assets:       page.Assets,
+		Transactions: txs,
+	}
+}
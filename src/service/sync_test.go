@@ -0,0 +1,119 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bottlepay/portfolio-data/model"
+	"github.com/shopspring/decimal"
+)
+
+// newPagingCustodianServer serves custodian 1 like the data service, with since and limit support
+func newPagingCustodianServer(cust *model.Custodian, l *sync.Mutex, queries *[]string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		l.Lock()
+		defer l.Unlock()
+		*queries = append(*queries, r.URL.RawQuery)
+
+		since, _ := strconv.Atoi(r.URL.Query().Get("since"))
+		limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+		page := &model.Custodian{ID: cust.ID, Assets: cust.Assets}
+		for _, tx := range cust.Transactions {
+			if int(tx.ID) > since && (limit == 0 || len(page.Transactions) < limit) {
+				page.Transactions = append(page.Transactions, tx)
+			}
+		}
+
+		rw.Header().Set("X-Last-Transaction-Id", strconv.Itoa(int(cust.LastTransactionID())))
+		json.NewEncoder(rw).Encode(page)
+	}))
+}
+
+func TestCustodianSvc_incremental_sync(t *testing.T) {
+	cust := &model.Custodian{ID: 1, Assets: []*model.Asset{{Code: "BTC", Balance: decimal.NewFromInt(1)}}}
+	for i := 0; i < 3; i++ {
+		cust.AddTransaction(&model.Transaction{Asset: "BTC", Amount: decimal.NewFromInt(1), Direction: model.DirectionIn})
+	}
+
+	var l sync.Mutex
+	var queries []string
+	ts := newPagingCustodianServer(cust, &l, &queries)
+	defer ts.Close()
+
+	now := time.Date(2021, 5, 20, 12, 0, 0, 0, time.UTC)
+	policy := CachePolicy{TTL: time.Minute, KeepExpired: time.Hour}
+	cache := NewLRUCache(10, policy.MaxAge())
+	svc := NewCustodianSvc(ts.URL+"/custodian/", WithCache(cache, policy), WithSyncPageSize(2))
+	cache.now = func() time.Time { return now }
+	svc.cacher.now = cache.now
+
+	fetch := func() *model.Custodian {
+		res, err := svc.FetchFromCustodian(context.Background(), 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res[0]
+	}
+
+	if got := fetch(); len(got.Transactions) != 3 {
+		t.Fatalf("first fetch: got %d transactions", len(got.Transactions))
+	}
+
+	// 5 new transactions are synced in 3 pages of 2
+	l.Lock()
+	for i := 0; i < 5; i++ {
+		cust.AddTransaction(&model.Transaction{Asset: "BTC", Amount: decimal.NewFromInt(1), Direction: model.DirectionOut})
+	}
+	cust.Assets = []*model.Asset{{Code: "BTC", Balance: decimal.NewFromInt(2)}}
+	queries = nil
+	l.Unlock()
+
+	now = now.Add(2 * time.Minute)
+	got := fetch()
+	if len(got.Transactions) != 8 {
+		t.Fatalf("synced custodian: got %d transactions", len(got.Transactions))
+	}
+	for i, tx := range got.Transactions {
+		if tx.ID != int32(i+1) {
+			t.Errorf("transaction %d has ID %d", i, tx.ID)
+		}
+	}
+	if b := got.Assets[0].Balance.String(); b != "2" {
+		t.Errorf("synced custodian: got balance %s", b)
+	}
+
+	l.Lock()
+	defer l.Unlock()
+	want := []string{"limit=2&since=3", "limit=2&since=5", "limit=2&since=7"}
+	if len(queries) != len(want) {
+		t.Fatalf("got queries %v, want %v", queries, want)
+	}
+	for i := range want {
+		if queries[i] != want[i] {
+			t.Errorf("got query %s, want %s", queries[i], want[i])
+		}
+	}
+}
+
+func Test_mergeTransactions(t *testing.T) {
+	cached := &model.Custodian{ID: 1}
+	cached.AddTransaction(&model.Transaction{Asset: "BTC"}, &model.Transaction{Asset: "BTC"})
+	page := &model.Custodian{ID: 1, Transactions: []*model.Transaction{
+		{ID: 2, Asset: "BTC"},
+		{ID: 3, Asset: "GBP"},
+	}}
+
+	merged := mergeTransactions(cached, page)
+	if len(merged.Transactions) != 3 || merged.LastTransactionID() != 3 {
+		t.Errorf("transaction 2 should be merged once, got %d transactions", len(merged.Transactions))
+	}
+	if len(cached.Transactions) != 2 {
+		t.Error("the cached custodian shouldn't be modified")
+	}
+}
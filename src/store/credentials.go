@@ -0,0 +1,62 @@
+package store
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"strings"
+)
+
+// encryptedCredentialsPrefix starts the encrypted credentials, the plain text ones are JSON objects
+const encryptedCredentialsPrefix = "aes-gcm:"
+
+// credentialsCipher encrypts the credentials of the linked custodians with AES-256-GCM.
+// The user and the custodian are authenticated with them, so that they can't be moved to another link.
+type credentialsCipher struct {
+	aead cipher.AEAD
+}
+
+func newCredentialsCipher(key []byte) (*credentialsCipher, error) {
+	if len(key) != 32 {
+		return nil, fmt.Errorf("the credentials key must be 32 bytes, got %d", len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &credentialsCipher{aead}, nil
+}
+
+// linkData is the additional data authenticated with the credentials of a link
+func linkData(userID, custID int32) []byte {
+	return []byte(fmt.Sprintf("%d/%d", userID, custID))
+}
+
+// seal encrypts the credentials of the link, with a random nonce stored before them
+func (c *credentialsCipher) seal(userID, custID int32, plain []byte) (string, error) {
+	nonce := make([]byte, c.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := c.aead.Seal(nonce, nonce, plain, linkData(userID, custID))
+	return encryptedCredentialsPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// open decrypts the credentials of the link sealed by seal
+func (c *credentialsCipher) open(userID, custID int32, stored string) ([]byte, error) {
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(stored, encryptedCredentialsPrefix))
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < c.aead.NonceSize() {
+		return nil, fmt.Errorf("truncated credentials")
+	}
+	nonce, sealed := sealed[:c.aead.NonceSize()], sealed[c.aead.NonceSize():]
+	return c.aead.Open(nil, nonce, sealed, linkData(userID, custID))
+}
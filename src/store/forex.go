@@ -2,6 +2,8 @@ package store
 
 import (
 	"errors"
+	"sort"
+	"time"
 
 	"github.com/shopspring/decimal"
 )
@@ -14,9 +16,33 @@ var (
 		"BTC": decimal.RequireFromString("1.00000000"),
 		"ETH": decimal.RequireFromString("14.00000000"),
 	}
+
+	defaultForex = NewStaticForexProvider(&ForexTable{Base: forexBase, Rates: forexPairs})
 )
 
-func ForexRate(pairFrom, pairTo string) (ret decimal.Decimal, err error) {
+// InvalidCurrencyPairError is returned for a currency without a rate
+var InvalidCurrencyPairError = errors.New("invalid currency pair")
+
+// ForexProvider gives exchange rates between currencies
+type ForexProvider interface {
+	// Rate returns the amount of the `to` currency worth one unit of the `from` currency
+	Rate(from, to string) (decimal.Decimal, error)
+	// Codes returns the supported currencies, sorted
+	Codes() []string
+	// AsOf returns when the rates were published
+	AsOf() time.Time
+}
+
+// ForexTable holds the rates of currencies against a base currency:
+// one unit of the base currency is worth Rates[code] of each currency
+type ForexTable struct {
+	Base  string                     `json:"base"`
+	AsOf  time.Time                  `json:"as_of"`
+	Rates map[string]decimal.Decimal `json:"rates"`
+}
+
+// Rate returns the cross rate of two currencies, through the base currency
+func (t *ForexTable) Rate(pairFrom, pairTo string) (ret decimal.Decimal, err error) {
 	if pairFrom == pairTo {
 		return decimal.RequireFromString("1"), nil
 	}
@@ -25,22 +51,100 @@ func ForexRate(pairFrom, pairTo string) (ret decimal.Decimal, err error) {
 
 	// If we're not converting from the base then we first need to convert the source amount
 	// to the base currency
-	if pairFrom != forexBase {
-		baseRate, ok := forexPairs[pairFrom]
-		if !ok {
-			return decimal.Zero, errors.New("invalid currency pair")
+	if pairFrom != t.Base {
+		baseRate, ok := t.Rates[pairFrom]
+		if !ok || baseRate.IsZero() {
+			return decimal.Zero, InvalidCurrencyPairError
 		}
 
 		ret = ret.Div(baseRate)
 	}
 
-	// Lookup the rate in the table
-	rate, ok := forexPairs[pairTo]
+	// Lookup the rate in the table, the base itself may not be listed
+	if pairTo == t.Base {
+		return ret, nil
+	}
+	rate, ok := t.Rates[pairTo]
 	if !ok {
-		return decimal.Zero, errors.New("invalid currency pair")
+		return decimal.Zero, InvalidCurrencyPairError
 	}
 
 	ret = ret.Mul(rate)
 
 	return ret, nil
 }
+
+// Codes returns the base and the currencies of the table, sorted
+func (t *ForexTable) Codes() []string {
+	codes := []string{t.Base}
+	for code := range t.Rates {
+		if code != t.Base {
+			codes = append(codes, code)
+		}
+	}
+	sort.Strings(codes)
+	return codes
+}
+
+// StaticForexProvider gives the rates of a fixed table
+type StaticForexProvider struct {
+	table *ForexTable
+}
+
+// NewStaticForexProvider creates a StaticForexProvider, as of now if the table doesn't say when it was published
+func NewStaticForexProvider(t *ForexTable) *StaticForexProvider {
+	if t.AsOf.IsZero() {
+		t.AsOf = time.Now()
+	}
+	return &StaticForexProvider{table: t}
+}
+
+// DefaultForexProvider returns the provider of the built-in rates table, with BTC as base
+func DefaultForexProvider() ForexProvider {
+	return defaultForex
+}
+
+func (p *StaticForexProvider) Rate(from, to string) (decimal.Decimal, error) {
+	return p.table.Rate(from, to)
+}
+
+func (p *StaticForexProvider) Codes() []string {
+	return p.table.Codes()
+}
+
+func (p *StaticForexProvider) AsOf() time.Time {
+	return p.table.AsOf
+}
+
+// ForexSupports tells if the provider, or the history, has a rate for the currency
+func ForexSupports(p interface{ Codes() []string }, code string) bool {
+	for _, each := range p.Codes() {
+		if each == code {
+			return true
+		}
+	}
+	return false
+}
+
+// ForexSnapshot returns the current rates of the provider against the base currency
+func ForexSnapshot(p ForexProvider, base string) (*ForexTable, error) {
+	t := &ForexTable{Base: base, AsOf: p.AsOf(), Rates: make(map[string]decimal.Decimal)}
+	for _, code := range p.Codes() {
+		rate, err := p.Rate(base, code)
+		if err != nil {
+			return nil, err
+		}
+		t.Rates[code] = rate
+	}
+	return t, nil
+}
+
+// ForexRate returns the rate of the built-in table
+func ForexRate(pairFrom, pairTo string) (ret decimal.Decimal, err error) {
+	return defaultForex.Rate(pairFrom, pairTo)
+}
+
+func init() {
+	// Check interface implementation
+	var _ ForexProvider = (*StaticForexProvider)(nil)
+}
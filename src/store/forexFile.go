@@ -0,0 +1,169 @@
+package store
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+// FileForexProvider gives the rates of a JSON or CSV file, reloaded when it's modified.
+//
+// A JSON file is a ForexTable: {"base":"BTC","as_of":"2021-05-20T10:00:00Z","rates":{"GBP":"40000.00"}}
+//
+// A CSV file has a code,rate line per currency, the first one is the base currency with a rate of 1,
+// and the rates are as of the modification time of the file.
+type FileForexProvider struct {
+	path string
+
+	table   *ForexTable
+	modTime time.Time
+	l       sync.RWMutex
+
+	stop chan struct{}
+}
+
+// NewFileForexProvider loads the rates of the file, and checks if it was modified every interval. 0 disables reloading
+func NewFileForexProvider(path string, interval time.Duration) (*FileForexProvider, error) {
+	p := &FileForexProvider{path: path, stop: make(chan struct{})}
+	if err := p.reload(); err != nil {
+		return nil, err
+	}
+
+	if interval > 0 {
+		go func() {
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					// keep the previous rates until the file is fixed
+					if err := p.reload(); err != nil {
+						log.Printf("error reloading forex rates from %s: %v", p.path, err)
+					}
+				case <-p.stop:
+					return
+				}
+			}
+		}()
+	}
+	return p, nil
+}
+
+// reload loads the file again if it was modified
+func (p *FileForexProvider) reload() error {
+	info, err := os.Stat(p.path)
+	if err != nil {
+		return err
+	}
+	p.l.RLock()
+	unchanged := p.table != nil && info.ModTime().Equal(p.modTime)
+	p.l.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	f, err := os.Open(p.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var table *ForexTable
+	if strings.EqualFold(filepath.Ext(p.path), ".csv") {
+		table, err = ParseForexCSV(f)
+	} else {
+		table, err = ParseForexJSON(f)
+	}
+
+	p.l.Lock()
+	defer p.l.Unlock()
+	// an invalid file is only reported once, until it's modified again
+	p.modTime = info.ModTime()
+	if err != nil {
+		return fmt.Errorf("invalid forex rates file %s: %w", p.path, err)
+	}
+	if table.AsOf.IsZero() {
+		table.AsOf = info.ModTime()
+	}
+	p.table = table
+	return nil
+}
+
+// Close stops reloading the file
+func (p *FileForexProvider) Close() {
+	close(p.stop)
+}
+
+func (p *FileForexProvider) current() *ForexTable {
+	p.l.RLock()
+	defer p.l.RUnlock()
+	return p.table
+}
+
+func (p *FileForexProvider) Rate(from, to string) (decimal.Decimal, error) {
+	return p.current().Rate(from, to)
+}
+
+func (p *FileForexProvider) Codes() []string {
+	return p.current().Codes()
+}
+
+func (p *FileForexProvider) AsOf() time.Time {
+	return p.current().AsOf
+}
+
+// ParseForexJSON parses a ForexTable
+func ParseForexJSON(r io.Reader) (*ForexTable, error) {
+	t := &ForexTable{}
+	if err := json.NewDecoder(r).Decode(t); err != nil {
+		return nil, err
+	}
+	if t.Base == "" {
+		return nil, fmt.Errorf("missing base currency")
+	}
+	return t, nil
+}
+
+// ParseForexCSV parses code,rate lines, the first one being the base currency. A code,rate header is skipped.
+func ParseForexCSV(r io.Reader) (*ForexTable, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = 2
+	reader.TrimLeadingSpace = true
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(records) > 0 && strings.EqualFold(records[0][0], "code") {
+		records = records[1:]
+	}
+	if len(records) == 0 {
+		return nil, fmt.Errorf("no rates")
+	}
+
+	t := &ForexTable{Base: strings.ToUpper(records[0][0]), Rates: make(map[string]decimal.Decimal)}
+	for i, record := range records {
+		rate, err := decimal.NewFromString(record[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid rate of %s: %w", record[0], err)
+		}
+		if i == 0 && !rate.Equal(decimal.NewFromInt(1)) {
+			return nil, fmt.Errorf("the base currency %s must have a rate of 1", t.Base)
+		}
+		t.Rates[strings.ToUpper(record[0])] = rate
+	}
+	return t, nil
+}
+
+func init() {
+	// Check interface implementation
+	var _ ForexProvider = (*FileForexProvider)(nil)
+}
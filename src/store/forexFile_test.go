@@ -0,0 +1,81 @@
+package store
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseForexCSV(t *testing.T) {
+	table, err := ParseForexCSV(strings.NewReader("code,rate\nbtc,1\nGBP, 40000.00\nETH,14\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if table.Base != "BTC" || len(table.Rates) != 3 || table.Rates["GBP"].String() != "40000" {
+		t.Errorf("unexpected table %+v", table)
+	}
+
+	for _, invalid := range []string{"", "code,rate\n", "GBP,2\nBTC,1\n", "BTC,1\nGBP,forty\n", "BTC,1,2\n"} {
+		if _, err := ParseForexCSV(strings.NewReader(invalid)); err == nil {
+			t.Errorf("expected an error for %q", invalid)
+		}
+	}
+}
+
+func TestFileForexProvider(t *testing.T) {
+	dir, err := ioutil.TempDir("", "forex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "rates.json")
+	write := func(content string, modTime time.Time) {
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		os.Chtimes(path, modTime, modTime)
+	}
+	write(`{"base":"BTC","as_of":"2021-05-20T10:00:00Z","rates":{"GBP":"40000"}}`, time.Now().Add(-time.Hour))
+
+	p, err := NewFileForexProvider(path, 10*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	if rate, _ := p.Rate("BTC", "GBP"); rate.String() != "40000" {
+		t.Errorf("unexpected rate %v", rate)
+	}
+	if !p.AsOf().Equal(time.Date(2021, 5, 20, 10, 0, 0, 0, time.UTC)) {
+		t.Errorf("unexpected as of %v", p.AsOf())
+	}
+
+	// an invalid file keeps the previous rates
+	write(`{"base":`, time.Now().Add(-time.Minute))
+	time.Sleep(50 * time.Millisecond)
+	if rate, _ := p.Rate("BTC", "GBP"); rate.String() != "40000" {
+		t.Errorf("expected the previous rate, got %v", rate)
+	}
+
+	// without as_of, the rates are as of the modification of the file
+	modTime := time.Now().Truncate(time.Second)
+	write(`{"base":"BTC","rates":{"GBP":"42000","EUR":"48000"}}`, modTime)
+	deadline := time.Now().Add(time.Second)
+	for len(p.Codes()) != 3 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if rate, _ := p.Rate("BTC", "GBP"); rate.String() != "42000" {
+		t.Errorf("expected the reloaded rate, got %v", rate)
+	}
+	if !p.AsOf().Equal(modTime) {
+		t.Errorf("expected as of %v, got %v", modTime, p.AsOf())
+	}
+
+	if _, err := NewFileForexProvider(filepath.Join(dir, "missing.csv"), 0); err == nil {
+		t.Error("expected an error for a missing file")
+	}
+}
@@ -0,0 +1,103 @@
+package store
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+// HTTPForexProvider gives the rates of an HTTP feed returning a JSON ForexTable, like GET /forex of the data service.
+// The rates are cached for ttl, and the last rates are still used while the feed fails.
+type HTTPForexProvider struct {
+	url    string
+	client *http.Client
+	ttl    time.Duration
+	now    func() time.Time
+
+	table     *ForexTable
+	fetchedAt time.Time
+	l         sync.Mutex
+}
+
+// NewHTTPForexProvider creates an HTTPForexProvider, the feed is requested the first time a rate is needed
+func NewHTTPForexProvider(u string, client *http.Client, ttl time.Duration) *HTTPForexProvider {
+	return &HTTPForexProvider{url: u, client: client, ttl: ttl, now: time.Now}
+}
+
+// current returns the cached rates, fetched again once they're older than ttl
+func (p *HTTPForexProvider) current() (*ForexTable, error) {
+	p.l.Lock()
+	defer p.l.Unlock()
+
+	now := p.now()
+	if p.table != nil && now.Sub(p.fetchedAt) < p.ttl {
+		return p.table, nil
+	}
+
+	table, err := p.fetch()
+	if err != nil {
+		if p.table == nil {
+			return nil, err
+		}
+		// don't request the feed for every rate while it's down
+		log.Printf("error fetching forex rates from %s, using the rates of %s: %v", p.url, p.fetchedAt.Format(time.RFC3339), err)
+		p.fetchedAt = now
+		return p.table, nil
+	}
+	p.table, p.fetchedAt = table, now
+	return table, nil
+}
+
+func (p *HTTPForexProvider) fetch() (*ForexTable, error) {
+	res, err := p.client.Get(p.url)
+	if err != nil {
+		return nil, fmt.Errorf("forex GET Error: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != 200 {
+		return nil, fmt.Errorf("forex GET status %d", res.StatusCode)
+	}
+	table, err := ParseForexJSON(res.Body)
+	if err != nil {
+		return nil, fmt.Errorf("invalid forex rates: %w", err)
+	}
+	if table.AsOf.IsZero() {
+		table.AsOf = p.now()
+	}
+	return table, nil
+}
+
+func (p *HTTPForexProvider) Rate(from, to string) (decimal.Decimal, error) {
+	table, err := p.current()
+	if err != nil {
+		return decimal.Zero, err
+	}
+	return table.Rate(from, to)
+}
+
+// Codes returns no currency while the feed can't be reached
+func (p *HTTPForexProvider) Codes() []string {
+	table, err := p.current()
+	if err != nil {
+		return nil
+	}
+	return table.Codes()
+}
+
+func (p *HTTPForexProvider) AsOf() time.Time {
+	table, err := p.current()
+	if err != nil {
+		return time.Time{}
+	}
+	return table.AsOf
+}
+
+func init() {
+	// Check interface implementation
+	var _ ForexProvider = (*HTTPForexProvider)(nil)
+}
@@ -0,0 +1,53 @@
+package store
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHTTPForexProvider(t *testing.T) {
+	var requests, failing int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if atomic.LoadInt32(&failing) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`{"base":"BTC","rates":{"GBP":"40000","EUR":"45000"}}`))
+	}))
+	defer ts.Close()
+
+	now := time.Date(2021, 5, 20, 10, 0, 0, 0, time.UTC)
+	p := NewHTTPForexProvider(ts.URL, http.DefaultClient, time.Minute)
+	p.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		if rate, err := p.Rate("GBP", "BTC"); err != nil || rate.String() != "0.000025" {
+			t.Errorf("unexpected rate %v %v", rate, err)
+		}
+	}
+	if atomic.LoadInt32(&requests) != 1 {
+		t.Errorf("expected the rates to be cached, got %d requests", requests)
+	}
+	if !p.AsOf().Equal(now) {
+		t.Errorf("expected the rates as of their fetch, got %v", p.AsOf())
+	}
+
+	// the cached rates are still used when the feed fails
+	atomic.StoreInt32(&failing, 1)
+	now = now.Add(2 * time.Minute)
+	if _, err := p.Rate("EUR", "GBP"); err != nil {
+		t.Errorf("expected the stale rates, got %v", err)
+	}
+	if len(p.Codes()) != 3 || atomic.LoadInt32(&requests) != 2 {
+		t.Errorf("expected a single failed request, got %d", requests)
+	}
+
+	down := NewHTTPForexProvider(ts.URL, http.DefaultClient, time.Minute)
+	if _, err := down.Rate("BTC", "GBP"); err == nil {
+		t.Error("expected an error without any rates")
+	}
+}
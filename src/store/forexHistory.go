@@ -0,0 +1,199 @@
+package store
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+// NoRateError is returned when a pair has no rate at the requested time
+var NoRateError = errors.New("no rate at this time")
+
+// ForexLookup tells how a rate is found between the points of a series
+type ForexLookup int
+
+const (
+	// NearestBefore uses the last rate published before the time
+	NearestBefore ForexLookup = iota
+	// Interpolate uses the linear interpolation of the rates around the time, or the last rate after the series
+	Interpolate
+)
+
+// ParseForexLookup parses "nearest" or "interpolate"
+func ParseForexLookup(s string) (ForexLookup, error) {
+	switch s {
+	case "nearest":
+		return NearestBefore, nil
+	case "interpolate":
+		return Interpolate, nil
+	}
+	return NearestBefore, fmt.Errorf("unknown forex lookup %q, use nearest or interpolate", s)
+}
+
+type ratePoint struct {
+	at   time.Time
+	rate decimal.Decimal
+}
+
+// ForexHistory holds time series of rates, per currency pair
+type ForexHistory struct {
+	lookup ForexLookup
+
+	// the series of each FROM/TO pair, sorted by time
+	series map[string][]ratePoint
+	// the currencies of the series, to find cross rates
+	codes map[string]bool
+	l     sync.RWMutex
+}
+
+// NewForexHistory creates an empty ForexHistory
+func NewForexHistory(lookup ForexLookup) *ForexHistory {
+	return &ForexHistory{lookup: lookup, series: make(map[string][]ratePoint), codes: make(map[string]bool)}
+}
+
+func pairKey(from, to string) string {
+	return from + "/" + to
+}
+
+// Add adds the rate of a pair at a time, replacing the rate already known at this time
+func (h *ForexHistory) Add(from, to string, at time.Time, rate decimal.Decimal) {
+	h.l.Lock()
+	defer h.l.Unlock()
+
+	key := pairKey(from, to)
+	s := h.series[key]
+	i := sort.Search(len(s), func(i int) bool { return !s[i].at.Before(at) })
+	switch {
+	case i < len(s) && s[i].at.Equal(at):
+		s[i].rate = rate
+	default:
+		s = append(s, ratePoint{})
+		copy(s[i+1:], s[i:])
+		s[i] = ratePoint{at, rate}
+	}
+	h.series[key] = s
+	h.codes[from], h.codes[to] = true, true
+}
+
+// Codes returns the currencies of the series, sorted
+func (h *ForexHistory) Codes() []string {
+	h.l.RLock()
+	defer h.l.RUnlock()
+
+	codes := make([]string, 0, len(h.codes))
+	for code := range h.codes {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+	return codes
+}
+
+// Record adds the current rates of the provider against the base currency, at their publication time
+func (h *ForexHistory) Record(p ForexProvider, base string) error {
+	table, err := ForexSnapshot(p, base)
+	if err != nil {
+		return err
+	}
+	for code, rate := range table.Rates {
+		if code != base {
+			h.Add(base, code, table.AsOf, rate)
+		}
+	}
+	return nil
+}
+
+// ForexRateAt returns the amount of the `to` currency worth one unit of the `from` currency at a time.
+// The rate comes from the series of the pair, of the inverse pair, or is the cross rate through a third currency.
+func (h *ForexHistory) ForexRateAt(from, to string, at time.Time) (decimal.Decimal, error) {
+	if from == to {
+		return decimal.NewFromInt(1), nil
+	}
+
+	h.l.RLock()
+	defer h.l.RUnlock()
+
+	if num, den, ok := h.pairRateAt(from, to, at); ok {
+		return num.Div(den), nil
+	}
+
+	for via := range h.codes {
+		if via == from || via == to {
+			continue
+		}
+		n1, d1, ok := h.pairRateAt(from, via, at)
+		if !ok {
+			continue
+		}
+		if n2, d2, ok := h.pairRateAt(via, to, at); ok {
+			// a single division keeps the precision
+			return n1.Mul(n2).Div(d1.Mul(d2)), nil
+		}
+	}
+	return decimal.Zero, NoRateError
+}
+
+// pairRateAt looks up the series of the pair, or of the inverse pair. The rate is num/den.
+func (h *ForexHistory) pairRateAt(from, to string, at time.Time) (num, den decimal.Decimal, ok bool) {
+	one := decimal.NewFromInt(1)
+	if rate, ok := h.seriesRateAt(h.series[pairKey(from, to)], at); ok {
+		return rate, one, true
+	}
+	if rate, ok := h.seriesRateAt(h.series[pairKey(to, from)], at); ok && !rate.IsZero() {
+		return one, rate, true
+	}
+	return decimal.Zero, one, false
+}
+
+func (h *ForexHistory) seriesRateAt(s []ratePoint, at time.Time) (decimal.Decimal, bool) {
+	// the first point after the time
+	i := sort.Search(len(s), func(i int) bool { return s[i].at.After(at) })
+	if i == 0 {
+		return decimal.Zero, false
+	}
+	before := s[i-1]
+	if h.lookup == NearestBefore || i == len(s) || before.at.Equal(at) {
+		return before.rate, true
+	}
+
+	after := s[i]
+	elapsed := decimal.NewFromInt(int64(at.Sub(before.at)))
+	span := decimal.NewFromInt(int64(after.at.Sub(before.at)))
+	return before.rate.Add(after.rate.Sub(before.rate).Mul(elapsed).Div(span)), true
+}
+
+// LoadCSV adds the rates of time,from,to,rate lines, the time being RFC 3339 or a 2006-01-02 date at midnight UTC.
+// A time,from,to,rate header is skipped.
+func (h *ForexHistory) LoadCSV(r io.Reader) error {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = 4
+	reader.TrimLeadingSpace = true
+	records, err := reader.ReadAll()
+	if err != nil {
+		return err
+	}
+	if len(records) > 0 && strings.EqualFold(records[0][0], "time") {
+		records = records[1:]
+	}
+
+	for line, record := range records {
+		at, err := time.Parse(time.RFC3339, record[0])
+		if err != nil {
+			if at, err = time.Parse("2006-01-02", record[0]); err != nil {
+				return fmt.Errorf("invalid time on line %d: %w", line+1, err)
+			}
+		}
+		rate, err := decimal.NewFromString(record[3])
+		if err != nil {
+			return fmt.Errorf("invalid rate on line %d: %w", line+1, err)
+		}
+		h.Add(strings.ToUpper(record[1]), strings.ToUpper(record[2]), at, rate)
+	}
+	return nil
+}
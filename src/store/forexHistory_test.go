@@ -0,0 +1,92 @@
+package store
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+const testHistoryCSV = `time,from,to,rate
+2021-05-01,BTC,GBP,40000
+2021-05-03,BTC,GBP,42000
+2021-05-02T00:00:00Z,eur,gbp,0.86
+2021-05-01,BTC,ETH,14
+`
+
+func day(d int) time.Time {
+	return time.Date(2021, 5, d, 0, 0, 0, 0, time.UTC)
+}
+
+func TestForexHistory_ForexRateAt(t *testing.T) {
+	nearest := NewForexHistory(NearestBefore)
+	interpolate := NewForexHistory(Interpolate)
+	for _, h := range []*ForexHistory{nearest, interpolate} {
+		if err := h.LoadCSV(strings.NewReader(testHistoryCSV)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tt := range []struct {
+		h        *ForexHistory
+		from, to string
+		at       time.Time
+		want     string
+	}{
+		{nearest, "BTC", "GBP", day(1), "40000"},
+		{nearest, "BTC", "GBP", day(2), "40000"},
+		{nearest, "BTC", "GBP", day(4), "42000"},
+		{interpolate, "BTC", "GBP", day(2), "41000"},
+		{interpolate, "BTC", "GBP", day(2).Add(12 * time.Hour), "41500"},
+		{interpolate, "BTC", "GBP", day(9), "42000"},
+		// the inverse pair
+		{nearest, "GBP", "BTC", day(1), "0.000025"},
+		// the cross rates through BTC and GBP
+		{nearest, "ETH", "GBP", day(3), "3000"},
+		{nearest, "EUR", "BTC", day(3), "0.0000204761904762"},
+		{nearest, "GBP", "GBP", day(1), "1"},
+	} {
+		rate, err := tt.h.ForexRateAt(tt.from, tt.to, tt.at)
+		if err != nil {
+			t.Errorf("%s/%s at %v: %v", tt.from, tt.to, tt.at, err)
+			continue
+		}
+		if rate.String() != tt.want {
+			t.Errorf("%s/%s at %v: expected %s, got %s", tt.from, tt.to, tt.at, tt.want, rate)
+		}
+	}
+
+	// before the series, or without any series
+	if _, err := nearest.ForexRateAt("BTC", "GBP", day(1).Add(-time.Second)); err != NoRateError {
+		t.Errorf("expected NoRateError before the series, got %v", err)
+	}
+	if _, err := nearest.ForexRateAt("BTC", "USD", day(5)); err != NoRateError {
+		t.Errorf("expected NoRateError for an unknown currency, got %v", err)
+	}
+}
+
+func TestForexHistory_Record(t *testing.T) {
+	h := NewForexHistory(NearestBefore)
+	p := NewStaticForexProvider(&ForexTable{Base: "BTC", AsOf: day(1), Rates: map[string]decimal.Decimal{"GBP": decimal.NewFromInt(40000)}})
+	if err := h.Record(p, "BTC"); err != nil {
+		t.Fatal(err)
+	}
+	// the same rates recorded again don't add points
+	h.Record(p, "BTC")
+	if len(h.series) != 1 || len(h.series["BTC/GBP"]) != 1 {
+		t.Errorf("unexpected series %v", h.series)
+	}
+
+	if rate, err := h.ForexRateAt("GBP", "BTC", day(2)); err != nil || rate.String() != "0.000025" {
+		t.Errorf("unexpected rate %v %v", rate, err)
+	}
+}
+
+func TestForexHistory_LoadCSV(t *testing.T) {
+	for _, invalid := range []string{"2021-05-01,BTC,GBP\n", "yesterday,BTC,GBP,40000\n", "2021-05-01,BTC,GBP,a lot\n"} {
+		if err := NewForexHistory(NearestBefore).LoadCSV(strings.NewReader(invalid)); err == nil {
+			t.Errorf("expected an error for %q", invalid)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package store
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/shopspring/decimal"
+)
+
+func TestForexRate(t *testing.T) {
+	for _, tt := range []struct {
+		from, to string
+		want     string
+	}{
+		{"BTC", "GBP", "40000"},
+		{"GBP", "GBP", "1"},
+		{"GBP", "BTC", "0.000025"},
+		{"ETH", "EUR", "3214.285714285713"},
+	} {
+		rate, err := ForexRate(tt.from, tt.to)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rate.String() != tt.want {
+			t.Errorf("%s/%s: expected %s, got %s", tt.from, tt.to, tt.want, rate)
+		}
+	}
+
+	if _, err := ForexRate("GBP", "XYZ"); err != InvalidCurrencyPairError {
+		t.Errorf("expected InvalidCurrencyPairError, got %v", err)
+	}
+}
+
+func TestStaticForexProvider(t *testing.T) {
+	// the base doesn't need to be listed in the rates
+	p := NewStaticForexProvider(&ForexTable{Base: "GBP", Rates: map[string]decimal.Decimal{
+		"EUR": decimal.RequireFromString("1.15"),
+		"USD": decimal.RequireFromString("1.40"),
+	}})
+
+	if want := []string{"EUR", "GBP", "USD"}; !reflect.DeepEqual(p.Codes(), want) {
+		t.Errorf("expected codes %v, got %v", want, p.Codes())
+	}
+	if p.AsOf().IsZero() {
+		t.Error("expected an as-of time")
+	}
+	if rate, err := p.Rate("EUR", "GBP"); err != nil || !rate.Mul(decimal.RequireFromString("1.15")).Round(8).Equal(decimal.NewFromInt(1)) {
+		t.Errorf("unexpected EUR/GBP rate %v %v", rate, err)
+	}
+	if !ForexSupports(p, "USD") || ForexSupports(p, "BTC") {
+		t.Error("unexpected supported currencies")
+	}
+
+	snapshot, err := ForexSnapshot(p, "USD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snapshot.Base != "USD" || !snapshot.Rates["USD"].Equal(decimal.NewFromInt(1)) || len(snapshot.Rates) != 3 {
+		t.Errorf("unexpected snapshot %+v", snapshot)
+	}
+}
@@ -0,0 +1,107 @@
+package store
+
+import (
+	"time"
+
+	"github.com/bottlepay/portfolio-data/model"
+)
+
+// migrationStep is the time between two events of a migrated state file
+const migrationStep = time.Hour
+
+// migrateTimestamps stamps the transactions without a timestamp, and tells if there were any.
+//
+// The time of the events is lost, but each custodian numbers its transactions, and the two transactions
+// of a transfer or an exchange were added together. So merging the transactions of all the custodians
+// gives an order of the events consistent with the history, and they're given evenly spaced timestamps
+// ending at the time of the state file.
+func migrateTimestamps(custodians []*model.Custodian, end time.Time) bool {
+	missing := false
+	for _, c := range custodians {
+		for _, tx := range c.Transactions {
+			missing = missing || tx.Timestamp.IsZero()
+		}
+	}
+	if !missing {
+		return false
+	}
+
+	events := orderEvents(custodians)
+	end = end.UTC().Truncate(time.Second)
+	for i, event := range events {
+		timestamp := end.Add(-time.Duration(len(events)-1-i) * migrationStep)
+		for _, tx := range event {
+			if tx.Timestamp.IsZero() {
+				tx.Timestamp = timestamp
+			}
+		}
+	}
+	return true
+}
+
+// orderEvents groups the transactions by event, in the order they were added
+func orderEvents(custodians []*model.Custodian) [][]*model.Transaction {
+	next := make(map[int32]int, len(custodians))
+	byID := make(map[int32]*model.Custodian, len(custodians))
+	remaining := 0
+	for _, c := range custodians {
+		byID[c.ID] = c
+		remaining += len(c.Transactions)
+	}
+
+	// peek returns the next transaction of a custodian, if it has the ID
+	peek := func(c *model.Custodian, offset int, id int32) *model.Transaction {
+		if c == nil || next[c.ID]+offset >= len(c.Transactions) {
+			return nil
+		}
+		if tx := c.Transactions[next[c.ID]+offset]; tx.ID == id {
+			return tx
+		}
+		return nil
+	}
+
+	var events [][]*model.Transaction
+	for remaining > 0 {
+		progress := false
+		for _, c := range custodians {
+			if next[c.ID] >= len(c.Transactions) {
+				continue
+			}
+			tx := c.Transactions[next[c.ID]]
+
+			event := []*model.Transaction{tx}
+			if tx.RelatedCustodianID != 0 {
+				// the other side must be the next transaction of the other custodian,
+				// or the one after this one for an exchange
+				offset := 0
+				if tx.RelatedCustodianID == c.ID {
+					offset = 1
+				}
+				related := peek(byID[tx.RelatedCustodianID], offset, tx.RelatedCustodianTransactionID)
+				if related == nil {
+					continue
+				}
+				event = append(event, related)
+				next[tx.RelatedCustodianID]++
+			}
+
+			next[c.ID]++
+			remaining -= len(event)
+			events = append(events, event)
+			progress = true
+		}
+
+		// a transfer whose other side is missing can't be ordered, it's taken alone
+		if !progress {
+			for _, c := range custodians {
+				if next[c.ID] < len(c.Transactions) {
+					events = append(events, []*model.Transaction{c.Transactions[next[c.ID]]})
+					next[c.ID]++
+					remaining--
+					break
+				}
+			}
+		}
+	}
+	return events
+}
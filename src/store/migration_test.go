@@ -0,0 +1,112 @@
+package store
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bottlepay/portfolio-data/model"
+	"github.com/shopspring/decimal"
+)
+
+// legacyCustodians returns custodians without timestamps: a deposit on 1, a transfer from 1 to 2,
+// an exchange on 2, and a withdrawal from 2
+func legacyCustodians() []*model.Custodian {
+	one := decimal.NewFromInt(1)
+	c1 := &model.Custodian{ID: 1}
+	c1.AddTransaction(
+		&model.Transaction{Asset: "BTC", Amount: one, Direction: model.DirectionIn},
+		&model.Transaction{Asset: "BTC", Amount: one, Direction: model.DirectionOut, RelatedCustodianID: 2, RelatedCustodianTransactionID: 1},
+	)
+	c2 := &model.Custodian{ID: 2}
+	c2.AddTransaction(
+		&model.Transaction{Asset: "BTC", Amount: one, Direction: model.DirectionIn, RelatedCustodianID: 1, RelatedCustodianTransactionID: 2},
+		&model.Transaction{Asset: "BTC", Amount: one, Direction: model.DirectionOut, RelatedCustodianID: 2, RelatedCustodianTransactionID: 3},
+		&model.Transaction{Asset: "GBP", Amount: one, Direction: model.DirectionIn, RelatedCustodianID: 2, RelatedCustodianTransactionID: 2},
+		&model.Transaction{Asset: "GBP", Amount: one, Direction: model.DirectionOut},
+	)
+	return []*model.Custodian{c2, c1}
+}
+
+func TestMigrateTimestamps(t *testing.T) {
+	custodians := legacyCustodians()
+	end := time.Date(2021, 5, 20, 10, 0, 0, 0, time.FixedZone("CEST", 2*3600))
+	if !migrateTimestamps(custodians, end) {
+		t.Fatal("expected a migration")
+	}
+	c2, c1 := custodians[0], custodians[1]
+
+	// 4 events, an hour apart
+	at := func(events int) time.Time {
+		return end.UTC().Add(-time.Duration(3-events) * time.Hour)
+	}
+	for _, tt := range []struct {
+		tx   *model.Transaction
+		want time.Time
+	}{
+		{c1.Transactions[0], at(0)},
+		{c1.Transactions[1], at(1)},
+		{c2.Transactions[0], at(1)},
+		{c2.Transactions[1], at(2)},
+		{c2.Transactions[2], at(2)},
+		{c2.Transactions[3], at(3)},
+	} {
+		if !tt.tx.Timestamp.Equal(tt.want) || tt.tx.Timestamp.Location() != time.UTC {
+			t.Errorf("transaction %d: expected %v, got %v", tt.tx.ID, tt.want, tt.tx.Timestamp)
+		}
+	}
+
+	if migrateTimestamps(custodians, end) {
+		t.Error("expected no migration once migrated")
+	}
+}
+
+func TestNewStore_migration(t *testing.T) {
+	dir, err := ioutil.TempDir("", "store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	stateFile := filepath.Join(dir, "state.json")
+	data, _ := json.Marshal(legacyCustodians())
+	if err := ioutil.WriteFile(stateFile, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// the state is migrated in memory, without rewriting the file
+	s, err := NewStore(stateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range s.custodians {
+		for _, tx := range c.Transactions {
+			if tx.Timestamp.IsZero() {
+				t.Errorf("transaction %d of %d has no timestamp", tx.ID, c.ID)
+			}
+		}
+	}
+	if saved, _ := ioutil.ReadFile(stateFile); string(saved) != string(data) {
+		t.Error("the state file shouldn't be rewritten without WithMigrationSnapshot")
+	}
+
+	// the migrated state is saved
+	if _, err := NewStore(stateFile, WithMigrationSnapshot()); err != nil {
+		t.Fatal(err)
+	}
+	var saved []*model.Custodian
+	data, _ = ioutil.ReadFile(stateFile)
+	if err := json.Unmarshal(data, &saved); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range saved {
+		for _, tx := range c.Transactions {
+			if tx.Timestamp.IsZero() {
+				t.Errorf("transaction %d of %d has no timestamp", tx.ID, c.ID)
+			}
+		}
+	}
+}
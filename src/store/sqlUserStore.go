@@ -0,0 +1,491 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/bottlepay/portfolio-data/model"
+	// the sqlite3 driver of database/sql
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// userStoreMigrations are the schema versions of the SQL user store, in order.
+// A migration is never modified once released, a new one is appended instead.
+var userStoreMigrations = []string{
+	// 1: the users and their linked custodians, in the order they were linked
+	`CREATE TABLE users (
+		id INTEGER PRIMARY KEY
+	);
+	CREATE TABLE user_custodians (
+		user_id      INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		custodian_id INTEGER NOT NULL,
+		position     INTEGER NOT NULL,
+		adapter      TEXT,
+		credentials  TEXT,
+		PRIMARY KEY (user_id, custodian_id)
+	);`,
+	// 2: the versions of the users, for optimistic concurrency
+	`ALTER TABLE users ADD COLUMN version INTEGER NOT NULL DEFAULT 1;`,
+}
+
+// queryer is a database, or a transaction
+type queryer interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// SQLUserStore stores users in an SQL database, it's persistent unlike the FakeUserStore.
+// The credentials of the linked custodians are stored in plain text, unless the store has a key to encrypt them.
+type SQLUserStore struct {
+	db *sql.DB
+
+	key    []byte
+	cipher *credentialsCipher
+}
+
+// SQLUserStoreOption configures an SQLUserStore
+type SQLUserStoreOption func(*SQLUserStore)
+
+// WithCredentialsKey encrypts the credentials of the linked custodians with AES-256-GCM and the 32 bytes key.
+// The credentials stored in plain text before are encrypted when the store is created.
+func WithCredentialsKey(key []byte) SQLUserStoreOption {
+	return func(s *SQLUserStore) {
+		s.key = key
+	}
+}
+
+// NewSQLUserStore creates a store on the database, migrating its schema to the latest version
+func NewSQLUserStore(ctx context.Context, db *sql.DB, opts ...SQLUserStoreOption) (*SQLUserStore, error) {
+	s := &SQLUserStore{db: db}
+	for _, opt := range opts {
+		opt(s)
+	}
+	if s.key != nil {
+		c, err := newCredentialsCipher(s.key)
+		if err != nil {
+			return nil, err
+		}
+		s.cipher = c
+	}
+	if err := s.migrate(ctx); err != nil {
+		return nil, err
+	}
+	if s.cipher != nil {
+		if err := s.encryptCredentials(ctx); err != nil {
+			return nil, fmt.Errorf("error encrypting the credentials: %w", err)
+		}
+	}
+	return s, nil
+}
+
+// OpenSQLiteUserStore opens, or creates, the SQLite database of a store in the file at path.
+// A new file is only readable by its owner, since it holds the credentials of the users.
+func OpenSQLiteUserStore(ctx context.Context, path string, opts ...SQLUserStoreOption) (*SQLUserStore, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	f.Close()
+
+	db, err := sql.Open("sqlite3", "file:"+path+"?_foreign_keys=1&_busy_timeout=5000")
+	if err != nil {
+		return nil, err
+	}
+	// SQLite only has one writer at a time
+	db.SetMaxOpenConns(1)
+
+	s, err := NewSQLUserStore(ctx, db, opts...)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// Close closes the database
+func (s *SQLUserStore) Close() error {
+	return s.db.Close()
+}
+
+// migrate applies the migrations newer than the version of the schema, each in its own transaction
+func (s *SQLUserStore) migrate(ctx context.Context) error {
+	if _, err := s.db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER PRIMARY KEY)`); err != nil {
+		return fmt.Errorf("error creating the schema migrations: %w", err)
+	}
+	var version int
+	if err := s.db.QueryRowContext(ctx, `SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&version); err != nil {
+		return fmt.Errorf("error reading the schema version: %w", err)
+	}
+	if version > len(userStoreMigrations) {
+		return fmt.Errorf("the schema version %d is newer than this version of the store, %d", version, len(userStoreMigrations))
+	}
+
+	for v := version + 1; v <= len(userStoreMigrations); v++ {
+		err := s.inTx(ctx, func(tx *sql.Tx) error {
+			if _, err := tx.ExecContext(ctx, userStoreMigrations[v-1]); err != nil {
+				return err
+			}
+			_, err := tx.ExecContext(ctx, `INSERT INTO schema_migrations (version) VALUES (?)`, v)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("error migrating the schema to version %d: %w", v, err)
+		}
+	}
+	return nil
+}
+
+// encryptCredentials encrypts the credentials stored in plain text
+func (s *SQLUserStore) encryptCredentials(ctx context.Context) error {
+	return s.inTx(ctx, func(tx *sql.Tx) error {
+		rows, err := tx.QueryContext(ctx, `SELECT user_id, custodian_id, credentials FROM user_custodians WHERE credentials IS NOT NULL AND credentials NOT LIKE ?`,
+			encryptedCredentialsPrefix+"%")
+		if err != nil {
+			return err
+		}
+		type plain struct {
+			userID, custID int32
+			credentials    string
+		}
+		var found []plain
+		for rows.Next() {
+			var p plain
+			if err := rows.Scan(&p.userID, &p.custID, &p.credentials); err != nil {
+				rows.Close()
+				return err
+			}
+			found = append(found, p)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		for _, p := range found {
+			sealed, err := s.cipher.seal(p.userID, p.custID, []byte(p.credentials))
+			if err != nil {
+				return err
+			}
+			_, err = tx.ExecContext(ctx, `UPDATE user_custodians SET credentials = ? WHERE user_id = ? AND custodian_id = ?`, sealed, p.userID, p.custID)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// inTx runs f in a transaction, committed unless f returns an error
+func (s *SQLUserStore) inTx(ctx context.Context, f func(*sql.Tx) error) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if err := f(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// Populate adds the fake User to an empty store
+func (s *SQLUserStore) Populate() error {
+	ctx := context.Background()
+	var users int
+	if err := s.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM users`).Scan(&users); err != nil {
+		return err
+	}
+	if users > 0 {
+		return nil
+	}
+	fakeuser := model.NewUser(1)
+	fakeuser.Custodians = []int32{1, 2, 3, 4}
+	return s.AddUser(ctx, fakeuser)
+}
+
+func (s *SQLUserStore) GetUser(ctx context.Context, id int32) (*model.User, error) {
+	return s.getUser(ctx, s.db, id)
+}
+
+// getUser reads the user and its custodians
+func (s *SQLUserStore) getUser(ctx context.Context, q queryer, id int32) (*model.User, error) {
+	user := model.NewUser(id)
+	err := q.QueryRowContext(ctx, `SELECT version FROM users WHERE id = ?`, id).Scan(&user.Version)
+	if err == sql.ErrNoRows {
+		return nil, UserNotFoundError
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := q.QueryContext(ctx, `SELECT custodian_id, adapter, credentials FROM user_custodians WHERE user_id = ? ORDER BY position`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var custID int32
+		var adapter, credentials sql.NullString
+		if err := rows.Scan(&custID, &adapter, &credentials); err != nil {
+			return nil, err
+		}
+		user.Custodians = append(user.Custodians, custID)
+		if !adapter.Valid {
+			continue
+		}
+
+		link := &model.CustodianLink{Adapter: adapter.String}
+		if credentials.Valid {
+			data, err := s.credentials(id, custID, credentials.String)
+			if err != nil {
+				return nil, fmt.Errorf("invalid credentials of custodian %d of user %d: %w", custID, id, err)
+			}
+			if err := json.Unmarshal(data, &link.Credentials); err != nil {
+				return nil, fmt.Errorf("invalid credentials of custodian %d of user %d: %w", custID, id, err)
+			}
+		}
+		if user.Links == nil {
+			user.Links = make(map[int32]*model.CustodianLink)
+		}
+		user.Links[custID] = link
+	}
+	return user, rows.Err()
+}
+
+func (s *SQLUserStore) AddUser(ctx context.Context, user *model.User) error {
+	return s.inTx(ctx, func(tx *sql.Tx) error {
+		if user.ID == 0 {
+			if err := tx.QueryRowContext(ctx, `SELECT COALESCE(MAX(id), 0) + 1 FROM users`).Scan(&user.ID); err != nil {
+				return err
+			}
+		}
+
+		var found int32
+		err := tx.QueryRowContext(ctx, `SELECT id FROM users WHERE id = ?`, user.ID).Scan(&found)
+		if err == nil {
+			return UserAlreadyExistsError
+		}
+		if err != sql.ErrNoRows {
+			return err
+		}
+
+		if _, err := tx.ExecContext(ctx, `INSERT INTO users (id, version) VALUES (?, 1)`, user.ID); err != nil {
+			return err
+		}
+		user.Version = 1
+		return s.insertCustodians(ctx, tx, user, 0)
+	})
+}
+
+// incrementVersion increments the version of the user, unless it was modified since its version
+func incrementVersion(ctx context.Context, tx *sql.Tx, id int32, version int64) error {
+	res, err := tx.ExecContext(ctx, `UPDATE users SET version = version + 1 WHERE id = ? AND version = ?`, id, version)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 1 {
+		return err
+	}
+	return versionError(ctx, tx, id)
+}
+
+// versionError tells why the user with the ID didn't have the expected version: it doesn't exist, or it was modified
+func versionError(ctx context.Context, tx *sql.Tx, id int32) error {
+	var found int32
+	err := tx.QueryRowContext(ctx, `SELECT id FROM users WHERE id = ?`, id).Scan(&found)
+	if err == sql.ErrNoRows {
+		return UserNotFoundError
+	}
+	if err != nil {
+		return err
+	}
+	return UserVersionConflictError
+}
+
+func (s *SQLUserStore) UpdateUser(ctx context.Context, user *model.User) error {
+	err := s.inTx(ctx, func(tx *sql.Tx) error {
+		if err := incrementVersion(ctx, tx, user.ID, user.Version); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, `DELETE FROM user_custodians WHERE user_id = ?`, user.ID); err != nil {
+			return err
+		}
+		return s.insertCustodians(ctx, tx, user, 0)
+	})
+	if err != nil {
+		return err
+	}
+	user.Version++
+	return nil
+}
+
+func (s *SQLUserStore) DeleteUser(ctx context.Context, id int32, version int64) error {
+	return s.inTx(ctx, func(tx *sql.Tx) error {
+		res, err := tx.ExecContext(ctx, `DELETE FROM users WHERE id = ? AND version = ?`, id, version)
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			return err
+		} else if n == 0 {
+			return versionError(ctx, tx, id)
+		}
+		// the custodians are deleted too without foreign keys
+		_, err = tx.ExecContext(ctx, `DELETE FROM user_custodians WHERE user_id = ?`, id)
+		return err
+	})
+}
+
+func (s *SQLUserStore) ListUsers(ctx context.Context, after int32, limit int) ([]*model.User, error) {
+	if limit <= 0 {
+		limit = -1
+	}
+	users := make([]*model.User, 0)
+	err := s.inTx(ctx, func(tx *sql.Tx) error {
+		rows, err := tx.QueryContext(ctx, `SELECT id FROM users WHERE id > ? ORDER BY id LIMIT ?`, after, limit)
+		if err != nil {
+			return err
+		}
+		var ids []int32
+		for rows.Next() {
+			var id int32
+			if err := rows.Scan(&id); err != nil {
+				rows.Close()
+				return err
+			}
+			ids = append(ids, id)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		for _, id := range ids {
+			u, err := s.getUser(ctx, tx, id)
+			if err != nil {
+				return err
+			}
+			users = append(users, u)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+func (s *SQLUserStore) LinkCustodian(ctx context.Context, id int32, version int64, custID int32, link *model.CustodianLink) (*model.User, error) {
+	var user *model.User
+	err := s.inTx(ctx, func(tx *sql.Tx) error {
+		if err := incrementVersion(ctx, tx, id, version); err != nil {
+			return err
+		}
+		// a custodian linked already is replaced at its position, a new one is inserted after the others
+		var position int
+		err := tx.QueryRowContext(ctx, `SELECT position FROM user_custodians WHERE user_id = ? AND custodian_id = ?`, id, custID).Scan(&position)
+		switch err {
+		case nil:
+			if _, err := tx.ExecContext(ctx, `DELETE FROM user_custodians WHERE user_id = ? AND custodian_id = ?`, id, custID); err != nil {
+				return err
+			}
+		case sql.ErrNoRows:
+			err := tx.QueryRowContext(ctx, `SELECT COALESCE(MAX(position), -1) + 1 FROM user_custodians WHERE user_id = ?`, id).Scan(&position)
+			if err != nil {
+				return err
+			}
+		default:
+			return err
+		}
+
+		linked := model.NewUser(id)
+		linked.Custodians = []int32{custID}
+		if link != nil {
+			linked.Links = map[int32]*model.CustodianLink{custID: link}
+		}
+		if err := s.insertCustodians(ctx, tx, linked, position); err != nil {
+			return err
+		}
+		user, err = s.getUser(ctx, tx, id)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+func (s *SQLUserStore) UnlinkCustodian(ctx context.Context, id int32, version int64, custID int32) (*model.User, error) {
+	var user *model.User
+	err := s.inTx(ctx, func(tx *sql.Tx) error {
+		if err := incrementVersion(ctx, tx, id, version); err != nil {
+			return err
+		}
+		res, err := tx.ExecContext(ctx, `DELETE FROM user_custodians WHERE user_id = ? AND custodian_id = ?`, id, custID)
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			return err
+		} else if n == 0 {
+			return CustodianNotLinkedError
+		}
+		user, err = s.getUser(ctx, tx, id)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// credentials returns the JSON credentials of a link, decrypted when they're encrypted
+func (s *SQLUserStore) credentials(userID, custID int32, stored string) ([]byte, error) {
+	if !strings.HasPrefix(stored, encryptedCredentialsPrefix) {
+		return []byte(stored), nil
+	}
+	if s.cipher == nil {
+		return nil, fmt.Errorf("the credentials are encrypted, the store needs their key")
+	}
+	return s.cipher.open(userID, custID, stored)
+}
+
+// insertCustodians inserts the linked custodians of the user, and how they're reached, from the position.
+// The links of custodians the user doesn't link aren't kept.
+func (s *SQLUserStore) insertCustodians(ctx context.Context, tx *sql.Tx, user *model.User, position int) error {
+	for i, custID := range user.Custodians {
+		var adapter, credentials sql.NullString
+		if link := user.Link(custID); link != nil {
+			adapter = sql.NullString{String: link.Adapter, Valid: true}
+			if link.Credentials != nil {
+				data, err := json.Marshal(link.Credentials)
+				if err != nil {
+					return err
+				}
+				stored := string(data)
+				if s.cipher != nil {
+					if stored, err = s.cipher.seal(user.ID, custID, data); err != nil {
+						return err
+					}
+				}
+				credentials = sql.NullString{String: stored, Valid: true}
+			}
+		}
+		_, err := tx.ExecContext(ctx, `INSERT INTO user_custodians (user_id, custodian_id, position, adapter, credentials) VALUES (?, ?, ?, ?, ?)`,
+			user.ID, custID, position+i, adapter, credentials)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func init() {
+	// Check interface implementation
+	var _ UserStore = (*SQLUserStore)(nil)
+}
@@ -6,7 +6,9 @@ import (
 	"io/ioutil"
 	"math/rand"
 	"os"
+	"sort"
 	"sync"
+	"time"
 
 	"github.com/bottlepay/portfolio-data/model"
 	"github.com/shopspring/decimal"
@@ -15,10 +17,73 @@ import (
 type Store struct {
 	custodians    []*model.Custodian
 	custodiansMap map[int32]*model.Custodian
+	// when each custodian was last modified
+	modifiedAt map[int32]time.Time
 
 	lock sync.RWMutex
 
 	stateFile string
+	forex     ForexProvider
+	fees      FeePolicy
+	now       func() time.Time
+	// the migrated state file is saved by NewStore
+	snapshotMigration bool
+}
+
+// FeePolicy is what the custodians charge for the events, no fee by default
+type FeePolicy struct {
+	// TransferPercent and TransferFlat are charged by the sending custodian of a transfer, in the sent asset
+	TransferPercent decimal.Decimal
+	TransferFlat    map[string]decimal.Decimal
+	// ForexPercent is charged by a custodian exchanging assets, in the received asset
+	ForexPercent decimal.Decimal
+}
+
+// transferFee is the fee of a transfer of an amount of an asset
+func (p FeePolicy) transferFee(code string, amount decimal.Decimal) decimal.Decimal {
+	return amount.Mul(p.TransferPercent).Div(decimal.NewFromInt(100)).Add(p.TransferFlat[code]).RoundBank(8)
+}
+
+// forexFee is the fee of an exchange for an amount of an asset
+func (p FeePolicy) forexFee(amount decimal.Decimal) decimal.Decimal {
+	return amount.Mul(p.ForexPercent).Div(decimal.NewFromInt(100)).RoundBank(8)
+}
+
+// StoreOption configures a Store
+type StoreOption func(*Store)
+
+// WithClock sets the clock stamping the new transactions
+func WithClock(now func() time.Time) StoreOption {
+	return func(s *Store) {
+		s.now = now
+	}
+}
+
+// WithForexProvider sets the rates used to convert the transfers between assets
+func WithForexProvider(p ForexProvider) StoreOption {
+	return func(s *Store) {
+		s.forex = p
+	}
+}
+
+// WithFees sets the fees charged on the transfers and the exchanges
+func WithFees(p FeePolicy) StoreOption {
+	return func(s *Store) {
+		s.fees = p
+	}
+}
+
+// WithMigrationSnapshot saves the state file when NewStore migrated it. Without it, the migration
+// is only kept in memory, so that the stores opened to read the state never rewrite the file.
+func WithMigrationSnapshot() StoreOption {
+	return func(s *Store) {
+		s.snapshotMigration = true
+	}
+}
+
+// Forex returns the rates used by the store
+func (s *Store) Forex() ForexProvider {
+	return s.forex
 }
 
 // IsEmpty returns true if the store is currently empty
@@ -42,6 +107,7 @@ func (s *Store) AddCustodian(c ...*model.Custodian) {
 		custodian.ID = startID + int32(idx) + 1
 		s.custodiansMap[custodian.ID] = custodian
 	}
+	s.touch(c...)
 
 	s.custodians = append(s.custodians, c...)
 }
@@ -55,6 +121,81 @@ func (s *Store) GetCustodian(id int32) *model.Custodian {
 	return custodian
 }
 
+// GetCustodianVersion returns the ID of the last transaction of the custodian, and when it was last modified.
+// found is false when there's no such custodian.
+func (s *Store) GetCustodianVersion(id int32) (lastTxID int32, modifiedAt time.Time, found bool) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	custodian, found := s.custodiansMap[id]
+	if !found {
+		return 0, time.Time{}, false
+	}
+	return custodian.LastTransactionID(), s.modifiedAt[id], true
+}
+
+// GetCustodianCopy returns a copy of the custodian, which can be used without the lock, with the ID of its last
+// transaction and when it was last modified. They're read together, so the version is the one of the copy.
+// The custodian is nil when there's no such custodian.
+func (s *Store) GetCustodianCopy(id int32) (custodian *model.Custodian, lastTxID int32, modifiedAt time.Time) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	c, found := s.custodiansMap[id]
+	if !found {
+		return nil, 0, time.Time{}
+	}
+	return copyCustodian(c, c.Transactions), c.LastTransactionID(), s.modifiedAt[id]
+}
+
+// copyCustodian copies the custodian with the transactions, it must be called with the lock held.
+// The balances are modified in place by the events, but the transactions never change once added.
+func copyCustodian(c *model.Custodian, txs []*model.Transaction) *model.Custodian {
+	assets := make([]*model.Asset, 0, len(c.Assets))
+	for _, a := range c.Assets {
+		copied := *a
+		assets = append(assets, &copied)
+	}
+	return &model.Custodian{
+		ID:           c.ID,
+		Assets:       assets,
+		Transactions: append([]*model.Transaction{}, txs...),
+	}
+}
+
+// GetCustodianSince gets a copy of a custodian with only the transactions after the since ID,
+// limit of them at most. A limit of 0 returns all of them. Like GetCustodianCopy, it also returns
+// the ID of the last transaction of the custodian and when it was last modified.
+func (s *Store) GetCustodianSince(id int32, since int32, limit int) (custodian *model.Custodian, lastTxID int32, modifiedAt time.Time) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	custodian, found := s.custodiansMap[id]
+	if !found {
+		return nil, 0, time.Time{}
+	}
+
+	// transactions are sorted by ID
+	txs := custodian.Transactions
+	start := sort.Search(len(txs), func(i int) bool {
+		return txs[i].ID > since
+	})
+	txs = txs[start:]
+	if limit > 0 && len(txs) > limit {
+		txs = txs[:limit]
+	}
+
+	return copyCustodian(custodian, txs), custodian.LastTransactionID(), s.modifiedAt[id]
+}
+
+// touch marks the custodians as modified now, it must be called with the lock held
+func (s *Store) touch(c ...*model.Custodian) {
+	now := s.now()
+	for _, custodian := range c {
+		s.modifiedAt[custodian.ID] = now
+	}
+}
+
 // GetCustodiansWithoutTransactions gets a clone of the custodians list without their transactions
 func (s *Store) GetCustodiansWithoutTransactions() []*model.Custodian {
 	s.lock.RLock()
@@ -129,6 +270,9 @@ func (s *Store) AddRandomEvent() error {
 		}
 	}
 
+	// All the transactions of the event happen now
+	timestamp := s.now().UTC().Truncate(time.Second)
+
 	// Determine the amount to use for this transaction.
 	// We'll use up to 20% of the current balance.
 	percentage := rand.Intn(20)
@@ -140,6 +284,7 @@ func (s *Store) AddRandomEvent() error {
 			Asset:              asset.Code,
 			Amount:             amount,
 			Direction:          model.DirectionOut,
+			Timestamp:          timestamp,
 			RelatedCustodianID: otherCustodian.ID,
 		}
 
@@ -147,12 +292,13 @@ func (s *Store) AddRandomEvent() error {
 			Asset:              otherAsset.Code,
 			Amount:             amount,
 			Direction:          model.DirectionIn,
+			Timestamp:          timestamp,
 			RelatedCustodianID: custodian.ID,
 		}
 
 		// If the assets are different then do forex
 		if asset.Code != otherAsset.Code {
-			rate, err := ForexRate(asset.Code, otherAsset.Code)
+			rate, err := s.forex.Rate(asset.Code, otherAsset.Code)
 			if err != nil {
 				return fmt.Errorf("error converting %s to %s", asset.Code, otherAsset.Code)
 			}
@@ -160,6 +306,26 @@ func (s *Store) AddRandomEvent() error {
 			transactionIn.Amount = transactionIn.Amount.Mul(rate)
 		}
 
+		// The custodian sending to another one charges a transfer fee, and the custodian
+		// exchanging its assets a forex fee. The fee can't take more than the balance left.
+		var fee decimal.Decimal
+		var feeTransaction *model.Transaction
+		var feeAsset *model.Asset
+		if otherCustodian.ID != custodian.ID {
+			fee = s.fees.transferFee(asset.Code, amount)
+			if left := asset.Balance.Sub(amount); fee.GreaterThan(left) {
+				fee = decimal.Max(left, decimal.Zero)
+			}
+			feeTransaction, feeAsset = transactionOut, asset
+		} else {
+			fee = decimal.Min(s.fees.forexFee(transactionIn.Amount), transactionIn.Amount)
+			feeTransaction, feeAsset = transactionIn, otherAsset
+		}
+		if fee.IsPositive() {
+			feeTransaction.Fee = &fee
+			feeTransaction.FeeAsset = feeTransaction.Asset
+		}
+
 		// Add the transactions to the custodians
 		custodian.AddTransaction(transactionOut)
 		otherCustodian.AddTransaction(transactionIn)
@@ -167,11 +333,16 @@ func (s *Store) AddRandomEvent() error {
 		// Modify the asset balances
 		asset.Balance = asset.Balance.Sub(transactionOut.Amount).RoundBank(8)
 		otherAsset.Balance = otherAsset.Balance.Add(transactionIn.Amount).RoundBank(8)
+		if fee := feeTransaction.FeePaid(); fee != nil {
+			feeAsset.Balance = feeAsset.Balance.Sub(fee.Balance).RoundBank(8)
+		}
 
 		// Make the transactions reference each other
 		transactionOut.RelatedCustodianTransactionID = transactionIn.ID
 		transactionIn.RelatedCustodianTransactionID = transactionOut.ID
 
+		s.touch(custodian, otherCustodian)
+
 		return nil
 	}
 
@@ -180,6 +351,7 @@ func (s *Store) AddRandomEvent() error {
 		Asset:     asset.Code,
 		Amount:    amount,
 		Direction: model.DirectionIn,
+		Timestamp: timestamp,
 	}
 	if rand.Intn(10) < 5 {
 		transaction.Direction = model.DirectionOut
@@ -189,12 +361,13 @@ func (s *Store) AddRandomEvent() error {
 		asset.Balance = asset.Balance.Add(transaction.Amount).RoundBank(8)
 	}
 	custodian.AddTransaction(transaction)
+	s.touch(custodian)
 
 	return nil
 }
 
 // NewStore creates a new data Store, persisted to stateFile
-func NewStore(stateFile string) (*Store, error) {
+func NewStore(stateFile string, opts ...StoreOption) (*Store, error) {
 	// Read the existing state file (if it exists)
 	stateData, err := ioutil.ReadFile(stateFile)
 	if err != nil && !os.IsNotExist(err) {
@@ -204,6 +377,12 @@ func NewStore(stateFile string) (*Store, error) {
 	store := &Store{
 		stateFile:     stateFile,
 		custodiansMap: make(map[int32]*model.Custodian),
+		modifiedAt:    make(map[int32]time.Time),
+		forex:         DefaultForexProvider(),
+		now:           time.Now,
+	}
+	for _, opt := range opts {
+		opt(store)
 	}
 
 	// Unmarshal the data if we have any
@@ -218,5 +397,21 @@ func NewStore(stateFile string) (*Store, error) {
 		store.custodiansMap[c.ID] = c
 	}
 
+	// The state file doesn't say when each custodian was modified, its own modification time will do
+	modifiedAt := time.Now()
+	if info, err := os.Stat(stateFile); err == nil {
+		modifiedAt = info.ModTime()
+	}
+	for _, c := range store.custodians {
+		store.modifiedAt[c.ID] = modifiedAt
+	}
+
+	// State files saved before the transactions had a timestamp are migrated
+	if migrateTimestamps(store.custodians, modifiedAt) && store.snapshotMigration {
+		if err := store.Snapshot(); err != nil {
+			return nil, err
+		}
+	}
+
 	return store, nil
 }
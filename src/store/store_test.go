@@ -0,0 +1,139 @@
+package store
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bottlepay/portfolio-data/model"
+	"github.com/shopspring/decimal"
+)
+
+func TestStore_AddRandomEvent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	now := time.Date(2021, 5, 20, 10, 0, 0, 500, time.UTC)
+	s, err := NewStore(filepath.Join(dir, "state.json"), WithClock(func() time.Time { return now }))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.AddCustodian(&model.Custodian{Assets: []*model.Asset{
+		{Code: "BTC", Balance: decimal.NewFromInt(10)},
+		{Code: "GBP", Balance: decimal.NewFromInt(1000)},
+	}})
+
+	for i := 0; i < 10; i++ {
+		if err := s.AddRandomEvent(); err != nil {
+			t.Fatal(err)
+		}
+		now = now.Add(time.Minute)
+	}
+
+	for i, tx := range s.GetCustodian(1).Transactions {
+		if tx.Timestamp.Before(time.Date(2021, 5, 20, 10, 0, 0, 0, time.UTC)) || tx.Timestamp.After(now) || tx.Timestamp.Nanosecond() != 0 {
+			t.Errorf("transaction %d has an unexpected timestamp %v", i, tx.Timestamp)
+		}
+	}
+	if _, modifiedAt, _ := s.GetCustodianVersion(1); !modifiedAt.Equal(now.Add(-time.Minute)) {
+		t.Errorf("expected the custodian modified by the last event, got %v", modifiedAt)
+	}
+}
+
+func TestStore_AddRandomEvent_fees(t *testing.T) {
+	dir, err := ioutil.TempDir("", "store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := NewStore(filepath.Join(dir, "state.json"), WithFees(FeePolicy{
+		TransferPercent: decimal.NewFromInt(1),
+		TransferFlat:    map[string]decimal.Decimal{"BTC": decimal.RequireFromString("0.0001")},
+		ForexPercent:    decimal.RequireFromString("0.5"),
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	opening := func() []*model.Asset {
+		return []*model.Asset{
+			{Code: "BTC", Balance: decimal.NewFromInt(10)},
+			{Code: "GBP", Balance: decimal.NewFromInt(1000)},
+		}
+	}
+	s.AddCustodian(&model.Custodian{Assets: opening()}, &model.Custodian{Assets: opening()})
+
+	for i := 0; i < 200; i++ {
+		if err := s.AddRandomEvent(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the fees are taken from the balances, the amounts aren't rounded like the balances
+	tolerance := decimal.RequireFromString("0.000001")
+	fees := 0
+	for _, id := range []int32{1, 2} {
+		c := s.GetCustodian(id)
+		fees += len(c.Fees())
+		if r := model.Reconcile(c, opening(), tolerance); !r.Reconciled {
+			for _, a := range r.Assets {
+				t.Errorf("custodian %d doesn't reconcile %s with its fees: %+v", id, a.Code, a)
+			}
+		}
+		for _, a := range c.Assets {
+			if a.Balance.IsNegative() {
+				t.Errorf("custodian %d has a negative %s balance %s", id, a.Code, a.Balance)
+			}
+		}
+	}
+	if fees == 0 {
+		t.Error("expected fees")
+	}
+}
+
+func TestStore_GetCustodianCopy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	now := time.Date(2021, 5, 20, 10, 0, 0, 0, time.UTC)
+	s, err := NewStore(filepath.Join(dir, "state.json"), WithClock(func() time.Time { return now }))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.AddCustodian(&model.Custodian{Assets: []*model.Asset{
+		{Code: "BTC", Balance: decimal.NewFromInt(10)},
+		{Code: "GBP", Balance: decimal.NewFromInt(1000)},
+	}})
+	if err := s.AddRandomEvent(); err != nil {
+		t.Fatal(err)
+	}
+
+	c, lastTxID, modifiedAt := s.GetCustodianCopy(1)
+	if c == nil || lastTxID != c.LastTransactionID() || !modifiedAt.Equal(now) {
+		t.Fatalf("expected the version of the copy, got %d at %v for %+v", lastTxID, modifiedAt, c)
+	}
+	btc, txs := c.Assets[0].Balance, len(c.Transactions)
+
+	// the events don't modify the copy
+	now = now.Add(time.Minute)
+	for i := 0; i < 10; i++ {
+		if err := s.AddRandomEvent(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !c.Assets[0].Balance.Equal(btc) || len(c.Transactions) != txs || c.LastTransactionID() != lastTxID {
+		t.Errorf("the copy was modified by the events: %+v", c)
+	}
+
+	if c, _, _ := s.GetCustodianCopy(2); c != nil {
+		t.Errorf("expected no custodian 2, got %+v", c)
+	}
+}
@@ -3,23 +3,66 @@ package store
 import (
 	"context"
 	"fmt"
+	"sort"
 	"sync"
 
 	"github.com/bottlepay/portfolio-data/model"
 )
 
 var (
-	UserNotFoundError      = fmt.Errorf("User not found")
-	UserAlreadyExistsError = fmt.Errorf("User exists already")
+	UserNotFoundError        = fmt.Errorf("User not found")
+	UserAlreadyExistsError   = fmt.Errorf("User exists already")
+	UserVersionConflictError = fmt.Errorf("User was modified since this version")
+	CustodianNotLinkedError  = fmt.Errorf("Custodian not linked")
 )
 
 // UserStore is used to store and get users
 // context and error will be needed for a real world implementation
+//
+// Each modification of a user increments its Version. The modifications are made from a version
+// of the user, and fail with UserVersionConflictError when it was modified since.
 type UserStore interface {
 	// GetUser returns a model.User corresponding to the int32 ID
 	GetUser(context.Context, int32) (*model.User, error)
-	// AddUser adds a model.User to the store
+	// AddUser adds a model.User to the store, at Version 1.
+	// A user without an ID gets the next one.
 	AddUser(context.Context, *model.User) error
+	// UpdateUser replaces the custodians and links of a model.User, from its Version, and increments it
+	UpdateUser(context.Context, *model.User) error
+	// DeleteUser deletes the user with the int32 ID, from its version
+	DeleteUser(ctx context.Context, id int32, version int64) error
+	// ListUsers returns up to limit users with an ID after the given one, sorted by ID. 0 doesn't limit them.
+	ListUsers(ctx context.Context, after int32, limit int) ([]*model.User, error)
+	// LinkCustodian links a custodian to the user, from its version, reached with the link.
+	// A custodian linked already keeps its position, with the new link. A nil link uses the default adapter.
+	LinkCustodian(ctx context.Context, id int32, version int64, custID int32, link *model.CustodianLink) (*model.User, error)
+	// UnlinkCustodian unlinks a custodian from the user, from its version
+	UnlinkCustodian(ctx context.Context, id int32, version int64, custID int32) (*model.User, error)
+}
+
+// copyUser copies a user, so that the users of the store are never shared
+func copyUser(u *model.User) *model.User {
+	c := *u
+	c.Custodians = append([]int32{}, u.Custodians...)
+	if u.Links != nil {
+		c.Links = make(map[int32]*model.CustodianLink, len(u.Links))
+		for id, link := range u.Links {
+			c.Links[id] = copyLink(link)
+		}
+	}
+	return &c
+}
+
+// copyLink copies a link with its credentials
+func copyLink(link *model.CustodianLink) *model.CustodianLink {
+	c := *link
+	if link.Credentials != nil {
+		c.Credentials = make(map[string]string, len(link.Credentials))
+		for k, v := range link.Credentials {
+			c.Credentials[k] = v
+		}
+	}
+	return &c
 }
 
 // FakeUserStore stores users in memory
@@ -49,7 +92,7 @@ func (s *FakeUserStore) GetUser(context context.Context, id int32) (*model.User,
 	defer s.l.RUnlock()
 
 	if u, found := s.usersMap[id]; found {
-		return u, nil
+		return copyUser(u), nil
 	}
 	return nil, UserNotFoundError
 }
@@ -58,13 +101,126 @@ func (s *FakeUserStore) AddUser(context context.Context, user *model.User) error
 	s.l.Lock()
 	defer s.l.Unlock()
 
+	if user.ID == 0 {
+		for id := range s.usersMap {
+			if id > user.ID {
+				user.ID = id
+			}
+		}
+		user.ID++
+	}
 	if _, exists := s.usersMap[user.ID]; exists {
 		return UserAlreadyExistsError
 	}
-	s.usersMap[user.ID] = user
+	user.Version = 1
+	s.usersMap[user.ID] = copyUser(user)
+	return nil
+}
+
+// modify modifies the user with f, from its version, and increments it
+func (s *FakeUserStore) modify(id int32, version int64, f func(*model.User) error) (*model.User, error) {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	u, found := s.usersMap[id]
+	if !found {
+		return nil, UserNotFoundError
+	}
+	if u.Version != version {
+		return nil, UserVersionConflictError
+	}
+	modified := copyUser(u)
+	if err := f(modified); err != nil {
+		return nil, err
+	}
+	modified.Version++
+	s.usersMap[id] = modified
+	return copyUser(modified), nil
+}
+
+func (s *FakeUserStore) UpdateUser(context context.Context, user *model.User) error {
+	updated, err := s.modify(user.ID, user.Version, func(u *model.User) error {
+		update := copyUser(user)
+		u.Custodians, u.Links = update.Custodians, update.Links
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	user.Version = updated.Version
 	return nil
 }
 
+func (s *FakeUserStore) DeleteUser(context context.Context, id int32, version int64) error {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	u, found := s.usersMap[id]
+	if !found {
+		return UserNotFoundError
+	}
+	if u.Version != version {
+		return UserVersionConflictError
+	}
+	delete(s.usersMap, id)
+	return nil
+}
+
+func (s *FakeUserStore) ListUsers(context context.Context, after int32, limit int) ([]*model.User, error) {
+	s.l.RLock()
+	defer s.l.RUnlock()
+
+	users := make([]*model.User, 0)
+	for id, u := range s.usersMap {
+		if id > after {
+			users = append(users, u)
+		}
+	}
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].ID < users[j].ID
+	})
+	if limit > 0 && len(users) > limit {
+		users = users[:limit]
+	}
+	for i, u := range users {
+		users[i] = copyUser(u)
+	}
+	return users, nil
+}
+
+func (s *FakeUserStore) LinkCustodian(context context.Context, id int32, version int64, custID int32, link *model.CustodianLink) (*model.User, error) {
+	return s.modify(id, version, func(u *model.User) error {
+		if !u.Linked(custID) {
+			u.Custodians = append(u.Custodians, custID)
+		}
+		delete(u.Links, custID)
+		if link != nil {
+			if u.Links == nil {
+				u.Links = make(map[int32]*model.CustodianLink)
+			}
+			u.Links[custID] = copyLink(link)
+		}
+		return nil
+	})
+}
+
+func (s *FakeUserStore) UnlinkCustodian(context context.Context, id int32, version int64, custID int32) (*model.User, error) {
+	return s.modify(id, version, func(u *model.User) error {
+		if !u.Linked(custID) {
+			return CustodianNotLinkedError
+		}
+		custodians := make([]int32, 0, len(u.Custodians)-1)
+		for _, each := range u.Custodians {
+			if each != custID {
+				custodians = append(custodians, each)
+			}
+		}
+		u.Custodians = custodians
+		delete(u.Links, custID)
+		return nil
+	})
+}
+
 func init() {
 	// Check interface implementation
 	var _ UserStore = (*FakeUserStore)(nil)
@@ -2,38 +2,314 @@ package store
 
 import (
 	"context"
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
 
 	"github.com/bottlepay/portfolio-data/model"
 )
 
-func TestFakeUserStore(t *testing.T) {
-
-	store := NewFakeUserStore()
+// testUserStore is the conformance suite of the UserStore implementations,
+// store must be empty and populate must add the fake user to it
+func testUserStore(t *testing.T, store UserStore, populate func()) {
+	ctx := context.Background()
 
-	if len(store.usersMap) != 0 {
-		t.Error("Store isn't empty after creation")
-	}
-
-	if _, err := store.GetUser(context.Background(), 1); err != UserNotFoundError {
+	if _, err := store.GetUser(ctx, 1); err != UserNotFoundError {
 		t.Error("GetUser should fail with UserNotFoundError")
 	}
 
-	store.Populate()
+	populate()
 
-	if len(store.usersMap) != 1 {
-		t.Error("Store Populate() didn't work")
+	fakeuser, err := store.GetUser(ctx, 1)
+	if err != nil || !reflect.DeepEqual(fakeuser.Custodians, []int32{1, 2, 3, 4}) {
+		t.Errorf("Store Populate() didn't work, got %+v, %v", fakeuser, err)
 	}
 
 	anotherUser := model.NewUser(2)
-	error := store.AddUser(context.Background(), anotherUser)
-	if error != nil || len(store.usersMap) != 2 {
+	error := store.AddUser(ctx, anotherUser)
+	if error != nil {
 		t.Error("Store AddUser for second user failed")
 	}
+	if u, err := store.GetUser(ctx, 2); err != nil || u.ID != 2 || len(u.Custodians) != 0 {
+		t.Errorf("Store GetUser for second user failed, got %+v, %v", u, err)
+	}
 
 	anotherUser2 := model.NewUser(2)
-	retryerror := store.AddUser(context.Background(), anotherUser2)
+	retryerror := store.AddUser(ctx, anotherUser2)
 	if retryerror != UserAlreadyExistsError {
 		t.Error("Store AddUser should prevent duplicates by ID")
 	}
+
+	// the custodians keep their order, and their links
+	linked := model.NewUser(3)
+	linked.Custodians = []int32{7, 5, 6}
+	linked.Links = map[int32]*model.CustodianLink{
+		5: {Adapter: "coinbase", Credentials: map[string]string{"api_key": "key", "api_secret": "secret"}},
+		6: {Adapter: "mock"},
+	}
+	if err := store.AddUser(ctx, linked); err != nil {
+		t.Fatal(err)
+	}
+	u, err := store.GetUser(ctx, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(u.Custodians, linked.Custodians) || !reflect.DeepEqual(u.Links, linked.Links) {
+		t.Errorf("expected %+v, got %+v", linked, u)
+	}
+
+	testUserLifecycle(t, store)
+}
+
+// testUserLifecycle modifies the users 1, 2 and 3 added by testUserStore
+func testUserLifecycle(t *testing.T, store UserStore) {
+	ctx := context.Background()
+
+	// a user without an ID gets the next one
+	added := model.NewUser(0)
+	if err := store.AddUser(ctx, added); err != nil || added.ID != 4 || added.Version != 1 {
+		t.Errorf("expected user 4 at version 1, got %+v, %v", added, err)
+	}
+
+	// the users are paginated by ID
+	page, err := store.ListUsers(ctx, 0, 3)
+	if err != nil || len(page) != 3 || page[0].ID != 1 || page[2].ID != 3 {
+		t.Fatalf("unexpected first page %+v, %v", page, err)
+	}
+	if page, err = store.ListUsers(ctx, 3, 3); err != nil || len(page) != 1 || page[0].ID != 4 {
+		t.Errorf("unexpected last page %+v, %v", page, err)
+	}
+	if page, err = store.ListUsers(ctx, 0, 0); err != nil || len(page) != 4 {
+		t.Errorf("expected every user without a limit, got %+v, %v", page, err)
+	}
+
+	// an update from the current version increments it, the users aren't shared with the store
+	u, _ := store.GetUser(ctx, 2)
+	u.Custodians = []int32{1, 2}
+	if err := store.UpdateUser(ctx, u); err != nil || u.Version != 2 {
+		t.Fatalf("expected user 2 at version 2, got %+v, %v", u, err)
+	}
+	u.Custodians[0] = 9
+	if u, _ := store.GetUser(ctx, 2); !reflect.DeepEqual(u.Custodians, []int32{1, 2}) || u.Version != 2 {
+		t.Errorf("unexpected updated user %+v", u)
+	}
+	stale := model.NewUser(2)
+	stale.Version = 1
+	if err := store.UpdateUser(ctx, stale); err != UserVersionConflictError {
+		t.Errorf("expected a version conflict, got %v", err)
+	}
+	if err := store.UpdateUser(ctx, model.NewUser(10)); err != UserNotFoundError {
+		t.Errorf("expected UserNotFoundError, got %v", err)
+	}
+
+	// the custodians are linked after the others, and unlinked
+	u, err = store.LinkCustodian(ctx, 2, 2, 3, &model.CustodianLink{Adapter: "bitcoin", Credentials: map[string]string{"xpub": "xpub1"}})
+	if err != nil || u.Version != 3 || !reflect.DeepEqual(u.Custodians, []int32{1, 2, 3}) || u.Link(3).Credentials["xpub"] != "xpub1" {
+		t.Fatalf("unexpected linked user %+v, %v", u, err)
+	}
+	if _, err := store.LinkCustodian(ctx, 2, 2, 4, nil); err != UserVersionConflictError {
+		t.Errorf("expected a version conflict, got %v", err)
+	}
+
+	// linking a custodian again replaces its link, at its position
+	u, err = store.LinkCustodian(ctx, 2, 3, 1, &model.CustodianLink{Adapter: "bitcoin", Credentials: map[string]string{"xpub": "xpub2"}})
+	if err != nil || u.Version != 4 || !reflect.DeepEqual(u.Custodians, []int32{1, 2, 3}) || u.Link(1).Credentials["xpub"] != "xpub2" {
+		t.Fatalf("unexpected relinked user %+v, %v", u, err)
+	}
+	u, err = store.LinkCustodian(ctx, 2, 4, 3, nil)
+	if err != nil || u.Version != 5 || !reflect.DeepEqual(u.Custodians, []int32{1, 2, 3}) || u.Link(3) != nil || u.Link(1) == nil {
+		t.Fatalf("expected custodian 3 with the default adapter, got %+v, %v", u, err)
+	}
+
+	if u, err = store.UnlinkCustodian(ctx, 2, 5, 3); err != nil || u.Version != 6 || !reflect.DeepEqual(u.Custodians, []int32{1, 2}) || u.Link(3) != nil {
+		t.Fatalf("unexpected unlinked user %+v, %v", u, err)
+	}
+	if _, err := store.UnlinkCustodian(ctx, 2, 6, 3); err != CustodianNotLinkedError {
+		t.Errorf("expected CustodianNotLinkedError, got %v", err)
+	}
+	if u, err = store.UnlinkCustodian(ctx, 2, 6, 1); err != nil || u.Link(1) != nil {
+		t.Fatalf("expected custodian 1 unlinked with its link, got %+v, %v", u, err)
+	}
+	if u, err = store.LinkCustodian(ctx, 2, 7, 1, nil); err != nil || !reflect.DeepEqual(u.Custodians, []int32{2, 1}) || u.Version != 8 {
+		t.Errorf("unexpected relinked user %+v, %v", u, err)
+	}
+	if _, err := store.LinkCustodian(ctx, 10, 1, 1, nil); err != UserNotFoundError {
+		t.Errorf("expected UserNotFoundError, got %v", err)
+	}
+
+	// a user is deleted from its current version
+	if err := store.DeleteUser(ctx, 2, 7); err != UserVersionConflictError {
+		t.Errorf("expected a version conflict, got %v", err)
+	}
+	if err := store.DeleteUser(ctx, 2, 8); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.GetUser(ctx, 2); err != UserNotFoundError {
+		t.Errorf("expected user 2 to be deleted, got %v", err)
+	}
+	if err := store.DeleteUser(ctx, 2, 8); err != UserNotFoundError {
+		t.Errorf("expected UserNotFoundError, got %v", err)
+	}
+	if page, err = store.ListUsers(ctx, 1, 1); err != nil || len(page) != 1 || page[0].ID != 3 {
+		t.Errorf("expected user 3 after user 1, got %+v, %v", page, err)
+	}
+}
+
+func TestFakeUserStore(t *testing.T) {
+	store := NewFakeUserStore()
+	testUserStore(t, store, store.Populate)
+}
+
+func TestSQLUserStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "users.db")
+
+	store, err := OpenSQLiteUserStore(context.Background(), path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testUserStore(t, store, func() {
+		if err := store.Populate(); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	// the users persist, and the migrated schema isn't migrated again
+	store.Close()
+	store, err = OpenSQLiteUserStore(context.Background(), path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if err := store.Populate(); err != nil {
+		t.Fatal(err)
+	}
+	if u, err := store.GetUser(context.Background(), 3); err != nil || len(u.Links) != 2 || u.Version != 1 {
+		t.Errorf("expected user 3 after reopening the store, got %+v, %v", u, err)
+	}
+}
+
+func TestSQLUserStore_migrate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "users.db")
+
+	// a database of the first version of the schema, with a user
+	db, err := sql.Open("sqlite3", "file:"+path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, query := range []string{
+		`CREATE TABLE schema_migrations (version INTEGER PRIMARY KEY)`,
+		userStoreMigrations[0],
+		`INSERT INTO schema_migrations (version) VALUES (1)`,
+		`INSERT INTO users (id) VALUES (5)`,
+		`INSERT INTO user_custodians (user_id, custodian_id, position) VALUES (5, 2, 0)`,
+	} {
+		if _, err := db.Exec(query); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Close()
+
+	store, err := OpenSQLiteUserStore(context.Background(), path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	u, err := store.GetUser(context.Background(), 5)
+	if err != nil || u.Version != 1 || !reflect.DeepEqual(u.Custodians, []int32{2}) {
+		t.Errorf("expected the user at version 1 after the migration, got %+v, %v", u, err)
+	}
+	var version int
+	store.db.QueryRow(`SELECT MAX(version) FROM schema_migrations`).Scan(&version)
+	if version != len(userStoreMigrations) {
+		t.Errorf("expected the schema version %d, got %d", len(userStoreMigrations), version)
+	}
+}
+
+func TestSQLUserStore_credentials(t *testing.T) {
+	dir, err := ioutil.TempDir("", "users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "users.db")
+	ctx := context.Background()
+	key := []byte(strings.Repeat("k", 32))
+
+	// credentials stored in plain text, before the store had a key
+	store, err := OpenSQLiteUserStore(ctx, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("the database should only be readable by its owner, got %v, %v", info.Mode(), err)
+	}
+	plain := model.NewUser(1)
+	plain.Custodians = []int32{5}
+	plain.Links = map[int32]*model.CustodianLink{5: {Adapter: "coinbase", Credentials: map[string]string{"api_secret": "plain-secret"}}}
+	if err := store.AddUser(ctx, plain); err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+
+	// they're encrypted once the store has a key, like the new ones
+	if store, err = OpenSQLiteUserStore(ctx, path, WithCredentialsKey(key)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.LinkCustodian(ctx, 1, 1, 6, &model.CustodianLink{Adapter: "binance", Credentials: map[string]string{"api_secret": "new-secret"}}); err != nil {
+		t.Fatal(err)
+	}
+	rows, err := store.db.Query(`SELECT credentials FROM user_custodians`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for rows.Next() {
+		var stored string
+		rows.Scan(&stored)
+		if !strings.HasPrefix(stored, encryptedCredentialsPrefix) || strings.Contains(stored, "secret") {
+			t.Errorf("expected encrypted credentials, got %s", stored)
+		}
+	}
+	rows.Close()
+	u, err := store.GetUser(ctx, 1)
+	if err != nil || u.Link(5).Credentials["api_secret"] != "plain-secret" || u.Link(6).Credentials["api_secret"] != "new-secret" {
+		t.Errorf("expected the decrypted credentials, got %+v, %v", u, err)
+	}
+
+	// the encrypted credentials can't be moved to another link
+	if _, err := store.db.Exec(`UPDATE user_custodians SET credentials = (SELECT credentials FROM user_custodians WHERE custodian_id = 6) WHERE custodian_id = 5`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.GetUser(ctx, 1); err == nil {
+		t.Error("credentials moved to another link shouldn't be decrypted")
+	}
+	store.Close()
+
+	// they can't be read without the key, or with another one
+	for _, opts := range [][]SQLUserStoreOption{nil, {WithCredentialsKey([]byte(strings.Repeat("x", 32)))}} {
+		if store, err = OpenSQLiteUserStore(ctx, path, opts...); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := store.GetUser(ctx, 1); err == nil {
+			t.Error("the credentials shouldn't be read without their key")
+		}
+		store.Close()
+	}
+
+	if _, err := OpenSQLiteUserStore(ctx, path, WithCredentialsKey([]byte("short"))); err == nil {
+		t.Error("expected an error for a key which isn't 32 bytes")
+	}
 }